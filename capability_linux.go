@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// capNetRaw is the capability bit needed to open an AF_PACKET socket (linux/capability.h)
+const capNetRaw = 13
+
+// hasCaptureCapability reports whether the process has CAP_NET_RAW in its
+// effective set, e.g. from `setcap cap_net_raw+ep`, so it can capture without root
+func hasCaptureCapability() bool {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		debugLog("Failed to read process capabilities: %v", err)
+		return false
+	}
+	defer file.Close()
+
+	capEff, ok := parseCapEff(file)
+	if !ok {
+		debugLog("No CapEff line in /proc/self/status.")
+		return false
+	}
+	debugLog("Effective capabilities: %016x", capEff)
+	return capEff&(1<<capNetRaw) != 0
+}
+
+// parseCapEff returns the effective capability mask from /proc/<pid>/status
+func parseCapEff(r io.Reader) (uint64, bool) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !found {
+			continue
+		}
+		mask, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		return mask, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCapEff(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		mask   uint64
+		ok     bool
+	}{
+		{"cap_net_raw", "Name:\twhichdns\nCapInh:\t0000000000000000\nCapPrm:\t0000000000002000\nCapEff:\t0000000000002000\n", 1 << capNetRaw, true},
+		{"root", "CapEff:\t000001ffffffffff\n", 0x1ffffffffff, true},
+		{"missing", "Name:\twhichdns\nUid:\t1000\t1000\t1000\t1000\n", 0, false},
+		{"malformed", "CapEff:\tzz\n", 0, false},
+	}
+
+	for _, tt := range tests {
+		mask, ok := parseCapEff(strings.NewReader(tt.status))
+		if mask != tt.mask || ok != tt.ok {
+			t.Errorf("%s: got (%x, %v), want (%x, %v)", tt.name, mask, ok, tt.mask, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// hasCaptureCapability always reports false: capabilities are Linux-specific
+func hasCaptureCapability() bool {
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ANSI colours for the result and error lines
+const (
+	colorGreen = "\033[32m"
+	colorRed   = "\033[31m"
+	colorReset = "\033[0m"
+)
+
+// Values of --color
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+var (
+	// colorStdout is set when the result lines are coloured
+	colorStdout bool
+	// colorStderr is set when the error messages are coloured
+	colorStderr bool
+)
+
+// setupColor decides which streams are coloured. With --color auto, a stream
+// is coloured when it is a terminal and NO_COLOR is not set; results written
+// to an --output file never are. It must run after openOutput.
+func setupColor() {
+	switch colorFlag {
+	case colorAlways:
+		colorStdout, colorStderr = true, true
+	case colorNever:
+		colorStdout, colorStderr = false, false
+	default:
+		noColor := os.Getenv("NO_COLOR") != ""
+		colorStdout = !noColor && outputFile == nil && isTerminal(os.Stdout)
+		colorStderr = !noColor && isTerminal(os.Stderr)
+	}
+}
+
+// colorize wraps s in the ANSI color if enabled is set
+func colorize(s, color string, enabled bool) string {
+	if !enabled {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// green colours a result line for stdout
+func green(s string) string {
+	return colorize(s, colorGreen, colorStdout)
+}
+
+// red colours an error message for stderr
+func red(s string) string {
+	return colorize(s, colorRed, colorStderr)
+}
+
+// printError prints a formatted error message on its own line to stderr
+func printError(format string, a ...interface{}) {
+	fmt.Fprintln(os.Stderr, red(fmt.Sprintf(format, a...)))
+}
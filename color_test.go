@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestSetupColor(t *testing.T) {
+	savedFlag, savedStdout, savedStderr := colorFlag, colorStdout, colorStderr
+	defer func() { colorFlag, colorStdout, colorStderr = savedFlag, savedStdout, savedStderr }()
+
+	colorFlag = colorAlways
+	setupColor()
+	if got := green("ok"); got != colorGreen+"ok"+colorReset {
+		t.Errorf("Expected a green result with --color always, got %q", got)
+	}
+	if got := red("failed"); got != colorRed+"failed"+colorReset {
+		t.Errorf("Expected a red error with --color always, got %q", got)
+	}
+
+	// NO_COLOR turns colours off even on a terminal
+	t.Setenv("NO_COLOR", "1")
+	colorFlag = colorAuto
+	setupColor()
+	if colorStdout || colorStderr {
+		t.Error("Expected no colours with NO_COLOR set")
+	}
+
+	colorFlag = colorNever
+	setupColor()
+	if got := green("ok"); got != "ok" {
+		t.Errorf("Expected no colours with --color never, got %q", got)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// completionShells are the shells --completion prints a script for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// writeCompletion writes the completion script of cmd for shell to w. The
+// scripts complete every flag, and call back into the binary for the values
+// of flags such as --interface that depend on the host.
+func writeCompletion(cmd *cobra.Command, w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		return cmd.GenBashCompletionV2(w, true)
+	case "zsh":
+		return cmd.GenZshCompletion(w)
+	case "fish":
+		return cmd.GenFishCompletion(w, true)
+	}
+	return fmt.Errorf("--completion must be one of %s, not %q", strings.Join(completionShells, ", "), shell)
+}
+
+// completeInterfaces completes --interface with the names of the host's
+// network interfaces
+func completeInterfaces(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	var names []string
+	for _, iface := range ifaces {
+		if strings.HasPrefix(iface.Name, toComplete) {
+			names = append(names, iface.Name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// runCompletion prints the --completion script of cmd and exits
+func runCompletion(cmd *cobra.Command) {
+	if err := writeCompletion(cmd, stdout, completionFlag); err != nil {
+		printError("Failed to write the completion script: %v", err)
+		exit(exitCantCreate)
+	}
+	exit(exitOK)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestWriteCompletion(t *testing.T) {
+	for _, shell := range completionShells {
+		var buf bytes.Buffer
+		if err := writeCompletion(rootCmd, &buf, shell); err != nil {
+			t.Errorf("Failed to write the %s completion: %v", shell, err)
+		}
+		if !strings.Contains(buf.String(), "whichdns") {
+			t.Errorf("Expected a %s completion script for whichdns, got %q", shell, buf.String())
+		}
+	}
+	if err := writeCompletion(rootCmd, &bytes.Buffer{}, "tcsh"); err == nil {
+		t.Error("Expected an unsupported shell to be rejected")
+	}
+}
+
+func TestCompleteInterfaces(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil || len(ifaces) == 0 {
+		t.Skipf("No interfaces to complete here: %v", err)
+	}
+	name := ifaces[0].Name
+
+	names, directive := completeInterfaces(rootCmd, nil, name[:1])
+	if !slices.Contains(names, name) || directive != cobra.ShellCompDirectiveNoFileComp {
+		t.Errorf("Expected %s among the completions for %q, got %v (directive %v)", name, name[:1], names, directive)
+	}
+	for _, got := range names {
+		if !strings.HasPrefix(got, name[:1]) {
+			t.Errorf("Expected only names starting with %q, got %s", name[:1], got)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"whichdns/whichdns"
+)
+
+// readDomainsFile reads the --domains-file list, or standard input for "-":
+// one domain per line, skipping blank lines and lines starting with #
+func readDomainsFile(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(domains) == 0 {
+		return nil, errors.New("no domains listed")
+	}
+	return domains, nil
+}
+
+// domainOutcome is the result of one domain's detection in a --domains-file run
+type domainOutcome struct {
+	result whichdns.Result
+	err    error
+	done   bool
+}
+
+// checkDomainsFile checks every domain of a --domains-file run, several at a
+// time over one shared capture, and reports each in the order listed as soon
+// as the ones before it are done. It records the server that answered each
+// domain in servers and returns the exit code of the first failure together
+// with the objects to print in JSON mode. Every domain is checked whatever
+// the earlier ones returned.
+func checkDomainsFile(ctx context.Context, iface *net.Interface, servers []string) (int, []interface{}) {
+	opts := detectOptions("", iface)
+	if !keepRootFlag {
+		opts.OnCaptureOpen = dropPrivileges
+	}
+
+	exitCode := exitOK
+	var jsonResults []interface{}
+	report := func(domain string, result whichdns.Result, err error) {
+		code, out := reportDomain(domain, result, err)
+		jsonResults = append(jsonResults, out)
+		if code != exitOK && exitCode == exitOK {
+			exitCode = code
+		}
+	}
+
+	outcomes := make([]domainOutcome, len(domainFlag))
+	next := 0
+	err := whichdns.DetectDomains(ctx, opts, domainFlag, 0, func(i int, result whichdns.Result, err error) {
+		outcomes[i] = domainOutcome{result: result, err: err, done: true}
+		if err == nil {
+			servers[i] = result.Server.String()
+		}
+		for ; next < len(outcomes) && outcomes[next].done; next++ {
+			report(domainFlag[next], outcomes[next].result, outcomes[next].err)
+		}
+	})
+
+	// A capture that failed to open, or an interrupt, leaves the remaining
+	// domains unchecked; report it once against the first of them
+	if err != nil && next < len(domainFlag) {
+		debugLog("Domains file run stopped after %d of %d domains: %v", next, len(domainFlag), err)
+		report(domainFlag[next], whichdns.Result{}, err)
+	}
+	infoLog("Checked %d of %d domains from %s.", next, len(domainFlag), domainsFileFlag)
+	return exitCode, jsonResults
+}
+
+// loadDomainsFile replaces the default --domain with the domains of
+// --domains-file; domainSet reports whether --domain was given, even as the
+// default domain
+func loadDomainsFile(domainSet bool) error {
+	if domainSet {
+		return errors.New("--domains-file cannot be combined with --domain")
+	}
+	domains, err := readDomainsFile(domainsFileFlag)
+	if err != nil {
+		return fmt.Errorf("--domains-file: %w", err)
+	}
+	domainFlag = domains
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"whichdns/whichdns"
+)
+
+func TestReadDomainsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	content := "# Internal\nintranet.corp.local\n\n  example.com  \n\t# Public\nexample.org\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write domains file: %v", err)
+	}
+	domains, err := readDomainsFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read domains file: %v", err)
+	}
+	want := []string{"intranet.corp.local", "example.com", "example.org"}
+	if !slices.Equal(domains, want) {
+		t.Errorf("Expected %v, got %v", want, domains)
+	}
+
+	// Comments and blank lines alone are not a list
+	if err := os.WriteFile(path, []byte("# nothing yet\n\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write domains file: %v", err)
+	}
+	if _, err := readDomainsFile(path); err == nil {
+		t.Error("Expected a file without domains to be rejected")
+	}
+	if _, err := readDomainsFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("Expected a missing file to be rejected")
+	}
+}
+
+func TestLoadDomainsFile(t *testing.T) {
+	savedDomains, savedFile := domainFlag, domainsFileFlag
+	defer func() { domainFlag, domainsFileFlag = savedDomains, savedFile }()
+
+	domainsFileFlag = filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(domainsFileFlag, []byte("example.com\nexample.org\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write domains file: %v", err)
+	}
+
+	// Even the default domain given explicitly conflicts with the file
+	domainFlag = []string{whichdns.DefaultDomain}
+	if err := loadDomainsFile(true); err == nil {
+		t.Error("Expected --domain to be rejected alongside --domains-file")
+	}
+	if err := loadDomainsFile(false); err != nil {
+		t.Fatalf("Failed to load domains file: %v", err)
+	}
+	if want := []string{"example.com", "example.org"}; !slices.Equal(domainFlag, want) {
+		t.Errorf("Expected %v, got %v", want, domainFlag)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"whichdns/whichdns"
+)
+
+// explaining reports whether --explain narration is on; script modes keep it
+// off so nothing but their output is produced
+func explaining() bool {
+	return explainFlag && !scriptOutput()
+}
+
+// explain prints one line of --explain narration to stderr
+func explain(format string, a ...interface{}) {
+	if explaining() {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+	}
+}
+
+// explainStep describes what a detection of domain on iface is doing as it
+// enters step
+func explainStep(step, domain, iface string) string {
+	switch step {
+	case whichdns.StepOpenCapture:
+		switch {
+		case pcapFlag != "":
+			return fmt.Sprintf("Opening capture file %s…", pcapFlag)
+		case allIfacesFlag:
+			return "Opening capture on every usable interface…"
+		}
+		return fmt.Sprintf("Opening capture on %s…", iface)
+	case whichdns.StepFilter:
+		if pcapFlag == "" && srcFlag == "" && !anyHostFlag {
+			return fmt.Sprintf("Keeping only DNS packets (%s) to or from this host from the capture…", explainTraffic())
+		}
+		return fmt.Sprintf("Keeping only DNS packets (%s) from the capture…", explainTraffic())
+	case whichdns.StepStartCapture:
+		return "Starting the capture before any query is sent, so the response cannot be missed…"
+	case whichdns.StepLookup:
+		queries := "query"
+		count := lookupCount()
+		if count > 1 {
+			queries = "queries"
+		}
+		if count > 1 && probeIntervalFlag > 0 {
+			return fmt.Sprintf("Sending %d DNS %s %s for %s %s, one every %v…", count, strings.ToUpper(typeFlag), queries, domain, explainResolver(), probeIntervalFlag)
+		}
+		return fmt.Sprintf("Sending %d DNS %s %s for %s %s…", count, strings.ToUpper(typeFlag), queries, domain, explainResolver())
+	case whichdns.StepWait:
+		if allFlag || waitFullFlag {
+			return fmt.Sprintf("Waiting up to %v for every response…", timeoutFlag)
+		}
+		return fmt.Sprintf("Waiting up to %v for a response…", timeoutFlag)
+	}
+	return ""
+}
+
+// explainTraffic describes the packets the capture keeps
+func explainTraffic() string {
+	if encryptedFlag {
+		return "TLS to DoT servers and known DoH endpoints"
+	}
+	proto := "UDP and TCP"
+	if protoFlag != whichdns.ProtoAny {
+		proto = strings.ToUpper(protoFlag)
+	}
+	return fmt.Sprintf("%s port %d", proto, portFlag)
+}
+
+// explainResolver describes how the lookups reach a DNS server
+func explainResolver() string {
+	switch {
+	case resolverFlag != "":
+		return "straight to " + resolverIP().String()
+	case pureGoFlag || srcFlag != "" || ednsFlag || dnssecFlag:
+		return "to the configured nameservers"
+	}
+	return "through the system resolver"
+}
+
+// explainOnStep returns an OnStep callback narrating a detection of domain
+// on iface, or nil when --explain is off. The lookups run alongside the wait,
+// so they are described once, before the wait, whichever step comes first.
+func explainOnStep(domain, iface string) func(step string) {
+	if !explaining() {
+		return nil
+	}
+	sent := pcapFlag != "" // A capture file needs no lookups
+	return func(step string) {
+		if !sent && (step == whichdns.StepLookup || step == whichdns.StepWait) {
+			explain("%s", explainStep(whichdns.StepLookup, domain, iface))
+			sent = true
+		}
+		if step != whichdns.StepLookup {
+			explain("%s", explainStep(step, domain, iface))
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"whichdns/whichdns"
+)
+
+func TestExplainStep(t *testing.T) {
+	savedCount, savedType, savedResolver := countFlag, typeFlag, resolverFlag
+	defer func() { countFlag, typeFlag, resolverFlag = savedCount, savedType, savedResolver }()
+
+	countFlag, typeFlag, resolverFlag = 4, "a", ""
+	if got := explainStep(whichdns.StepOpenCapture, "example.com", "eth0"); got != "Opening capture on eth0…" {
+		t.Errorf("Expected the capture interface to be named, got %q", got)
+	}
+	if got := explainStep(whichdns.StepLookup, "example.com", "eth0"); !strings.HasPrefix(got, "Sending 4 DNS A queries for example.com") {
+		t.Errorf("Expected the lookups to be described, got %q", got)
+	}
+
+	countFlag, resolverFlag = 1, "9.9.9.9"
+	if got := explainStep(whichdns.StepLookup, "example.com", "eth0"); got != "Sending 1 DNS A query for example.com straight to 9.9.9.9…" {
+		t.Errorf("Expected a single query to the requested resolver, got %q", got)
+	}
+}
+
+func TestExplainingScriptModes(t *testing.T) {
+	savedExplain, savedJSON := explainFlag, jsonFlag
+	defer func() { explainFlag, jsonFlag = savedExplain, savedJSON }()
+
+	explainFlag, jsonFlag = true, false
+	if !explaining() {
+		t.Error("Expected --explain to narrate in human mode")
+	}
+	jsonFlag = true
+	if explaining() || explainOnStep("example.com", "eth0") != nil {
+		t.Error("Expected --explain to be off with --json")
+	}
+}
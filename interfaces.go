@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"whichdns/whichdns"
+)
+
+// jsonInterface is one interface printed in JSON mode with --list-interfaces
+type jsonInterface struct {
+	Name      string   `json:"name"`
+	Flags     []string `json:"flags"`
+	MAC       string   `json:"mac,omitempty"`
+	Addresses []string `json:"addresses"`
+	Default   bool     `json:"default"`
+	Capture   bool     `json:"capture"`
+}
+
+// listInterfaces describes every network interface of the host, marking the
+// one auto-selected without --interface (default) and the ones captured on
+// with --all-interfaces (capture)
+func listInterfaces() ([]jsonInterface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var defaultName string
+	if iface, err := whichdns.DefaultInterface(ipv6Flag); err == nil {
+		defaultName = iface.Name
+	} else {
+		debugLog("No default interface: %v", err)
+	}
+	captured, err := whichdns.CaptureInterfaces(whichdns.Options{AllInterfaces: true, IPv6: ipv6Flag})
+	if err != nil {
+		debugLog("No interface to capture on: %v", err)
+	}
+
+	var list []jsonInterface
+	for _, iface := range ifaces {
+		item := jsonInterface{
+			Name:      iface.Name,
+			Flags:     []string{},
+			MAC:       maskMAC(iface.HardwareAddr),
+			Addresses: []string{},
+			Default:   iface.Name == defaultName,
+			Capture:   slices.Contains(captured, iface.Name),
+		}
+		if iface.Flags != 0 {
+			item.Flags = strings.Split(iface.Flags.String(), "|")
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			debugLog("Failed to get the addresses of %v: %v", iface.Name, err)
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				ones, _ := ipnet.Mask.Size()
+				item.Addresses = append(item.Addresses, fmt.Sprintf("%s/%d", maskIP(ipnet.IP.String()), ones))
+			}
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+// runListInterfaces prints the interfaces for --list-interfaces and exits
+// without capturing or looking anything up
+func runListInterfaces() {
+	list, err := listInterfaces()
+	if err != nil {
+		if jsonFlag {
+			printJSON(jsonError{Error: err.Error()})
+		} else {
+			printError("Failed to list the network interfaces: %v", err)
+		}
+		exit(exitUnavailable)
+	}
+
+	if jsonFlag {
+		printJSON(list)
+		exit(exitOK)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tFLAGS\tMAC\tADDRESSES\tSELECTED")
+	for _, iface := range list {
+		var selected []string
+		if iface.Default {
+			selected = append(selected, "default")
+		}
+		if iface.Capture {
+			selected = append(selected, "all-interfaces")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", iface.Name, strings.Join(iface.Flags, ","), iface.MAC,
+			strings.Join(iface.Addresses, ", "), strings.Join(selected, ", "))
+	}
+	w.Flush()
+	if !slices.ContainsFunc(list, func(iface jsonInterface) bool { return iface.Default }) {
+		fmt.Fprintln(os.Stderr, "No interface would be selected automatically; pass --interface.")
+	}
+	exit(exitOK)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestListInterfaces(t *testing.T) {
+	list, err := listInterfaces()
+	if err != nil {
+		t.Skipf("Cannot list interfaces here: %v", err)
+	}
+	for _, iface := range list {
+		if iface.Addresses == nil || iface.Flags == nil {
+			t.Errorf("Expected empty lists rather than null for %s", iface.Name)
+		}
+		if slices.Contains(iface.Flags, "loopback") && (iface.Default || iface.Capture) {
+			t.Errorf("Expected loopback %s never to be selected", iface.Name)
+		}
+	}
+}
@@ -3,99 +3,180 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
 	"net"
 	"os"
-	"os/user"
+	"os/signal"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
-	"unsafe"
 
 	"github.com/spf13/cobra"
-)
 
-const (
-	appversion     = "1.1.11"
-	captureTimeout = 10 * time.Second
+	"whichdns/whichdns"
 )
 
-// AF_PACKET constants
 const (
-	afPacket = syscall.AF_PACKET
-	sockRaw  = syscall.SOCK_RAW
+	appversion = "1.1.11"
+	// fingerprintTimeout bounds the wait for a version.bind answer, which many servers never send
+	fingerprintTimeout = 2 * time.Second
+	// maxSnaplen is the largest --snaplen, libpcap's limit for a record
+	maxSnaplen = 262144
+	// minUsefulSnaplen is the smallest --snaplen that fits the headers and a short DNS message
+	minUsefulSnaplen = 100
 )
 
-// Network protocol constants
+// Exit codes, following sysexits.h where one fits
 const (
-	ethPAll    = 0x0003 // Ethernet protocol: All packets
-	ethPIPv4   = 0x0800 // Ethernet protocol: IPv4
-	ipProtoUDP = 17     // IP protocol: UDP
-	dnsPort    = 53     // DNS service port
+	exitOK          = 0   // DNS server detected
+	exitFailure     = 1   // Unexpected internal error
+	exitMismatch    = 3   // --check or --compare-expected mismatch, or fewer servers than --min-servers
+	exitLocal       = 4   // The domain resolved locally without contacting a DNS server
+	exitUsage       = 64  // Invalid flags or arguments (EX_USAGE)
+	exitLookup      = 68  // The DNS lookup failed (EX_NOHOST)
+	exitUnavailable = 69  // Interface or capture could not be opened (EX_UNAVAILABLE)
+	exitResolvConf  = 72  // resolv.conf could not be read (EX_OSFILE)
+	exitCantCreate  = 73  // The --output file could not be written (EX_CANTCREAT)
+	exitCapture     = 74  // Reading or writing packets failed (EX_IOERR)
+	exitTimeout     = 75  // No DNS response before the timeout (EX_TEMPFAIL)
+	exitNoPrivilege = 77  // Root privileges or CAP_NET_RAW are required (EX_NOPERM)
+	exitNoInterface = 78  // No usable network interface, e.g. in a minimal container (EX_CONFIG)
+	exitInterrupted = 130 // Interrupted by Ctrl-C or SIGTERM
 )
 
-// Packet size constants
-const (
-	ethHeaderLen = 14 // Ethernet header length
-	ipHeaderMin  = 20 // Minimum IP header length
-	udpHeaderLen = 8  // UDP header length
-	ipSrcOffset  = 12 // IP source address offset in header
+// Global variables
+var (
+	// logger writes leveled diagnostics to stderr; it discards them until configured
+	logger = slog.New(slog.DiscardHandler)
+	// debugFile receives every log record at debug level with --debug-file
+	debugFile *os.File
+	// interactive is set when stdout is a terminal; otherwise (pipes, files,
+	// cron, CI) only the result lines are printed, without bar or interface line
+	interactive bool
+	// verbose is set when info or debug logs are enabled, which hides the progress bar
+	verbose bool
 )
 
-// sockaddrLl structure for AF_PACKET
-type sockaddrLl struct {
-	sllFamily   uint16
-	sllProtocol uint16
-	sllIfindex  int32
-	sllHatype   uint16
-	sllPkttype  uint8
-	sllHalen    uint8
-	sllAddr     [8]uint8
+// barStyle holds the characters drawing the done and remaining parts of the bar
+type barStyle struct {
+	done, todo string
 }
 
-// Global variables
-var (
-	debug bool
-)
+// barStyles are the styles accepted by --bar-style
+var barStyles = map[string]barStyle{
+	"ascii":  {"#", "-"},
+	"blocks": {"█", "░"},
+}
+
+// barDecoration is the number of columns the bar line takes besides the bar:
+// the brackets and " 100.00%"
+const barDecoration = 10
 
 // ProgressBar represents a simple textual progress bar
 type ProgressBar struct {
 	total     int
 	current   int
 	barLength int
+	style     barStyle
 	mu        sync.Mutex
 }
 
-// NewProgressBar initializes a new ProgressBar
+// NewProgressBar initializes a new ProgressBar in the ascii style
 func NewProgressBar(total int, barLength int) *ProgressBar {
 	return &ProgressBar{
 		total:     total,
 		current:   0,
 		barLength: barLength,
+		style:     barStyles["ascii"],
 	}
 }
 
+// The ProgressBar methods do nothing on a nil bar, which is how a hidden bar
+// (debug logs, --json, --iponly, --quiet, --watch) is represented.
+
 // Advance increments the progress and renders the bar
 func (p *ProgressBar) Advance() {
+	if p == nil {
+		return
+	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	p.current++
 	if p.current > p.total {
 		p.current = p.total
 	}
-	p.Render()
+	p.render()
+}
+
+// AdvanceTo moves the progress forward to n steps, e.g. to skip the rest of
+// the wait once a response has arrived; it never moves the bar back
+func (p *ProgressBar) AdvanceTo(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.current < n && p.current < p.total {
+		p.current++
+		p.render()
+	}
+}
+
+// Reset moves the progress back to n steps, e.g. to redo part of the work,
+// and renders the bar
+func (p *ProgressBar) Reset(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = min(n, p.current)
+	p.render()
+}
+
+// Finished reports whether the bar has reached its total
+func (p *ProgressBar) Finished() bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current >= p.total
 }
 
 // Render displays the current state of the progress bar
 func (p *ProgressBar) Render() {
-	percentage := float64(p.current) / float64(p.total) * 100
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.render()
+}
+
+// render draws the bar; the caller must hold p.mu
+func (p *ProgressBar) render() {
+	// An empty bar is complete rather than a division by zero
+	percentage := 100.0
+	if p.total > 0 {
+		percentage = float64(p.current) / float64(p.total) * 100
+	}
 	if percentage > 100 {
 		percentage = 100
 	}
 	filledLength := int(percentage / 100 * float64(p.barLength))
-	bar := strings.Repeat("#", filledLength) + strings.Repeat("-", p.barLength-filledLength)
+	bar := strings.Repeat(p.style.done, filledLength) + strings.Repeat(p.style.todo, p.barLength-filledLength)
 	fmt.Printf("\r[%s] %.2f%%", bar, percentage)
 	if p.current >= p.total {
 		fmt.Println()
@@ -104,38 +185,227 @@ func (p *ProgressBar) Render() {
 
 // Clear clears the progress bar line by overwriting it with spaces
 func (p *ProgressBar) Clear() {
+	if p == nil {
+		return
+	}
 	// Clear the line by overwriting with spaces and carriage return
-	fmt.Printf("\r%s\r", strings.Repeat(" ", 70))
-}
-
-// IncrementDuringWait increments the progress bar every second during the wait period
-func (p *ProgressBar) IncrementDuringWait(duration time.Duration, done chan struct{}) {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-	for i := 0; i < int(duration.Seconds()); i++ {
-		select {
-		case <-ticker.C:
-			p.Advance()
-		case <-done:
-			return
-		}
+	fmt.Printf("\r%s\r", strings.Repeat(" ", p.barLength+barDecoration))
+}
+
+// barWidth returns the --bar-width, narrowed so the bar line fits on the
+// terminal: a line that wraps breaks the carriage-return redraw
+func barWidth() int {
+	width := barWidthFlag
+	if cols := terminalWidth(os.Stdout); cols > 0 && width > cols-barDecoration-1 {
+		debugLog("Narrowing the progress bar from %d to fit %d columns.", width, cols)
+		width = max(cols-barDecoration-1, 1)
 	}
+	return width
+}
+
+// waitSteps returns the number of one-second progress steps needed to cover duration
+func waitSteps(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
 }
 
 var (
-	domainFlag string
-	ipOnlyFlag bool
-	debugFlag  bool
+	domainFlag        []string
+	domainsFileFlag   string
+	interfaceFlag     string
+	allIfacesFlag     bool
+	srcFlag           string
+	resolverFlag      string
+	resolvConfFlag    string
+	checkSetupFlag    bool
+	selftestFlag      bool
+	outputFlag        string
+	ednsFlag          bool
+	dnssecFlag        bool
+	waitFullFlag      bool
+	minServersFlag    int
+	ipOnlyFlag        bool
+	jsonFlag          bool
+	shellFlag         bool
+	summaryFlag       bool
+	splitDNSFlag      bool
+	quietFlag         bool
+	fingerprintFlag   bool
+	filterFlag        string
+	anyHostFlag       bool
+	watchFlag         time.Duration
+	oncePerServerFlag bool
+	metricsFlag       string
+	pprofFlag         string
+	noProgressFlag    bool
+	barWidthFlag      int
+	barStyleFlag      string
+	colorFlag         string
+	debugFlag         bool
+	verboseFlag       bool
+	debugFileFlag     string
+	explainFlag       bool
+	ipv6Flag          bool
+	familyFlag        string
+	allFlag           bool
+	resolveFlag       bool
+	l2Flag            bool
+	ttlFlag           bool
+	pcapFlag          string
+	writeFlag         string
+	noRootFlag        bool
+	checkFlag         bool
+	listIfacesFlag    bool
+	completionFlag    string
+	expectedFlag      []string
+	protoFlag         string
+	encryptedFlag     bool
+	continueFlag      bool
+	logLevelFlag      string
+	retriesFlag       int
+	attemptsFlag      int
+	waitIfaceFlag     time.Duration
+	loopbackFlag      bool
+	snaplenFlag       int
+	typeFlag          string
+	bufferSizeFlag    int
+	immediateFlag     bool
+	maskFlag          bool
+	portFlag          int
+	countFlag         int
+	probesFlag        int
+	probeIntervalFlag time.Duration
+	uniqueFlag        bool
+	pureGoFlag        bool
+	keepRootFlag      bool
+	timeoutFlag       time.Duration
 )
 
+// protocolLabels are the human-readable names of encrypted DNS protocols
+var protocolLabels = map[string]string{
+	whichdns.ProtocolDoT: "DNS over TLS",
+	whichdns.ProtocolDoH: "DNS over HTTPS",
+}
+
+// jsonResult is the object printed on success in JSON mode
+type jsonResult struct {
+	Domain     string                         `json:"domain"`
+	Interface  string                         `json:"interface"`
+	DNSServer  string                         `json:"dns_server"`
+	DNSServers []string                       `json:"dns_servers,omitempty"`
+	Scope      string                         `json:"scope,omitempty"`
+	Scopes     map[string]string              `json:"scopes,omitempty"`
+	Responses  map[string]int                 `json:"responses,omitempty"`
+	Interfaces map[string]string              `json:"interfaces,omitempty"`
+	Protocol   string                         `json:"protocol"`
+	SNI        string                         `json:"sni,omitempty"`
+	Query      string                         `json:"query,omitempty"`
+	EDNS       *jsonEDNS                      `json:"edns,omitempty"`
+	DNSSEC     *jsonDNSSEC                    `json:"dnssec,omitempty"`
+	MAC        string                         `json:"mac,omitempty"`
+	NextHop    string                         `json:"next_hop,omitempty"`
+	TTL        int                            `json:"ttl,omitempty"`
+	TTLs       map[string]map[int]int         `json:"ttls,omitempty"`
+	AnswerSets map[string]map[string][]string `json:"answer_sets,omitempty"`
+	Conflicts  [][2]string                    `json:"answer_conflicts,omitempty"`
+	Hostname   string                         `json:"hostname,omitempty"`
+	Software   string                         `json:"software,omitempty"`
+	Configured []string                       `json:"configured_servers,omitempty"`
+	Expected   []string                       `json:"expected_servers,omitempty"`
+	Matches    *bool                          `json:"matches_config,omitempty"`
+	Answers    []jsonAnswer                   `json:"answers,omitempty"`
+	MinReached *bool                          `json:"min_servers_reached,omitempty"`
+	ElapsedMS  int64                          `json:"elapsed_ms"`
+}
+
+// jsonAnswer is an answer record of the response printed in JSON mode with --verbose
+type jsonAnswer struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	TTL   uint32 `json:"ttl"`
+	Value string `json:"value"`
+}
+
+// jsonEDNS is the EDNS0 support of the server printed in JSON mode with --edns
+type jsonEDNS struct {
+	Supported   bool   `json:"supported"`
+	PayloadSize uint16 `json:"payload_size,omitempty"`
+	Version     uint8  `json:"version,omitempty"`
+	DO          bool   `json:"do,omitempty"`
+	Flags       uint16 `json:"flags,omitempty"`
+}
+
+// jsonDNSSEC is the DNSSEC status printed in JSON mode with --dnssec
+type jsonDNSSEC struct {
+	QueryDO       bool `json:"query_do"`
+	Authenticated bool `json:"authenticated"`
+	Truncated     bool `json:"truncated"`
+}
+
+// newJSONEDNS converts the OPT record a server echoed, nil if none, for JSON output
+func newJSONEDNS(edns *whichdns.EDNS) *jsonEDNS {
+	if edns == nil {
+		return &jsonEDNS{}
+	}
+	return &jsonEDNS{Supported: true, PayloadSize: edns.PayloadSize, Version: edns.Version, DO: edns.DO, Flags: edns.Flags}
+}
+
+// jsonConfigured is the object printed in JSON mode with --noroot
+type jsonConfigured struct {
+	Source      string   `json:"source"`
+	Nameservers []string `json:"nameservers"`
+}
+
+// jsonError is the object printed on failure in JSON mode
+type jsonError struct {
+	Domain   string `json:"domain,omitempty"`
+	Error    string `json:"error"`
+	ExitCode int    `json:"exit_code,omitempty"`
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "whichdns",
 	Short: "Find which DNS server is being used",
 	Long: `A tool to detect which DNS server responds to DNS queries by capturing network packets.
 
 This tool performs DNS lookups while monitoring network traffic to identify
-which DNS server actually responds to the queries.`,
+which DNS server actually responds to the queries.
+
+Exit codes:
+  0    DNS server detected
+  1    unexpected internal error
+  3    --check: the observed server is not a configured resolver;
+       --compare-expected: it is not an expected one;
+       --min-servers: fewer servers answered
+  4    the domain resolved locally (hosts file or cache)
+  64   invalid flags or arguments
+  68   the DNS lookup failed, or the server refused it with ICMP
+  69   the interface or capture could not be opened
+  72   resolv.conf could not be read
+  73   the --output file could not be written
+  74   reading or writing packets failed
+  75   no DNS response before the timeout
+  77   root privileges or CAP_NET_RAW are required
+  78   no usable network interface (e.g. a container with only loopback)
+  130  interrupted by Ctrl-C or SIGTERM (--watch exits 0)`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupLogging()
+	},
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		// Reject bad combinations before --domains-file is read, which may
+		// wait on stdin, then check the flags again with its domains
+		if err := validateFlags(); err != nil || domainsFileFlag == "" {
+			return err
+		}
+		if err := loadDomainsFile(cmd.Flags().Changed("domain")); err != nil {
+			return err
+		}
+		return validateFlags()
+	},
 	Run: func(cmd *cobra.Command, args []string) {
+		if completionFlag != "" {
+			runCompletion(cmd)
+			return
+		}
 		runDNSCheck()
 	},
 }
@@ -144,437 +414,1532 @@ var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Print the version number",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Printf("Version: %s\n", appversion)
+		printVersion()
 		debugLog("Printed version and exiting.")
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(versionCmd)
-	rootCmd.Flags().StringVar(&domainFlag, "domain", "example.com", "the domain for DNS lookup")
+	versionCmd.Flags().BoolVar(&jsonFlag, "json", false, "print the build metadata as a JSON object")
+	rootCmd.Flags().StringSliceVar(&domainFlag, "domain", []string{whichdns.DefaultDomain}, "the domains for DNS lookup (comma-separated or repeated)")
+	rootCmd.Flags().StringVar(&domainsFileFlag, "domains-file", "", "read the domains from this file, one per line (# starts a comment), and check several at a time; - reads stdin")
+	rootCmd.Flags().BoolVar(&splitDNSFlag, "split-dns", false, "with two domains, an internal then a public one, report whether different servers answer them")
+	rootCmd.Flags().BoolVar(&continueFlag, "continue", false, "keep checking the remaining domains after a failure")
+	rootCmd.Flags().StringVar(&interfaceFlag, "interface", "", "the network interface to capture on (default: auto-detect)")
+	rootCmd.Flags().BoolVar(&loopbackFlag, "loopback", false, "capture on the loopback interface, e.g. to test a local resolver; implied by a loopback --resolver")
+	rootCmd.Flags().BoolVar(&allIfacesFlag, "all-interfaces", false, "capture on every up interface with a usable address and report which one saw the response")
+	rootCmd.Flags().StringVar(&resolverFlag, "resolver", "", "send the lookups to this DNS server, ip or ip:port, and report whether it is the one that answers")
+	rootCmd.Flags().StringVar(&srcFlag, "src", "", "send the lookups from this local IP address and only capture traffic to or from it")
 	rootCmd.Flags().BoolVar(&ipOnlyFlag, "iponly", false, "print only the IP address of the DNS server")
-	rootCmd.Flags().BoolVar(&debugFlag, "debug", false, "enable debug output")
+	rootCmd.Flags().BoolVar(&jsonFlag, "json", false, "print the result as a single JSON object")
+	rootCmd.Flags().BoolVar(&summaryFlag, "summary", false, "print a report of the interface, configured and observed servers and whether they match, for bug reports")
+	rootCmd.Flags().BoolVar(&shellFlag, "shell", false, "print WHICHDNS_SERVER, WHICHDNS_IFACE and WHICHDNS_ELAPSED_MS assignments for eval in a shell")
+	rootCmd.Flags().StringVar(&outputFlag, "output", "", "write the result (in --json format if set) to this file instead of stdout; - is stdout")
+	rootCmd.Flags().BoolVar(&noProgressFlag, "no-progress", false, "do not show the progress bar (it is also hidden when stdout is not a terminal)")
+	rootCmd.Flags().IntVar(&barWidthFlag, "bar-width", 50, "progress bar width in characters, narrowed to fit the terminal")
+	rootCmd.Flags().StringVar(&barStyleFlag, "bar-style", "ascii", "progress bar characters: ascii (#-) or blocks (█░)")
+	rootCmd.Flags().StringVar(&colorFlag, "color", colorAuto, "color the result green and errors red: auto (on a terminal without NO_COLOR), always or never")
+	rootCmd.Flags().BoolVar(&maskFlag, "mask", false, "hide the last octet (IPv4) or last 80 bits (IPv6) of the server addresses printed, for sharing output")
+	rootCmd.Flags().BoolVar(&quietFlag, "quiet", false, "print nothing on success, only errors; check the exit code")
+	rootCmd.Flags().BoolVarP(&ipv6Flag, "ipv6", "6", false, "only detect DNS servers reached over IPv6 (same as --family 6)")
+	rootCmd.Flags().StringVar(&familyFlag, "family", whichdns.FamilyAny, "only detect DNS servers reached over this address family: 4, 6 or any")
+	rootCmd.Flags().BoolVar(&encryptedFlag, "encrypted", false, "detect DNS-over-TLS and DNS-over-HTTPS servers from TLS handshakes")
+	rootCmd.Flags().IntVar(&portFlag, "port", whichdns.DefaultPort, "port the DNS server listens on")
+	rootCmd.Flags().StringVar(&protoFlag, "proto", whichdns.ProtoAny, "transport to match DNS responses on: udp, tcp or any")
+	rootCmd.Flags().BoolVar(&allFlag, "all", false, "keep capturing until the timeout and report every DNS server that answers")
+	rootCmd.Flags().BoolVar(&ednsFlag, "edns", false, "send EDNS0 queries advertising a 4096-byte buffer and report the payload size and flags the server echoes")
+	rootCmd.Flags().BoolVar(&dnssecFlag, "dnssec", false, "send EDNS0 queries with the DO bit and report the AD (validated) and TC (truncated) flags of the response")
+	rootCmd.Flags().IntVar(&minServersFlag, "min-servers", 0, "with --all, stop once this many servers have answered and exit with code 3 if fewer do")
+	rootCmd.Flags().BoolVar(&waitFullFlag, "wait-full", false, "capture for the whole timeout and report the server that answered the most lookups instead of the first")
+	rootCmd.Flags().BoolVar(&fingerprintFlag, "fingerprint", false, "ask the detected server for its software version with a version.bind CHAOS query")
+	rootCmd.Flags().BoolVar(&l2Flag, "l2", false, "report the MAC address the response came through and the neighbour owning it, e.g. the gateway")
+	rootCmd.Flags().BoolVar(&ttlFlag, "ttl", false, "report the IP TTL of the response and the hops it suggests; with --all, the TTLs seen per server")
+	rootCmd.Flags().BoolVar(&resolveFlag, "resolve", false, "look up the hostname of the detected DNS server")
+	rootCmd.Flags().StringVar(&pcapFlag, "pcap", "", "read packets from a saved pcap file instead of capturing (no root needed)")
+	rootCmd.Flags().BoolVar(&anyHostFlag, "any-host", false, "consider the DNS traffic of every host the capture sees, not only this host's")
+	rootCmd.Flags().StringVar(&filterFlag, "filter", "", "only consider packets matching this expression, e.g. \"net 10.0.0.0/8 and not host 10.0.0.2\"")
+	rootCmd.Flags().StringVar(&writeFlag, "write", "", "write every captured packet to a pcap file")
+	rootCmd.Flags().BoolVar(&listIfacesFlag, "list-interfaces", false, "list the network interfaces, marking the one chosen without --interface, then exit")
+	rootCmd.Flags().StringVar(&completionFlag, "completion", "", "print a completion script for this shell ("+strings.Join(completionShells, ", ")+"), then exit")
+	rootCmd.RegisterFlagCompletionFunc("interface", completeInterfaces)
+	rootCmd.Flags().BoolVar(&checkSetupFlag, "check-setup", false, "check privileges, interface and capture without any lookup, then exit (0 if all pass)")
+	rootCmd.Flags().BoolVar(&selftestFlag, "selftest", false, "look the domain up at 1.1.1.1 and check the capture sees its response, printing PASS or FAIL, then exit")
+	rootCmd.Flags().BoolVar(&noRootFlag, "noroot", false, "report the resolvers configured in resolv.conf instead of capturing (no root needed)")
+	rootCmd.Flags().BoolVar(&checkFlag, "check", false, "exit with code 3 if the observed DNS server is not listed in resolv.conf")
+	rootCmd.Flags().StringSliceVar(&expectedFlag, "compare-expected", nil, "exit with code 3 unless the observed DNS server is one of these IPs (comma-separated or repeated)")
+	rootCmd.Flags().StringVar(&resolvConfFlag, "resolv-conf", defaultResolvConf(), "resolv.conf file the configured resolvers are read from ($"+resolvConfEnv+" sets the default)")
+	rootCmd.Flags().IntVar(&countFlag, "count", whichdns.DefaultCount, "number of lookups to perform; with --all, responses per server are tallied")
+	rootCmd.Flags().IntVar(&probesFlag, "probes", 0, "number of lookups to send, overriding --count; the progress bar does not depend on it (default: --count)")
+	rootCmd.Flags().DurationVar(&probeIntervalFlag, "probe-interval", 0, "delay between the starts of consecutive lookups (default: together, or spread over half the timeout with --all or --wait-full)")
+	rootCmd.Flags().StringVar(&typeFlag, "type", "", "record type to look up: "+strings.Join(whichdns.QueryTypes(), ", ")+" (default: the domain's A and AAAA addresses)")
+	rootCmd.Flags().BoolVar(&uniqueFlag, "unique", false, "look up a random subdomain each time so no cache can answer")
+	rootCmd.Flags().BoolVar(&pureGoFlag, "purego", true, "send lookups with Go's DNS client; --purego=false uses the system resolver (nscd, systemd-resolved)")
+	rootCmd.Flags().BoolVar(&keepRootFlag, "keep-root", false, "keep root privileges after opening the capture instead of switching back to the sudo user")
+	rootCmd.Flags().IntVar(&snaplenFlag, "snaplen", whichdns.DefaultSnaplen, "bytes kept of each captured frame (and recorded in --write files); larger frames are cut off")
+	rootCmd.Flags().IntVar(&bufferSizeFlag, "buffer-size", 0, "capture socket receive buffer in bytes, to avoid drops on busy hosts (0 keeps the kernel default)")
+	rootCmd.Flags().BoolVar(&immediateFlag, "immediate", false, "poll the capture without pausing, for the lowest latency at the cost of a busy CPU")
+	rootCmd.Flags().IntVar(&retriesFlag, "retries", 3, "times to retry opening the capture, with backoff starting at 200ms")
+	rootCmd.Flags().IntVar(&attemptsFlag, "attempts", 1, "run the whole capture and lookups up to this many times while they time out or fail")
+	rootCmd.Flags().DurationVar(&waitIfaceFlag, "wait-for-interface", 0, "wait up to this long (e.g. 60s) for the interface to come up with a usable address, e.g. at boot")
+	rootCmd.Flags().DurationVar(&watchFlag, "watch", 0, "repeat the detection at this interval (e.g. 30s) until interrupted, printing a line per cycle")
+	rootCmd.Flags().BoolVar(&oncePerServerFlag, "once-per-server", false, "with --watch, print a server only when it differs from the last one reported")
+	rootCmd.Flags().StringVar(&pprofFlag, "pprof", "", "serve net/http/pprof profiles on this address (e.g. 127.0.0.1:6060); unauthenticated, keep it on loopback")
+	rootCmd.Flags().StringVar(&metricsFlag, "metrics", "", "with --watch, serve Prometheus metrics on this address (e.g. :9109)")
+	rootCmd.Flags().DurationVar(&timeoutFlag, "timeout", whichdns.DefaultTimeout, "how long to wait for a DNS response (e.g. 3s, 30s)")
+	rootCmd.PersistentFlags().StringVar(&logLevelFlag, "loglevel", "warn", "log level written to stderr: error, warn, info or debug")
+	rootCmd.PersistentFlags().BoolVar(&debugFlag, "debug", false, "enable debug output (same as --loglevel debug)")
+	rootCmd.PersistentFlags().BoolVar(&verboseFlag, "verbose", false, "log at info level and print the answer records of the response (same as --loglevel info)")
+	rootCmd.PersistentFlags().StringVar(&debugFileFlag, "debug-file", "", "append debug logs to this file; stderr keeps the --loglevel level")
+	rootCmd.Flags().BoolVar(&explainFlag, "explain", false, "describe each stage of the check on stderr as it runs")
 }
 
-func runDNSCheck() {
-	debug = debugFlag
+// validateFlags checks flag values before any capture is attempted
+func validateFlags() error {
+	if timeoutFlag <= 0 {
+		return errors.New("--timeout must be a positive duration such as 3s or 30s")
+	}
+	switch protoFlag {
+	case whichdns.ProtoAny, whichdns.ProtoUDP, whichdns.ProtoTCP:
+	default:
+		return fmt.Errorf("--proto must be udp, tcp or any, not %q", protoFlag)
+	}
+	if barWidthFlag < 1 {
+		return fmt.Errorf("--bar-width must be at least 1, not %d", barWidthFlag)
+	}
+	if _, ok := barStyles[barStyleFlag]; !ok {
+		return fmt.Errorf("--bar-style must be ascii or blocks, not %q", barStyleFlag)
+	}
+	switch colorFlag {
+	case colorAuto, colorAlways, colorNever:
+	default:
+		return fmt.Errorf("--color must be auto, always or never, not %q", colorFlag)
+	}
+	switch familyFlag {
+	case whichdns.FamilyAny, whichdns.FamilyIPv6:
+	case whichdns.FamilyIPv4:
+		if ipv6Flag {
+			return errors.New("--ipv6 cannot be combined with --family 4")
+		}
+	default:
+		return fmt.Errorf("--family must be 4, 6 or any, not %q", familyFlag)
+	}
+	if familyFlag == whichdns.FamilyIPv6 {
+		ipv6Flag = true
+	}
+	if portFlag < 1 || portFlag > 65535 {
+		return fmt.Errorf("--port must be between 1 and 65535, not %d", portFlag)
+	}
+	if countFlag < 1 {
+		return errors.New("--count must be at least 1")
+	}
+	if probeIntervalFlag < 0 {
+		return fmt.Errorf("--probe-interval must not be negative, not %v", probeIntervalFlag)
+	}
+	if probesFlag < 0 {
+		return fmt.Errorf("--probes must not be negative, not %d", probesFlag)
+	}
+	if last := time.Duration(lookupCount()-1) * probeIntervalFlag; last >= timeoutFlag {
+		return fmt.Errorf("--probe-interval %v would start lookup %d at %v, after the %v timeout", probeIntervalFlag, lookupCount(), last, timeoutFlag)
+	}
+	if retriesFlag < 0 {
+		return errors.New("--retries must not be negative")
+	}
+	if minServersFlag < 0 {
+		return fmt.Errorf("--min-servers must not be negative, not %d", minServersFlag)
+	}
+	if minServersFlag > 0 && (!allFlag || waitFullFlag || watchFlag > 0) {
+		return errors.New("--min-servers requires --all and cannot be combined with --wait-full or --watch")
+	}
+	if attemptsFlag < 1 {
+		return errors.New("--attempts must be at least 1")
+	}
+	if waitIfaceFlag < 0 {
+		return fmt.Errorf("--wait-for-interface must not be negative, not %v", waitIfaceFlag)
+	}
+	if waitIfaceFlag > 0 && (pcapFlag != "" || allIfacesFlag) {
+		return errors.New("--wait-for-interface cannot be combined with --pcap or --all-interfaces")
+	}
+	if attemptsFlag > 1 && (pcapFlag != "" || domainsFileFlag != "" || watchFlag > 0) {
+		return errors.New("--attempts cannot be combined with --pcap, --domains-file or --watch")
+	}
+	if snaplenFlag < 1 || snaplenFlag > maxSnaplen {
+		return fmt.Errorf("--snaplen must be between 1 and %d, not %d", maxSnaplen, snaplenFlag)
+	}
+	if bufferSizeFlag < 0 {
+		return fmt.Errorf("--buffer-size must not be negative, not %d", bufferSizeFlag)
+	}
+	if domainsFileFlag != "" {
+		if watchFlag > 0 || pcapFlag != "" || writeFlag != "" || noRootFlag || checkSetupFlag {
+			return errors.New("--domains-file cannot be combined with --watch, --pcap, --write, --noroot or --check-setup")
+		}
+	}
+	if len(domainFlag) == 0 || slices.Contains(domainFlag, "") {
+		return errors.New("--domain must not be empty")
+	}
+	typeFlag = strings.ToUpper(typeFlag)
+	if err := whichdns.ValidateQueryType(typeFlag); err != nil {
+		return fmt.Errorf("--type: %w", err)
+	}
+	for _, domain := range domainFlag {
+		if err := whichdns.ValidateDomain(domain); err != nil {
+			return fmt.Errorf("--domain: %w", err)
+		}
+	}
+	if err := whichdns.ValidateFilter(filterFlag); err != nil {
+		return fmt.Errorf("--filter: %w", err)
+	}
+	if watchFlag < 0 {
+		return errors.New("--watch must be a positive interval such as 30s")
+	}
+	if watchFlag > 0 && (pcapFlag != "" || writeFlag != "" || noRootFlag) {
+		return errors.New("--watch cannot be combined with --pcap, --write or --noroot")
+	}
+	if metricsFlag != "" && watchFlag == 0 {
+		return errors.New("--metrics requires --watch")
+	}
+	if oncePerServerFlag && watchFlag == 0 {
+		return errors.New("--once-per-server requires --watch")
+	}
+	if allIfacesFlag && (interfaceFlag != "" || pcapFlag != "") {
+		return errors.New("--all-interfaces cannot be combined with --interface or --pcap")
+	}
+	if loopbackFlag && (interfaceFlag != "" || allIfacesFlag || pcapFlag != "" || selftestFlag) {
+		return errors.New("--loopback cannot be combined with --interface, --all-interfaces, --pcap or --selftest")
+	}
+	if srcFlag != "" {
+		ip := net.ParseIP(srcFlag)
+		if ip == nil {
+			return fmt.Errorf("--src: %q is not an IP address", srcFlag)
+		}
+		if ipv6Flag && ip.To4() != nil {
+			return fmt.Errorf("--src %v is not an IPv6 address, as --ipv6 requires", ip)
+		}
+		if familyFlag == whichdns.FamilyIPv4 && ip.To4() == nil {
+			return fmt.Errorf("--src %v is not an IPv4 address, as --family 4 requires", ip)
+		}
+		if pcapFlag == "" {
+			if _, err := whichdns.InterfaceForIP(ip); err != nil {
+				return fmt.Errorf("--src: %w", err)
+			}
+		}
+	}
+	if resolverFlag != "" {
+		ip, port, err := parseResolver(resolverFlag)
+		if err != nil {
+			return fmt.Errorf("--resolver: %w", err)
+		}
+		if port != 0 && portFlag != whichdns.DefaultPort && portFlag != port {
+			return fmt.Errorf("--resolver port %d differs from --port %d", port, portFlag)
+		}
+		if port != 0 {
+			portFlag = port
+		}
+		if (ipv6Flag && ip.To4() != nil) || (familyFlag == whichdns.FamilyIPv4 && ip.To4() == nil) {
+			return fmt.Errorf("--resolver %v does not match the address family requested", ip)
+		}
+		if noRootFlag || encryptedFlag || !pureGoFlag {
+			return errors.New("--resolver cannot be combined with --noroot, --encrypted or --purego=false")
+		}
+	}
+	for i, server := range expectedFlag {
+		ip := net.ParseIP(server)
+		if ip == nil {
+			return fmt.Errorf("--compare-expected: %q is not an IP address", server)
+		}
+		expectedFlag[i] = ip.String() // Compare in the form the capture reports
+	}
+	if len(expectedFlag) > 0 && (checkFlag || resolverFlag != "" || watchFlag > 0 || noRootFlag || checkSetupFlag) {
+		return errors.New("--compare-expected cannot be combined with --check, --resolver, --watch, --noroot or --check-setup")
+	}
+	if quietFlag && (ipOnlyFlag || jsonFlag) {
+		return errors.New("--quiet cannot be combined with --iponly or --json")
+	}
+	if shellFlag && (ipOnlyFlag || jsonFlag || quietFlag) {
+		return errors.New("--shell cannot be combined with --iponly, --json or --quiet")
+	}
+	if shellFlag && (len(domainFlag) > 1 || watchFlag > 0 || noRootFlag || checkSetupFlag) {
+		return errors.New("--shell can only be used with a single domain and without --watch, --noroot or --check-setup")
+	}
+	if summaryFlag && (ipOnlyFlag || jsonFlag || quietFlag || shellFlag) {
+		return errors.New("--summary cannot be combined with --iponly, --json, --quiet or --shell")
+	}
+	if summaryFlag && (len(domainFlag) > 1 || watchFlag > 0 || noRootFlag || checkSetupFlag) {
+		return errors.New("--summary can only be used with a single domain and without --watch, --noroot or --check-setup")
+	}
+	if splitDNSFlag && len(domainFlag) != 2 {
+		return errors.New("--split-dns requires exactly two domains, an internal and a public one, e.g. --domain intranet.example.com,example.com")
+	}
+	if splitDNSFlag && (ipOnlyFlag || shellFlag || allFlag || watchFlag > 0 || noRootFlag || checkSetupFlag) {
+		return errors.New("--split-dns cannot be combined with --iponly, --shell, --all, --watch, --noroot or --check-setup")
+	}
+	if completionFlag != "" && !slices.Contains(completionShells, completionFlag) {
+		return fmt.Errorf("--completion must be one of %s, not %q", strings.Join(completionShells, ", "), completionFlag)
+	}
+	if listIfacesFlag && (noRootFlag || checkSetupFlag || watchFlag > 0 || pcapFlag != "" || domainsFileFlag != "") {
+		return errors.New("--list-interfaces cannot be combined with --noroot, --check-setup, --watch, --pcap or --domains-file")
+	}
+	if checkSetupFlag && (pcapFlag != "" || writeFlag != "" || noRootFlag || watchFlag > 0) {
+		return errors.New("--check-setup cannot be combined with --pcap, --write, --noroot or --watch")
+	}
+	if selftestFlag && (checkSetupFlag || pcapFlag != "" || resolverFlag != "" || noRootFlag || watchFlag > 0 || domainsFileFlag != "" || len(domainFlag) > 1) {
+		return errors.New("--selftest cannot be combined with --check-setup, --pcap, --resolver, --noroot, --watch, --domains-file or several domains")
+	}
+	if (ednsFlag || dnssecFlag) && encryptedFlag {
+		return errors.New("--edns and --dnssec cannot be combined with --encrypted")
+	}
+	if outputFlag != "" && outputFlag != "-" && outputFlag == writeFlag {
+		return errors.New("--output and --write must name different files")
+	}
+	if writeFlag != "" && len(domainFlag) > 1 {
+		return errors.New("--write can only be used with a single domain")
+	}
+	return nil
+}
 
-	debugLog("Parsed arguments: domain=%s, ipOnly=%v, debug=%v", domainFlag, ipOnlyFlag, debugFlag)
+func runDNSCheck() {
+	debugLog("Parsed arguments: domain=%s, domains-file=%s, interface=%s, loopback=%v, all-interfaces=%v, src=%s, resolver=%s, resolv-conf=%s, ipOnly=%v, json=%v, shell=%v, summary=%v, split-dns=%v, output=%s, mask=%v, quiet=%v, no-progress=%v, bar-width=%d, bar-style=%s, color=%s, ipv6=%v, family=%s, all=%v, min-servers=%d, wait-full=%v, resolve=%v, l2=%v, ttl=%v, edns=%v, dnssec=%v, fingerprint=%v, pcap=%s, filter=%q, any-host=%v, write=%s, noroot=%v, list-interfaces=%v, completion=%s, check-setup=%v, selftest=%v, check=%v, compare-expected=%s, proto=%s, port=%d, encrypted=%v, continue=%v, count=%d, probes=%d, probe-interval=%v, type=%s, unique=%v, purego=%v, keep-root=%v, retries=%d, attempts=%d, wait-for-interface=%v, snaplen=%d, buffer-size=%d, immediate=%v, timeout=%v, watch=%v, once-per-server=%v, metrics=%s, pprof=%s, explain=%v, loglevel=%s, verbose=%v, debug=%v, debug-file=%s", strings.Join(domainFlag, ","), domainsFileFlag, interfaceFlag, loopbackFlag, allIfacesFlag, srcFlag, resolverFlag, resolvConfFlag, ipOnlyFlag, jsonFlag, shellFlag, summaryFlag, splitDNSFlag, outputFlag, maskFlag, quietFlag, noProgressFlag, barWidthFlag, barStyleFlag, colorFlag, ipv6Flag, familyFlag, allFlag, minServersFlag, waitFullFlag, resolveFlag, l2Flag, ttlFlag, ednsFlag, dnssecFlag, fingerprintFlag, pcapFlag, filterFlag, anyHostFlag, writeFlag, noRootFlag, listIfacesFlag, completionFlag, checkSetupFlag, selftestFlag, checkFlag, strings.Join(expectedFlag, ","), protoFlag, portFlag, encryptedFlag, continueFlag, countFlag, probesFlag, probeIntervalFlag, typeFlag, uniqueFlag, pureGoFlag, keepRootFlag, retriesFlag, attemptsFlag, waitIfaceFlag, snaplenFlag, bufferSizeFlag, immediateFlag, timeoutFlag, watchFlag, oncePerServerFlag, metricsFlag, pprofFlag, explainFlag, logLevelFlag, verboseFlag, debugFlag, debugFileFlag)
 
-	// Suppress log output if ipOnly is set
-	if ipOnlyFlag {
+	// Suppress log output if ipOnly, json or quiet is set
+	if scriptOutput() {
 		log.SetOutput(os.Stderr)
 		log.SetFlags(0)
-		debugLog("ipOnly flag is set; logging output suppressed.")
+		debugLog("Script output requested; logging output suppressed.")
+	}
+
+	if snaplenFlag < minUsefulSnaplen {
+		warnLog("--snaplen %d is below %d bytes; DNS packets will be cut off before they can be decoded.", snaplenFlag, minUsefulSnaplen)
+	}
+
+	// Send the result to the --output file; errors stay on stderr
+	if err := openOutput(outputFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCantCreate)
 	}
+	setupColor()
 
-	// Define total steps and total progress units
-	totalSteps := 9                                 // Total number of steps before wait
-	timeoutSeconds := int(captureTimeout.Seconds()) // Timeout in seconds
-	totalProgress := totalSteps + timeoutSeconds    // Total progress units (9 +10=19)
+	// Serve profiles for the whole run, before any capture starts
+	if pprofFlag != "" {
+		if err := servePprof(pprofFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(exitUnavailable)
+		}
+	}
+
+	// List the interfaces to choose --interface from; no root is needed
+	if listIfacesFlag {
+		runListInterfaces()
+		return
+	}
+
+	// Without capture privileges, fall back to the configured resolvers
+	if noRootFlag {
+		runResolverConfigCheck()
+		return
+	}
+
+	// Validate the host's setup without capturing any traffic
+	if checkSetupFlag {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		runSetupCheck(ctx)
+	}
+
+	// Check the whole pipeline against a known public resolver
+	if selftestFlag {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		runSelftest(ctx)
+	}
+
+	// Register every step so the bar's total follows from them: two setup
+	// steps, then the capture stages, lookups and wait for each domain
+	steps := newStepTracker()
+	steps.Register(stepPrivileges, 1)
+	steps.Register(stepInterface, 1)
+	for i := range domainFlag {
+		registerDomainSteps(steps, i)
+	}
 
-	// Initialize ProgressBar if not in debug mode
+	// Initialize ProgressBar if logs are quiet and stdout is a terminal not
+	// meant for scripts; watch mode prints a line per cycle instead, and
+	// --explain narrates the steps in its place
 	var progressBar *ProgressBar
-	if !debug {
-		progressBar = NewProgressBar(totalProgress, 50) // 50 characters bar length
-		progressBar.Render()                            // Initialize the progress bar
+	if !verbose && !scriptOutput() && watchFlag == 0 && domainsFileFlag == "" && !noProgressFlag && !explaining() && interactive {
+		progressBar = steps.Show(barWidth(), barStyles[barStyleFlag])
 	}
 
-	// Step 1: Check for root privileges
-	if !isRoot() {
-		if !ipOnlyFlag {
-			fmt.Fprintln(os.Stderr, "This program requires root privileges to run.")
-			fmt.Fprintln(os.Stderr, "Please run it as root or with sudo.")
+	// Live capture is Linux-only; elsewhere there is nothing to be root for
+	if pcapFlag == "" && !whichdns.LiveCapture {
+		if jsonFlag {
+			printJSON(jsonError{Error: "live capture not supported on " + runtime.GOOS})
+		} else if !ipOnlyFlag {
+			printError("Live capture is not supported on %s; analyse a saved capture with --pcap instead.", runtime.GOOS)
+		}
+		exit(exitUnavailable)
+	}
+
+	// Step 1: Check for root privileges or CAP_NET_RAW (not needed to read a capture file)
+	if pcapFlag == "" && !hasCaptureCapability() && !isRoot() {
+		if jsonFlag {
+			printJSON(jsonError{Error: "root privileges required"})
+		} else if !ipOnlyFlag {
+			printError("This program requires root privileges or CAP_NET_RAW to run.")
+			printError("Please run it as root, with sudo, or after setcap cap_net_raw+ep.")
 			debugLog("User does not have root privileges.")
 		}
-		if progressBar != nil {
-			progressBar.Advance()
+		exit(exitNoPrivilege)
+	}
+	debugLog("User can capture packets or is reading a capture file.")
+	steps.Done(stepPrivileges)
+
+	// Step 2: Get the requested or default network interface
+	var iface *net.Interface
+	if pcapFlag != "" {
+		infoLog("Reading packets from capture file %v; skipping interface detection.", pcapFlag)
+		steps.Done(stepInterface)
+	} else if allIfacesFlag {
+		steps.Done(stepInterface)
+		if !scriptOutput() && !verbose && interactive {
+			progressBar.Clear()
+			fmt.Println("Interface: all")
+			progressBar.Render() // Restart progress bar on new line
+		}
+		infoLog("Capturing on every usable interface.")
+	} else if interfaceFlag != "" {
+		iface = getNamedNetworkInterface(interfaceFlag, !ipOnlyFlag)
+		steps.Done(stepInterface)
+		if !scriptOutput() && !verbose && interactive {
+			progressBar.Clear()
+			fmt.Printf("Interface: %v\n", iface.Name)
+			progressBar.Render() // Restart progress bar on new line
+		}
+		infoLog("Requested network interface obtained: %v", iface.Name)
+	} else if loopbackCapture() {
+		iface = getLoopbackNetworkInterface(!ipOnlyFlag)
+		steps.Done(stepInterface)
+		if !scriptOutput() && !verbose && interactive {
+			progressBar.Clear()
+			fmt.Printf("Interface: %v (loopback)\n", iface.Name)
+			progressBar.Render() // Restart progress bar on new line
+		}
+		infoLog("Loopback interface obtained: %v", iface.Name)
+	} else if srcFlag != "" {
+		iface = getSourceNetworkInterface(net.ParseIP(srcFlag), !ipOnlyFlag)
+		steps.Done(stepInterface)
+		if !scriptOutput() && !verbose && interactive {
+			progressBar.Clear()
+			fmt.Printf("Interface: %v (source %v)\n", iface.Name, srcFlag)
+			progressBar.Render() // Restart progress bar on new line
 		}
-		os.Exit(1)
+		infoLog("Network interface of source address %v obtained: %v", srcFlag, iface.Name)
+	} else {
+		iface = getDefaultNetworkInterface(!ipOnlyFlag)
+		steps.Done(stepInterface)
+		if !scriptOutput() && !verbose && interactive {
+			progressBar.Clear()
+			fmt.Printf("Default interface: %v\n", iface.Name)
+			progressBar.Render() // Restart progress bar on new line
+		}
+		infoLog("Default network interface obtained: %v", iface.Name)
+	}
+
+	// Steps 3-9, repeated for each domain: capture DNS traffic while performing the lookups
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if watchFlag > 0 {
+		var metrics *watchMetrics
+		if metricsFlag != "" {
+			metrics = newWatchMetrics()
+			if err := serveMetrics(metricsFlag, metrics); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				exit(exitUnavailable)
+			}
+		}
+		// Every cycle opens a new capture, so root is kept throughout
+		runWatch(ctx, iface, metrics)
+		stop()
+		exit(exitOK)
 	}
-	debugLog("User has root privileges.")
-	if progressBar != nil {
-		progressBar.Advance()
+
+	servers := make([]string, len(domainFlag)) // The server that answered each domain
+	var exitCode int
+	var jsonResults []interface{}
+	if domainsFileFlag != "" {
+		exitCode, jsonResults = checkDomainsFile(ctx, iface, servers)
+	} else {
+		exitCode, jsonResults = checkDomains(ctx, iface, steps, progressBar, servers)
 	}
+	stop()
 
-	// Step 2: Get the default network interface
-	iface := getDefaultNetworkInterface(!ipOnlyFlag, progressBar)
-	if !ipOnlyFlag && !debug {
+	// Remove a bar left part-way when a failure stopped the run early
+	if !progressBar.Finished() {
 		progressBar.Clear()
-		fmt.Printf("Default interface: %v\n", iface.Name)
-		progressBar.Render() // Restart progress bar on new line
 	}
-	debugLog("Default network interface obtained: %v", iface.Name)
 
-	// Step 3: Open AF_PACKET socket
-	if progressBar != nil {
-		progressBar.Advance()
+	// Compare the servers of the internal and public domains once both answered
+	splitReport := splitDNSFlag && !slices.Contains(servers, "")
+	if splitReport {
+		debugLog("Split DNS comparison: %s answered by %s, %s by %s.", domainFlag[0], servers[0], domainFlag[1], servers[1])
 	}
-	fd, err := openAFPacketSocket(iface)
-	if err != nil {
-		log.Printf("Failed to open AF_PACKET socket: %v", err)
-		debugLog("Failed to open AF_PACKET socket: %v", err)
-		if progressBar != nil {
-			progressBar.Advance()
+	if splitReport && !jsonFlag && !quietFlag {
+		printSplitDNS(domainFlag, servers)
+	}
+
+	if jsonFlag {
+		if splitReport {
+			printJSON(jsonSplitDNS{
+				SplitDNS:       servers[0] != servers[1],
+				InternalServer: maskIP(servers[0]),
+				PublicServer:   maskIP(servers[1]),
+				Domains:        jsonResults,
+			})
+		} else if len(domainFlag) == 1 && domainsFileFlag == "" {
+			printJSON(jsonResults[0])
+		} else {
+			printJSON(jsonResults)
 		}
-		os.Exit(1)
 	}
-	defer func() {
-		syscall.Close(fd)
-		debugLog("AF_PACKET socket closed.")
-		if progressBar != nil && progressBar.current < progressBar.total {
-			progressBar.Advance()
+	infoLog("Exiting with code %d.", exitCode)
+	exit(exitCode)
+}
+
+// checkDomains checks the domains one after the other, each with its own
+// capture, printing each result above the progress bar. It records the server
+// that answered each domain in servers and returns the exit code of the first
+// failure together with the objects to print in JSON mode; the run stops at a
+// failure unless --continue is set.
+func checkDomains(ctx context.Context, iface *net.Interface, steps *stepTracker, progressBar *ProgressBar, servers []string) (int, []interface{}) {
+	exitCode := exitOK
+	var jsonResults []interface{}
+	for i, domain := range domainFlag {
+		// Root is only needed to open the capture; give it up with the last one
+		dropRoot := !keepRootFlag && i == len(domainFlag)-1
+		result, err := detectAttempts(ctx, i, domain, iface, steps, dropRoot)
+		if err == nil {
+			servers[i] = result.Server.String()
 		}
-	}()
 
-	// Step 4: Skip BPF filter setup (we'll filter in userspace)
-	if progressBar != nil {
-		progressBar.Advance()
+		// Ensure that the progress bar has reached the end of this domain's steps
+		steps.Done(domainStep(i, whichdns.StepWait))
+
+		// Print this domain's result above the bar while more domains follow
+		last := i == len(domainFlag)-1
+		if !last {
+			progressBar.Clear()
+		}
+		code, out := reportDomain(domain, result, err)
+		jsonResults = append(jsonResults, out)
+		if !last {
+			progressBar.Render()
+		}
+		if code != exitOK && exitCode == exitOK {
+			exitCode = code
+		}
+		// A configuration mismatch is not a hard failure; an interrupt always stops
+		if code == exitInterrupted || (code != exitOK && code != exitMismatch && !continueFlag) {
+			break
+		}
 	}
-	debugLog("AF_PACKET socket opened, filtering DNS packets in userspace.")
+	return exitCode, jsonResults
+}
 
-	// Step 5: Start packet processing
-	if progressBar != nil {
-		progressBar.Advance()
+// detectAttempts runs the detection for the i-th domain up to --attempts times
+// while it times out or fails, rewinding the domain's part of the progress bar
+// before each new attempt. Every attempt opens a new capture, so root is only
+// given up, if dropRoot is set, once the last one has opened its capture.
+func detectAttempts(ctx context.Context, i int, domain string, iface *net.Interface, steps *stepTracker, dropRoot bool) (whichdns.Result, error) {
+	for attempt := 1; ; attempt++ {
+		last := attempt == attemptsFlag
+		result, err := detectDomain(ctx, domain, iface, steps.forDomain(i), dropRoot && last)
+		if err == nil {
+			debugLog("Detection for %s succeeded on attempt %d of %d.", domain, attempt, attemptsFlag)
+			return result, nil
+		}
+		if last || !retryable(err) {
+			return result, err
+		}
+		debugLog("Attempt %d of %d for %s failed: %v; trying again.", attempt, attemptsFlag, domain, err)
+		steps.Rewind(domainStep(i, whichdns.StepOpenCapture))
 	}
-	dnsResponseCh := make(chan string)
-	errorCh := make(chan error)
+}
 
-	go func() {
-		debugLog("Starting packet processing goroutine.")
-		startTime := time.Now()
-		for {
-			// Check if we've exceeded the timeout
-			if time.Since(startTime) > captureTimeout {
-				errorCh <- fmt.Errorf("packet capture timeout")
-				return
-			}
+// retryable reports whether a detection that failed with err may succeed when
+// run again, as after lost packets; an interrupt or a name resolved without
+// any query on the wire would fail the same way
+func retryable(err error) bool {
+	return errors.Is(err, whichdns.ErrTimeout) || errors.Is(err, whichdns.ErrLookup) ||
+		errors.Is(err, whichdns.ErrCapture) || errors.Is(err, whichdns.ErrCaptureOpen)
+}
 
-			frame, err := readPacket(fd)
-			if err != nil {
-				errorCh <- fmt.Errorf("failed to read packet: %w", err)
-				return
-			}
+// detectDomain runs one detection for domain, reporting the library's steps
+// to onStep and dropping root once the capture is open if dropRoot is set
+func detectDomain(ctx context.Context, domain string, iface *net.Interface, onStep func(step string, waitDone chan struct{}), dropRoot bool) (whichdns.Result, error) {
+	waitDone := make(chan struct{})
+	opts := detectOptions(domain, iface)
+	narrate := explainOnStep(domain, opts.Interface)
+	opts.OnStep = func(step string) {
+		if narrate != nil {
+			narrate(step)
+		}
+		if onStep != nil {
+			onStep(step, waitDone)
+		}
+	}
+	if dropRoot {
+		opts.OnCaptureOpen = dropPrivileges
+	}
 
-			if frame != nil {
-				debugLog("Packet captured: %d bytes", len(frame))
+	result, err := whichdns.Detect(ctx, opts)
+	close(waitDone) // Stop the progress bar incrementing
+	return result, err
+}
+
+// lookupCount returns how many lookups each detection sends: --probes if
+// set, --count otherwise
+func lookupCount() int {
+	if probesFlag > 0 {
+		return probesFlag
+	}
+	return countFlag
+}
+
+// detectOptions returns the library options for a detection of domain on
+// iface, or on the interfaces the flags select if it is nil; with --loopback
+// the library finds the loopback interface itself
+func detectOptions(domain string, iface *net.Interface) whichdns.Options {
+	opts := whichdns.Options{
+		Domain:         domain,
+		PcapFile:       pcapFlag,
+		WriteFile:      writeFlag,
+		Filter:         filterFlag,
+		Retries:        retriesFlag,
+		Snaplen:        snaplenFlag,
+		BufferSize:     bufferSizeFlag,
+		Immediate:      immediateFlag,
+		Count:          lookupCount(),
+		ProbeInterval:  probeIntervalFlag,
+		Type:           typeFlag,
+		Unique:         uniqueFlag,
+		SystemResolver: !pureGoFlag,
+		Timeout:        timeoutFlag,
+		IPv6:           ipv6Flag,
+		Family:         familyFlag,
+		Proto:          protoFlag,
+		Port:           portFlag,
+		Encrypted:      encryptedFlag,
+		All:            allFlag,
+		WaitFull:       waitFullFlag,
+		MinServers:     minServersFlag,
+		AllInterfaces:  allIfacesFlag,
+		Loopback:       loopbackFlag,
+		Source:         net.ParseIP(srcFlag),
+		AnyHost:        anyHostFlag,
+		Resolver:       resolverIP(),
+		EDNS:           ednsFlag,
+		DNSSEC:         dnssecFlag,
+	}
+	if iface != nil && !opts.Loopback {
+		opts.Interface = iface.Name
+	}
+	return opts
+}
+
+// reportDomain prints the outcome of a detection for domain in human or IP-only
+// mode and returns the exit code together with the object to print in JSON mode
+func reportDomain(domain string, result whichdns.Result, err error) (int, interface{}) {
+	// Label output lines with the domain when several are checked
+	prefix := ""
+	if len(domainFlag) > 1 {
+		prefix = domain + ": "
+	}
+
+	switch {
+	case err == nil:
+		dnsIPs := []string{result.Server.String()}
+		if allFlag {
+			dnsIPs = dnsIPs[:0]
+			for _, server := range result.Servers {
+				dnsIPs = append(dnsIPs, server.String())
+			}
+		}
 
-				if dnsIP, ok := extractDNSIP(frame); ok {
-					debugLog("DNS response detected from IP: %v", dnsIP)
-					dnsResponseCh <- dnsIP
-					return
+		// Compare the observed servers with the requested resolver, or with
+		// the configured ones
+		var configured, unexpected []string
+		if resolverFlag != "" {
+			configured = []string{resolverIP().String()}
+			for _, ip := range dnsIPs {
+				if ip != configured[0] {
+					unexpected = append(unexpected, ip)
+				}
+			}
+		} else if len(expectedFlag) > 0 {
+			configured = expectedFlag
+			for _, ip := range dnsIPs {
+				if !slices.Contains(expectedFlag, ip) {
+					unexpected = append(unexpected, ip)
 				}
-			} else {
-				// Small delay to prevent busy waiting when no packets
-				time.Sleep(1 * time.Millisecond)
 			}
+		} else if checkFlag {
+			configured, unexpected = compareWithConfigured(dnsIPs)
 		}
-	}()
 
-	// Steps 6-9: Perform 4 DNS lookups
-	for i := 1; i <= 4; i++ {
-		debugLog("Performing DNS lookup for domain: %v (Attempt %d)", domainFlag, i)
-		if progressBar != nil {
-			progressBar.Advance()
+		code := exitOK
+		if len(unexpected) > 0 {
+			debugLog("Observed DNS server for %s differs from configuration.", domain)
+			code = exitMismatch
 		}
-		_, err := net.LookupHost(domainFlag)
-		if err != nil {
-			log.Printf("DNS lookup failed: %v", err)
-			debugLog("DNS lookup failed: %v", err)
-			if progressBar != nil {
-				progressBar.Advance()
-			}
-			os.Exit(2)
+		tooFew := minServersFlag > 0 && len(dnsIPs) < minServersFlag
+		if tooFew {
+			debugLog("Only %d of the %d servers required answered for %s.", len(dnsIPs), minServersFlag, domain)
+			code = exitMismatch
+		}
+		if result.ServerPort != 0 {
+			infoLog("Response for %s came from port %d to client port %d.", domain, result.ServerPort, result.ClientPort)
+		}
+		if portRewritten(result) {
+			warnLog("Response for %s came from port %d instead of %d; NAT or a proxy rewrote it on the way.", domain, result.ServerPort, portFlag)
+		}
+		var conflicts [][2]net.IP
+		if allFlag {
+			conflicts = result.AnswerConflicts()
 		}
-	}
 
-	// Step 10: Start waiting for DNS response or timeout
-	// Start progress bar incrementing every second
-	waitDone := make(chan struct{})
-	if progressBar != nil {
-		go progressBar.IncrementDuringWait(captureTimeout, waitDone)
-	}
-
-	// Wait for DNS response or timeout
-	select {
-	case dnsIP := <-dnsResponseCh:
-		// DNS response received
-		close(waitDone) // Stop the progress bar incrementing
-		// Ensure that the progress bar has reached totalProgress
-		if progressBar != nil {
-			for progressBar.current < progressBar.total {
-				progressBar.Advance()
+		if jsonFlag {
+			out := jsonResult{
+				Domain:    domain,
+				Interface: result.Interface,
+				DNSServer: maskIP(dnsIPs[0]),
+				Scope:     ipScope(dnsIPs[0]),
+				Protocol:  result.Protocol,
+				SNI:       result.SNI,
+				Query:     result.Query,
+				ElapsedMS: result.Elapsed.Milliseconds(),
 			}
-		}
-		if ipOnlyFlag {
-			fmt.Println(dnsIP)
-			debugLog("Printed DNS IP and exiting with code 0.")
-		} else {
-			fmt.Printf("DNS server IP: %s\n", dnsIP)
-		}
-		os.Exit(0)
-	case err := <-errorCh:
-		// Error during packet processing
-		close(waitDone) // Stop the progress bar incrementing
-		// Ensure that the progress bar has reached totalProgress
-		if progressBar != nil {
-			for progressBar.current < progressBar.total {
-				progressBar.Advance()
+			if waitFullFlag {
+				out.Responses = maskCounts(result.Counts)
+			}
+			if ednsFlag {
+				out.EDNS = newJSONEDNS(result.EDNS)
+			}
+			if dnssecFlag {
+				out.DNSSEC = &jsonDNSSEC{QueryDO: result.DNSSEC.QueryDO, Authenticated: result.DNSSEC.AD, Truncated: result.DNSSEC.TC}
+			}
+			if allFlag {
+				out.DNSServers = maskIPs(dnsIPs)
+				out.Responses = maskCounts(result.Counts)
+				out.Interfaces = maskKeys(result.Interfaces)
+				out.Scopes = make(map[string]string, len(dnsIPs))
+				for _, dnsIP := range dnsIPs {
+					out.Scopes[maskIP(dnsIP)] = ipScope(dnsIP)
+				}
+				out.AnswerSets = maskAnswerSets(result.AnswerSets)
+				for _, pair := range conflicts {
+					out.Conflicts = append(out.Conflicts, [2]string{maskIP(pair[0].String()), maskIP(pair[1].String())})
+				}
+			}
+			if l2Flag && result.MAC != nil {
+				out.MAC = maskMAC(result.MAC)
+				if result.NextHop != nil {
+					out.NextHop = maskIP(result.NextHop.String())
+				}
+			}
+			if ttlFlag {
+				out.TTL = result.TTL
+				if allFlag {
+					out.TTLs = maskTTLCounts(result.TTLCounts)
+				}
+			}
+			if resolveFlag {
+				out.Hostname = lookupServerName(dnsIPs[0])
+			}
+			if verbose {
+				for _, answer := range result.Answers {
+					out.Answers = append(out.Answers, jsonAnswer{Name: answer.Name, Type: answer.Type, TTL: answer.TTL, Value: maskIP(answer.Value)})
+				}
+			}
+			if fingerprintFlag {
+				out.Software = serverSoftware(dnsIPs[0])
 			}
+			if minServersFlag > 0 {
+				enough := !tooFew
+				out.MinReached = &enough
+			}
+			if checkFlag || resolverFlag != "" {
+				matches := len(unexpected) == 0
+				out.Configured = maskIPs(configured)
+				out.Matches = &matches
+			} else if len(expectedFlag) > 0 {
+				matches := len(unexpected) == 0
+				out.Expected = maskIPs(expectedFlag)
+				out.Matches = &matches
+			}
+			return code, out
 		}
-		if ipOnlyFlag {
-			fmt.Fprintf(os.Stderr, "Failed to capture DNS response: %v\n", err)
-			debugLog("DNS response not captured; reason: %v. Exiting with code 2.", err)
+
+		if quietFlag {
+			debugLog("Detected DNS server %s for %s; output suppressed.", dnsIPs[0], domain)
+		} else if ipOnlyFlag {
+			for _, dnsIP := range maskIPs(dnsIPs) {
+				fmt.Fprintln(stdout, dnsIP)
+			}
+			debugLog("Printed DNS IP for %s.", domain)
+		} else if shellFlag {
+			printShellVars(dnsIPs, result)
+		} else if summaryFlag {
+			printSummary(domain, dnsIPs, result)
 		} else {
-			fmt.Fprintf(os.Stderr, "Failed to capture DNS response: %v\n", err)
-		}
-		os.Exit(2)
-	case <-time.After(captureTimeout):
-		// Timeout occurred
-		close(waitDone) // Stop the progress bar incrementing
-		// Ensure that the progress bar has reached totalProgress
-		if progressBar != nil {
-			for progressBar.current < progressBar.total {
-				progressBar.Advance()
+			for i, dnsIP := range dnsIPs {
+				var details []string
+				if scope := ipScope(dnsIP); scope != "" {
+					details = append(details, scope)
+				}
+				if name := lookupServerName(dnsIP); name != "" {
+					details = append(details, name)
+				}
+				if fingerprintFlag {
+					details = append(details, "version.bind: "+serverSoftware(dnsIP))
+				}
+				if allIfacesFlag {
+					details = append(details, "via "+result.Interfaces[dnsIP])
+				}
+				if i == 0 && l2Flag {
+					details = append(details, formatL2(result))
+				}
+				if i == 0 && ttlFlag && result.TTL > 0 {
+					details = append(details, formatTTL(result.TTL))
+				}
+				if i == 0 && result.Protocol != whichdns.ProtocolDNS {
+					details = append(details, protocolLabels[result.Protocol])
+					if result.SNI != "" {
+						details = append(details, "SNI "+result.SNI)
+					}
+					details = append(details, fmt.Sprintf("connected after %v", result.Elapsed.Round(10*time.Microsecond)))
+				} else if i == 0 {
+					if waitFullFlag {
+						details = append(details, fmt.Sprintf("answered %d of %d responses", result.Counts[dnsIP], totalCount(result.Counts)))
+					}
+					if result.Query != "" {
+						details = append(details, "answered query for "+result.Query)
+					}
+					if ednsFlag {
+						details = append(details, formatEDNS(result.EDNS))
+					}
+					if dnssecFlag {
+						details = append(details, formatDNSSEC(result.DNSSEC))
+					}
+					details = append(details, fmt.Sprintf("responded in %v", result.Elapsed.Round(10*time.Microsecond)))
+				}
+				fmt.Fprintln(stdout, green(fmt.Sprintf("%sDNS server IP: %s (%s)", prefix, maskIP(dnsIP), strings.Join(details, ", "))))
+			}
+			if allFlag && len(result.Counts) > 0 {
+				fmt.Fprintf(stdout, "%sResponses: %s\n", prefix, formatCounts(dnsIPs, result.Counts))
+			}
+			if allFlag && ttlFlag && len(result.TTLCounts) > 0 {
+				fmt.Fprintf(stdout, "%sTTLs: %s\n", prefix, formatTTLCounts(dnsIPs, result.TTLCounts))
+			}
+			if verbose && result.Protocol == whichdns.ProtocolDNS {
+				for _, answer := range result.Answers {
+					fmt.Fprintf(stdout, "%sAnswer: %s\n", prefix, formatAnswer(answer))
+				}
+				if len(result.Answers) == 0 {
+					fmt.Fprintf(stdout, "%sAnswer: none\n", prefix)
+				}
+			}
+			if checkFlag && len(unexpected) == 0 {
+				fmt.Fprintln(stdout, green(prefix+"Observed DNS server matches the configured resolvers."))
+			}
+			if len(expectedFlag) > 0 && len(unexpected) == 0 {
+				fmt.Fprintln(stdout, green(prefix+"Observed DNS server is one of the expected servers."))
 			}
 		}
-		if ipOnlyFlag {
-			fmt.Fprintf(os.Stderr, "Failed to capture DNS response: timeout after %v\n", captureTimeout)
-			debugLog("DNS response capture timed out after %v. Exiting with code 2.", captureTimeout)
-		} else {
-			fmt.Fprintf(os.Stderr, "Failed to capture DNS response: timeout after %v\n", captureTimeout)
+		if len(conflicts) > 0 {
+			printError("%s", formatAnswerConflicts(prefix, conflicts, result.AnswerSets))
+		}
+		if tooFew {
+			printError("%sOnly %d DNS server(s) answered, fewer than the %d required by --min-servers", prefix, len(dnsIPs), minServersFlag)
+		}
+		if len(unexpected) > 0 && len(expectedFlag) > 0 {
+			printError("%sObserved DNS server is not one of the expected servers\n  expected: %s\n  observed: %s",
+				prefix, strings.Join(maskIPs(expectedFlag), ", "), strings.Join(maskIPs(dnsIPs), ", "))
+		} else if len(unexpected) > 0 && resolverFlag != "" {
+			printError("%sResponse came from %s instead of the requested resolver %s: DNS is being redirected",
+				prefix, strings.Join(maskIPs(unexpected), ", "), maskIP(configured[0]))
+		} else if len(unexpected) > 0 {
+			printError("%sObserved DNS server %s is not a configured resolver (expected one of: %s)",
+				prefix, strings.Join(maskIPs(unexpected), ", "), strings.Join(maskIPs(configured), ", "))
+		}
+		return code, nil
+	case errors.Is(err, context.Canceled):
+		if !jsonFlag {
+			printError("Interrupted while waiting for a DNS response.")
+		}
+		debugLog("Capture interrupted.")
+		return exitInterrupted, domainError(domain, "interrupted")
+	case errors.Is(err, whichdns.ErrCaptureOpen):
+		if !jsonFlag {
+			log.Print(red(fmt.Sprintf("Failed to open AF_PACKET socket: %v", err)))
+		}
+		debugLog("Failed to open AF_PACKET socket: %v", err)
+		return exitUnavailable, domainError(domain, err.Error())
+	case errors.Is(err, whichdns.ErrNoInterface):
+		if !jsonFlag {
+			printError("%s%v", prefix, err)
 		}
-		os.Exit(2)
+		out := domainError(domain, err.Error())
+		out.ExitCode = exitNoInterface
+		return exitNoInterface, out
+	case errors.Is(err, whichdns.ErrResolvedLocally):
+		if !jsonFlag {
+			printError("%s%v", prefix, err)
+		}
+		infoLog("No DNS query for %s left the host.", domain)
+		return exitLocal, domainError(domain, err.Error())
+	case errors.Is(err, whichdns.ErrUnreachable):
+		if !jsonFlag {
+			printError("%s%v", prefix, err)
+		}
+		infoLog("A query for %s was bounced with ICMP; not waiting for the timeout.", domain)
+		return exitLookup, domainError(domain, err.Error())
+	case errors.Is(err, whichdns.ErrLookup):
+		if !jsonFlag {
+			log.Print(red(prefix + err.Error()))
+		}
+		return exitLookup, domainError(domain, err.Error())
+	default:
+		if !jsonFlag {
+			printError("%sFailed to capture DNS response: %v", prefix, err)
+		}
+		infoLog("DNS response for %s not captured; reason: %v.", domain, err)
+		if errors.Is(err, whichdns.ErrTimeout) || errors.Is(err, whichdns.ErrNoResponse) {
+			return exitTimeout, domainError(domain, err.Error())
+		}
+		return exitCapture, domainError(domain, err.Error())
 	}
 }
 
-// isRoot checks if the current user is root
-func isRoot() bool {
-	debugLog("Checking if the current user is root.")
-	currentUser, err := user.Current()
-	if err != nil {
-		log.Fatalf("Failed to get current user: %v", err)
+// formatEDNS describes the OPT record a server echoed, e.g. "EDNS0 payload 1232, DO"
+func formatEDNS(edns *whichdns.EDNS) string {
+	if edns == nil {
+		return "server does not support EDNS0"
+	}
+	s := fmt.Sprintf("EDNS%d payload %d", edns.Version, edns.PayloadSize)
+	if edns.DO {
+		s += ", DO"
 	}
-	debugLog("Current user UID: %s", currentUser.Uid)
-	return currentUser.Uid == "0"
+	if other := edns.Flags &^ 0x8000; other != 0 { // Flags besides DO
+		s += fmt.Sprintf(", flags %#04x", other)
+	}
+	return s
 }
 
-// getDefaultNetworkInterface retrieves the default network interface
-func getDefaultNetworkInterface(printOutput bool, progressBar *ProgressBar) *net.Interface {
-	debugLog("Fetching the default network interface.")
-	iface, err := findDefaultNetworkInterface()
-	if err != nil {
-		if printOutput {
-			fmt.Fprintf(os.Stderr, "Failed to get the default interface: %v\n", err)
-		}
-		debugLog("Error finding default network interface: %v", err)
-		if progressBar != nil {
-			progressBar.Advance()
-		}
-		os.Exit(1)
+// formatL2 describes the next hop a response came through, e.g.
+// "MAC 52:54:00:12:34:56 via 192.168.1.1"
+func formatL2(result whichdns.Result) string {
+	switch {
+	case result.MAC == nil:
+		return "no link-layer address"
+	case result.NextHop.Equal(result.Server):
+		return "MAC " + maskMAC(result.MAC) + ", the server itself on the local segment"
+	case result.NextHop != nil:
+		return "MAC " + maskMAC(result.MAC) + " via " + maskIP(result.NextHop.String())
 	}
-	if progressBar != nil {
-		progressBar.Advance()
+	return "MAC " + maskMAC(result.MAC)
+}
+
+// initialTTLs are the TTLs operating systems commonly send packets with
+var initialTTLs = []int{64, 128, 255}
+
+// estimateHops returns how many routers a packet arriving with ttl crossed,
+// assuming it was sent with the nearest common initial TTL above it
+func estimateHops(ttl int) int {
+	for _, initial := range initialTTLs {
+		if ttl <= initial {
+			return initial - ttl
+		}
 	}
-	return iface
+	return 0
 }
 
-// findDefaultNetworkInterface lists interfaces and returns the first one with a global unicast IP
-func findDefaultNetworkInterface() (*net.Interface, error) {
-	debugLog("Listing all network interfaces.")
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return nil, fmt.Errorf("could not list interfaces: %w", err)
+// formatTTL describes the IP TTL of a response, e.g. "TTL 57, ~7 hops"
+func formatTTL(ttl int) string {
+	hops := estimateHops(ttl)
+	if hops == 1 {
+		return fmt.Sprintf("TTL %d, ~1 hop", ttl)
 	}
+	return fmt.Sprintf("TTL %d, ~%d hops", ttl, hops)
+}
 
-	for _, iface := range interfaces {
-		debugLog("Checking interface: %v", iface.Name)
-		addrs, err := iface.Addrs()
-		if err != nil {
-			debugLog("Could not get addresses for interface %v: %v", iface.Name, err)
-			return nil, fmt.Errorf("could not get addresses for interface %v: %w", iface.Name, err)
+// formatTTLCounts lists the TTLs seen from each server in --all mode and how
+// often, flagging the servers with several as likely anycast, e.g.
+// "8.8.8.8: 117 (3), 120 (1) - several nodes?"
+func formatTTLCounts(servers []string, counts map[string]map[int]int) string {
+	parts := make([]string, 0, len(servers))
+	for _, server := range servers {
+		ttls := slices.Sorted(maps.Keys(counts[server]))
+		if len(ttls) == 0 {
+			continue
+		}
+		seen := make([]string, len(ttls))
+		for i, ttl := range ttls {
+			seen[i] = fmt.Sprintf("%d (%d)", ttl, counts[server][ttl])
+		}
+		part := maskIP(server) + ": " + strings.Join(seen, ", ")
+		if len(ttls) > 1 {
+			part += " - several nodes?"
 		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "; ")
+}
 
-		for _, addr := range addrs {
-			var ip net.IP
-			switch v := addr.(type) {
-			case *net.IPNet:
-				ip = v.IP
-			case *net.IPAddr:
-				ip = v.IP
+// formatAnswerConflicts describes the servers of --all that disagree on the
+// answer, listing what each of them returned, e.g.
+// "Warning: answer inconsistency detected between 10.0.0.1 and 10.0.0.2\n  10.0.0.1: A query: A 192.0.2.1\n  10.0.0.2: A query: none"
+func formatAnswerConflicts(prefix string, conflicts [][2]net.IP, sets map[string]map[string][]string) string {
+	var servers []string
+	for _, pair := range conflicts {
+		for _, server := range pair {
+			if !slices.Contains(servers, server.String()) {
+				servers = append(servers, server.String())
 			}
-
-			debugLog("Found IP address: %v on interface: %v", ip, iface.Name)
-
-			if ip.IsGlobalUnicast() {
-				debugLog("Global unicast IP found: %v on interface: %v", ip, iface.Name)
-				return &iface, nil
+		}
+	}
+	pairs := make([]string, len(conflicts))
+	for i, pair := range conflicts {
+		pairs[i] = maskIP(pair[0].String()) + " and " + maskIP(pair[1].String())
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%sWarning: answer inconsistency detected between %s", prefix, strings.Join(pairs, ", "))
+	masked := maskAnswerSets(sets)
+	for _, server := range maskIPs(servers) {
+		var answers []string
+		for _, qtype := range slices.Sorted(maps.Keys(masked[server])) {
+			records := "none"
+			if len(masked[server][qtype]) > 0 {
+				records = strings.Join(masked[server][qtype], ", ")
 			}
+			answers = append(answers, qtype+" query: "+records)
 		}
+		fmt.Fprintf(&b, "\n  %s: %s", server, strings.Join(answers, "; "))
 	}
+	return b.String()
+}
 
-	debugLog("No suitable default interface found.")
-	return nil, fmt.Errorf("no suitable default interface found")
+// sharedAddressSpace is 100.64.0.0/10, the carrier-grade NAT range of RFC
+// 6598, which like RFC 1918 space is not reachable from the internet
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// ipScope classifies a server address as "loopback", "link-local",
+// "private" (RFC 1918, RFC 6598 or an IPv6 ULA) or "public", telling an
+// internal resolver from one on the internet; it is empty for anything but
+// an IP address
+func ipScope(s string) string {
+	ip := net.ParseIP(s)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsLinkLocalUnicast():
+		return "link-local"
+	case ip.IsPrivate() || sharedAddressSpace.Contains(ip):
+		return "private"
+	}
+	return "public"
 }
 
-// debugLog prints debug messages if debug mode is enabled
-func debugLog(format string, a ...interface{}) {
-	if debug {
-		log.Printf("[DEBUG] "+format, a...)
+// formatDNSSEC summarizes the DNSSEC flags of a query and its response, e.g.
+// "DO set, AD set (validated)"
+func formatDNSSEC(flags whichdns.DNSSEC) string {
+	parts := []string{"DO not set"}
+	if flags.QueryDO {
+		parts[0] = "DO set"
+	}
+	if flags.AD {
+		parts = append(parts, "AD set (validated)")
+	} else {
+		parts = append(parts, "AD not set (not validated)")
+	}
+	if flags.TC {
+		parts = append(parts, "TC set (truncated)")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// printShellVars prints the result as shell variable assignments for eval
+func printShellVars(dnsIPs []string, result whichdns.Result) {
+	vars := [][2]string{
+		{"WHICHDNS_SERVER", maskIP(dnsIPs[0])},
+		{"WHICHDNS_IFACE", result.Interface},
+		{"WHICHDNS_ELAPSED_MS", strconv.FormatInt(result.Elapsed.Milliseconds(), 10)},
+		{"WHICHDNS_PROTOCOL", result.Protocol},
+	}
+	if allFlag {
+		vars = append(vars, [2]string{"WHICHDNS_SERVERS", strings.Join(maskIPs(dnsIPs), " ")})
+	}
+	if l2Flag {
+		vars = append(vars, [2]string{"WHICHDNS_MAC", maskMAC(result.MAC)})
+	}
+	for _, v := range vars {
+		fmt.Fprintf(stdout, "%s=%s\n", v[0], shellQuote(v[1]))
+	}
+}
+
+// shellQuote quotes s for a POSIX shell, leaving it bare when it only holds
+// characters no shell treats specially
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// totalCount sums the per-server response counts
+func totalCount(counts map[string]int) int {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total
+}
+
+// formatCounts renders per-server response counts in the order the servers were seen
+func formatCounts(servers []string, counts map[string]int) string {
+	parts := make([]string, 0, len(servers))
+	for _, server := range servers {
+		parts = append(parts, fmt.Sprintf("%s: %d", maskIP(server), counts[server]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// domainError builds the JSON error object for domain, naming the domain only
+// when several are checked so single-domain output is unchanged
+func domainError(domain, message string) jsonError {
+	out := jsonError{Error: message}
+	if len(domainFlag) > 1 {
+		out.Domain = domain
 	}
+	return out
 }
 
-// openAFPacketSocket creates a raw AF_PACKET socket for packet capture
-func openAFPacketSocket(iface *net.Interface) (int, error) {
-	// Create raw socket to capture all Ethernet frames
-	fd, err := syscall.Socket(afPacket, sockRaw, int(htons(ethPAll)))
+// runResolverConfigCheck reports the nameservers configured in resolv.conf
+// without capturing any traffic
+func runResolverConfigCheck() {
+	servers, err := whichdns.ConfiguredNameservers(resolvConfFlag)
+	if err == nil && len(servers) == 0 {
+		err = fmt.Errorf("no nameservers configured in %s", resolvConfFlag)
+	}
 	if err != nil {
-		return -1, fmt.Errorf("failed to create AF_PACKET socket: %w", err)
+		if jsonFlag {
+			printJSON(jsonError{Error: err.Error()})
+		} else {
+			fmt.Fprintf(os.Stderr, "Failed to read configured resolvers: %v\n", err)
+		}
+		exit(exitResolvConf)
 	}
 
-	// Bind to interface
-	sa := &sockaddrLl{
-		sllFamily:   afPacket,
-		sllProtocol: htons(ethPAll),
-		sllIfindex:  int32(iface.Index),
+	var ips []string
+	for _, server := range servers {
+		ips = append(ips, maskIP(server.String()))
 	}
 
-	_, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(sa)), unsafe.Sizeof(*sa))
-	if errno != 0 {
-		syscall.Close(fd)
-		return -1, fmt.Errorf("failed to bind socket to interface: %w", errno)
+	if jsonFlag {
+		printJSON(jsonConfigured{Source: "configured", Nameservers: ips})
+	} else if quietFlag {
+		debugLog("Configured resolvers: %s; output suppressed.", strings.Join(ips, ", "))
+	} else if ipOnlyFlag {
+		for _, ip := range ips {
+			fmt.Fprintln(stdout, ip)
+		}
+	} else {
+		for _, ip := range ips {
+			fmt.Fprintf(stdout, "Configured resolver (not observed): %s\n", ip)
+		}
 	}
+	exit(exitOK)
+}
 
-	// Set socket to non-blocking mode
-	if err := syscall.SetNonblock(fd, true); err != nil {
-		syscall.Close(fd)
-		return -1, fmt.Errorf("failed to set socket to non-blocking mode: %w", err)
+// parseResolver splits a --resolver value, ip or ip:port with brackets around
+// an IPv6 address, into the address and the port, zero if none is given
+func parseResolver(s string) (net.IP, int, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, 0, nil
 	}
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%q is not an IP address or ip:port", s)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("%q is not an IP address", host)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, 0, fmt.Errorf("port %q must be between 1 and 65535", portStr)
+	}
+	return ip, port, nil
+}
+
+// formatAnswer describes an answer record of the response, masking an
+// address with --mask, e.g. "example.com 300 A 93.184.216.34"
+func formatAnswer(answer whichdns.Answer) string {
+	answer.Value = maskIP(answer.Value)
+	return answer.String()
+}
 
-	debugLog("AF_PACKET socket created and bound to interface %s (index %d)", iface.Name, iface.Index)
-	return fd, nil
+// portRewritten reports whether the matched response came from another port
+// than the one the queries were sent to
+func portRewritten(result whichdns.Result) bool {
+	return result.ServerPort != 0 && result.ServerPort != portFlag
 }
 
-// htons converts host byte order to network byte order (big endian)
-func htons(x uint16) uint16 {
-	return (x<<8)&0xff00 | x>>8
+// resolvConfEnv names the environment variable that replaces /etc/resolv.conf
+// as the --resolv-conf default, e.g. inside a container or chroot
+const resolvConfEnv = "WHICHDNS_RESOLV_CONF"
+
+// defaultResolvConf returns the --resolv-conf default
+func defaultResolvConf() string {
+	if path := os.Getenv(resolvConfEnv); path != "" {
+		return path
+	}
+	return whichdns.DefaultResolvConf
 }
 
-// readPacket reads a single packet from the AF_PACKET socket
-func readPacket(fd int) ([]byte, error) {
-	const maxFrameSize = 65536 // Maximum Ethernet frame size
-	buf := make([]byte, maxFrameSize)
+// resolverIP returns the address of the --resolver server, nil if none is set
+func resolverIP() net.IP {
+	ip, _, _ := parseResolver(resolverFlag)
+	return ip
+}
 
-	n, _, err := syscall.Recvfrom(fd, buf, 0)
+// compareWithConfigured reads the configured nameservers and returns them along
+// with the observed servers that are not among them
+func compareWithConfigured(observed []string) ([]string, []string) {
+	servers, err := whichdns.ConfiguredNameservers(resolvConfFlag)
 	if err != nil {
-		if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
-			// No data available, try again
-			return nil, nil
+		if jsonFlag {
+			printJSON(jsonError{Error: err.Error()})
+		} else {
+			fmt.Fprintf(os.Stderr, "Failed to read configured resolvers: %v\n", err)
 		}
-		debugLog("Recvfrom error: %v", err)
-		return nil, err
+		exit(exitResolvConf)
 	}
 
-	if n == 0 {
-		// Empty packet, skip
-		debugLog("Received empty packet (n=0)")
-		return nil, nil
+	var configured []string
+	for _, server := range servers {
+		configured = append(configured, server.String())
 	}
 
-	debugLog("Received packet with %d bytes", n)
-	return buf[:n], nil
+	var unexpected []string
+	for _, ip := range observed {
+		if !slices.Contains(configured, ip) {
+			unexpected = append(unexpected, ip)
+		}
+	}
+	return configured, unexpected
 }
 
-// parseEthernetFrame parses basic Ethernet frame to extract IP packet
-func parseEthernetFrame(frame []byte) ([]byte, bool) {
-	if len(frame) < ethHeaderLen {
-		return nil, false
+// serverSoftware asks the DNS server at ip for its version.bind string,
+// returning the reason instead (e.g. "refused") when it does not tell
+func serverSoftware(ip string) string {
+	version, err := whichdns.ServerVersion(context.Background(), net.ParseIP(ip), portFlag, fingerprintTimeout)
+	if errors.Is(err, whichdns.ErrNoVersion) {
+		debugLog("Server %v did not report its version: %v", ip, err)
+		return strings.TrimPrefix(err.Error(), whichdns.ErrNoVersion.Error()+": ")
+	}
+	if err != nil {
+		debugLog("Version query to %v failed: %v", ip, err)
+		return "unavailable"
 	}
+	return version
+}
 
-	// Check if it's IPv4 (EtherType 0x0800)
-	etherType := uint16(frame[12])<<8 | uint16(frame[13])
-	if etherType != ethPIPv4 {
-		return nil, false
+// lookupServerName returns the PTR name of ip when --resolve is set, or "" if there is none
+func lookupServerName(ip string) string {
+	if !resolveFlag {
+		return ""
 	}
+	names, err := net.LookupAddr(ip)
+	if err != nil || len(names) == 0 {
+		debugLog("Reverse lookup for %v failed: %v", ip, err)
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
 
-	return frame[ethHeaderLen:], true
+// scriptOutput reports whether stdout is reserved for machine-readable output
+// or silenced, so no progress bar or informational lines may be printed
+func scriptOutput() bool {
+	return ipOnlyFlag || jsonFlag || quietFlag || shellFlag || summaryFlag
 }
 
-// parseIPPacket extracts UDP packet from IP packet
-func parseIPPacket(ipPacket []byte) ([]byte, bool) {
-	if len(ipPacket) < ipHeaderMin {
-		return nil, false
+// isTerminal reports whether f is a terminal rather than a pipe or file, where
+// the carriage returns of the progress bar would garble the output
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// printJSON writes v to stdout as a single JSON object
+func printJSON(v interface{}) {
+	if err := json.NewEncoder(stdout).Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode JSON output: %v\n", err)
 	}
+}
 
-	// Check if it's UDP
-	if ipPacket[9] != ipProtoUDP {
-		return nil, false
+// interfacePollInterval is how often --wait-for-interface looks for the interface again
+const interfacePollInterval = 500 * time.Millisecond
+
+// awaitInterface calls find every poll until it returns an interface or wait
+// has elapsed, and returns its last result; with no wait it calls find once
+func awaitInterface(wait, poll time.Duration, find func() (*net.Interface, error)) (*net.Interface, error) {
+	deadline := time.Now().Add(wait)
+	for attempt := 1; ; attempt++ {
+		iface, err := find()
+		if err == nil || !time.Now().Before(deadline) {
+			return iface, err
+		}
+		if attempt == 1 {
+			infoLog("Waiting up to %v for the interface: %v", wait, err)
+		}
+		debugLog("Interface not ready (attempt %d): %v; looking again in %v", attempt, err, poll)
+		time.Sleep(min(poll, time.Until(deadline)))
 	}
+}
 
-	// Get header length (first 4 bits * 4)
-	headerLen := int(ipPacket[0]&0x0F) * 4
-	if len(ipPacket) < headerLen+udpHeaderLen {
-		return nil, false
+// getDefaultNetworkInterface retrieves the default network interface
+func getDefaultNetworkInterface(printOutput bool) *net.Interface {
+	debugLog("Fetching the default network interface.")
+	iface, err := awaitInterface(waitIfaceFlag, interfacePollInterval, func() (*net.Interface, error) {
+		return whichdns.DefaultInterface(ipv6Flag)
+	})
+	if err != nil {
+		code := exitUnavailable
+		if errors.Is(err, whichdns.ErrNoInterface) {
+			// Not a failure of this host so much as an environment where
+			// whichdns cannot apply; always say so, even with --iponly
+			code, printOutput = exitNoInterface, true
+		}
+		if jsonFlag {
+			printJSON(jsonError{Error: fmt.Sprintf("failed to get the default interface: %v", err), ExitCode: code})
+		} else if printOutput {
+			fmt.Fprintf(os.Stderr, "Failed to get the default interface: %v\n", err)
+		}
+		debugLog("Error finding default network interface: %v", err)
+		exit(code)
 	}
+	if verbose {
+		warnAmbiguousInterface(iface.Name)
+	}
+	return iface
+}
 
-	return ipPacket[headerLen:], true
+// warnAmbiguousInterface warns when interfaces other than chosen, the default
+// one, could have been picked, since capturing on the wrong one is a common
+// cause of timeouts and unexpected results
+func warnAmbiguousInterface(chosen string) {
+	candidates, err := whichdns.CaptureInterfaces(whichdns.Options{AllInterfaces: true, IPv6: ipv6Flag})
+	if err != nil {
+		debugLog("Could not list the candidate interfaces: %v", err)
+		return
+	}
+	if message := ambiguousInterfaceMessage(candidates, chosen); message != "" {
+		warnLog("%s", message)
+	}
 }
 
-// parseUDPPacket extracts DNS data from UDP packet
-func parseUDPPacket(udpPacket []byte) ([]byte, uint16, bool) {
-	if len(udpPacket) < udpHeaderLen {
-		return nil, 0, false
+// ambiguousInterfaceMessage describes the choice of chosen among several
+// candidate interfaces, or returns "" if there was no other candidate
+func ambiguousInterfaceMessage(candidates []string, chosen string) string {
+	if len(candidates) < 2 {
+		return ""
 	}
+	return fmt.Sprintf("Multiple candidate interfaces found: %s; using %s - specify --interface to override.", strings.Join(candidates, ", "), chosen)
+}
 
-	srcPort := uint16(udpPacket[0])<<8 | uint16(udpPacket[1])
-	dstPort := uint16(udpPacket[2])<<8 | uint16(udpPacket[3])
+// getNamedNetworkInterface retrieves the network interface requested with --interface
+func getNamedNetworkInterface(name string, printOutput bool) *net.Interface {
+	debugLog("Fetching network interface %v.", name)
+	iface, err := awaitInterface(waitIfaceFlag, interfacePollInterval, func() (*net.Interface, error) {
+		return whichdns.InterfaceByName(name, ipv6Flag)
+	})
+	if err != nil {
+		if jsonFlag {
+			printJSON(jsonError{Error: err.Error()})
+		} else if printOutput {
+			fmt.Fprintf(os.Stderr, "Failed to get interface %v: %v\n", name, err)
+		}
+		debugLog("Error finding network interface %v: %v", name, err)
+		exit(exitUnavailable)
+	}
+	return iface
+}
 
-	// Check if source port is DNS
-	if srcPort != dnsPort {
-		return nil, 0, false
+// loopbackCapture reports whether to capture on the loopback interface: with
+// --loopback, or when --resolver is a loopback address such as a local
+// unbound or dnsmasq and no other flag picks the interface
+func loopbackCapture() bool {
+	if loopbackFlag {
+		return true
 	}
+	return interfaceFlag == "" && !allIfacesFlag && pcapFlag == "" && srcFlag == "" && resolverIP().IsLoopback()
+}
 
-	// Get UDP data length
-	dataLen := uint16(udpPacket[4])<<8 | uint16(udpPacket[5])
-	if dataLen < udpHeaderLen || len(udpPacket) < int(dataLen) {
-		return nil, 0, false
+// getLoopbackNetworkInterface retrieves the loopback interface for --loopback
+func getLoopbackNetworkInterface(printOutput bool) *net.Interface {
+	debugLog("Fetching the loopback interface.")
+	iface, err := awaitInterface(waitIfaceFlag, interfacePollInterval, func() (*net.Interface, error) {
+		return whichdns.LoopbackInterface(ipv6Flag)
+	})
+	if err != nil {
+		if jsonFlag {
+			printJSON(jsonError{Error: err.Error()})
+		} else if printOutput {
+			fmt.Fprintf(os.Stderr, "Failed to get the loopback interface: %v\n", err)
+		}
+		debugLog("Error finding the loopback interface: %v", err)
+		exit(exitUnavailable)
 	}
+	return iface
+}
 
-	return udpPacket[udpHeaderLen:dataLen], dstPort, true
+// getSourceNetworkInterface retrieves the network interface the --src address is assigned to
+func getSourceNetworkInterface(ip net.IP, printOutput bool) *net.Interface {
+	debugLog("Fetching the network interface of %v.", ip)
+	iface, err := awaitInterface(waitIfaceFlag, interfacePollInterval, func() (*net.Interface, error) {
+		return whichdns.InterfaceForIP(ip)
+	})
+	if err != nil {
+		if jsonFlag {
+			printJSON(jsonError{Error: err.Error()})
+		} else if printOutput {
+			fmt.Fprintf(os.Stderr, "Failed to get interface of %v: %v\n", ip, err)
+		}
+		debugLog("Error finding network interface of %v: %v", ip, err)
+		exit(exitUnavailable)
+	}
+	return iface
 }
 
-// extractDNSIP extracts the DNS server IP from the Ethernet frame
-func extractDNSIP(frame []byte) (string, bool) {
-	// Parse Ethernet frame
-	ipPacket, ok := parseEthernetFrame(frame)
-	if !ok {
-		return "", false
+// parseLogLevel maps a --loglevel name to a slog level; debug forces the debug level
+func parseLogLevel(name string, debug bool) (slog.Level, error) {
+	if debug {
+		return slog.LevelDebug, nil
 	}
+	switch strings.ToLower(name) {
+	case "error":
+		return slog.LevelError, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	}
+	return 0, fmt.Errorf("--loglevel must be error, warn, info or debug, not %q", name)
+}
 
-	// Parse IP packet
-	udpPacket, ok := parseIPPacket(ipPacket)
-	if !ok {
-		return "", false
+// setupLogging configures the stderr logger for the CLI and the library, and
+// with --debug-file also sends every record at debug level to that file
+func setupLogging() error {
+	level, err := parseLogLevel(logLevelFlag, debugFlag)
+	if err != nil {
+		return err
 	}
+	if verboseFlag {
+		level = min(level, slog.LevelInfo)
+	}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	if debugFileFlag != "" {
+		file, err := os.OpenFile(debugFileFlag, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("--debug-file: %w", err)
+		}
+		debugFile = file
+		handler = teeHandler{handler, slog.NewTextHandler(file, &slog.HandlerOptions{Level: slog.LevelDebug})}
+	}
+	logger = slog.New(handler)
+	whichdns.Logger = logger
+	// Only what reaches the terminal hides the bar
+	verbose = level <= slog.LevelInfo
+	return nil
+}
 
-	// Parse UDP packet
-	_, _, ok = parseUDPPacket(udpPacket)
-	if !ok {
-		return "", false
+// closeDebugFile closes the --debug-file, if one is open
+func closeDebugFile() error {
+	if debugFile == nil {
+		return nil
 	}
+	err := debugFile.Close()
+	debugFile = nil
+	if err != nil {
+		return fmt.Errorf("--debug-file: %w", err)
+	}
+	return nil
+}
+
+// teeHandler passes each log record to every handler enabled for its level
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slices.ContainsFunc(t, func(h slog.Handler) bool { return h.Enabled(ctx, level) })
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
 
-	// Extract source IP from IP header
-	if len(ipPacket) < ipSrcOffset+4 {
-		return "", false
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
 	}
+	return handlers
+}
+
+// debugLog logs a formatted message at debug level
+func debugLog(format string, a ...interface{}) {
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		logger.Debug(fmt.Sprintf(format, a...))
+	}
+}
+
+// warnLog logs a formatted message at warn level
+func warnLog(format string, a ...interface{}) {
+	if logger.Enabled(context.Background(), slog.LevelWarn) {
+		logger.Warn(fmt.Sprintf(format, a...))
+	}
+}
 
-	srcIP := net.IP(ipPacket[ipSrcOffset : ipSrcOffset+4])
-	return srcIP.String(), true
+// infoLog logs a formatted message at info level
+func infoLog(format string, a ...interface{}) {
+	if logger.Enabled(context.Background(), slog.LevelInfo) {
+		logger.Info(fmt.Sprintf(format, a...))
+	}
 }
 
 func main() {
-	if err := rootCmd.Execute(); err != nil {
+	interactive = isTerminal(os.Stdout)
+	err := rootCmd.Execute()
+	if err := closeDebugFile(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 }
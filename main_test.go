@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"whichdns/whichdns"
 )
 
 func TestFlags(t *testing.T) {
 	// Test default values
-	if domainFlag != "example.com" {
-		t.Errorf("Expected default domain 'example.com', got '%s'", domainFlag)
+	if len(domainFlag) != 1 || domainFlag[0] != "example.com" {
+		t.Errorf("Expected default domain 'example.com', got '%v'", domainFlag)
 	}
 	if ipOnlyFlag != false {
 		t.Errorf("Expected default ipOnly false, got %v", ipOnlyFlag)
@@ -16,13 +27,16 @@ func TestFlags(t *testing.T) {
 		t.Errorf("Expected default debug false, got %v", debugFlag)
 	}
 
-	// Test setting flags
-	domainFlag = "test.com"
-	ipOnlyFlag = true
-	debugFlag = true
+	// Parse flags the way cobra does when the command runs; they populate the
+	// package variables, which are restored so later tests see the defaults
+	savedDomains, savedIPOnly, savedDebug, savedIPv6 := domainFlag, ipOnlyFlag, debugFlag, ipv6Flag
+	defer func() { domainFlag, ipOnlyFlag, debugFlag, ipv6Flag = savedDomains, savedIPOnly, savedDebug, savedIPv6 }()
+	if err := rootCmd.ParseFlags([]string{"--domain", "test.com", "--iponly", "--debug", "-6"}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
 
-	if domainFlag != "test.com" {
-		t.Errorf("Expected domain 'test.com', got '%s'", domainFlag)
+	if len(domainFlag) != 1 || domainFlag[0] != "test.com" {
+		t.Errorf("Expected domain 'test.com', got '%v'", domainFlag)
 	}
 	if !ipOnlyFlag {
 		t.Errorf("Expected ipOnly to be true")
@@ -30,24 +44,482 @@ func TestFlags(t *testing.T) {
 	if !debugFlag {
 		t.Errorf("Expected debug to be true")
 	}
+	if !ipv6Flag {
+		t.Errorf("Expected -6 to set ipv6")
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	saved := timeoutFlag
+	defer func() { timeoutFlag = saved }()
+
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		timeoutFlag = timeout
+		if err := validateFlags(); err == nil {
+			t.Errorf("Expected timeout %v to be rejected", timeout)
+		}
+	}
+
+	timeoutFlag = 3 * time.Second
+	if err := validateFlags(); err != nil {
+		t.Errorf("Expected timeout 3s to be accepted, got %v", err)
+	}
+
+	savedProto := protoFlag
+	defer func() { protoFlag = savedProto }()
+	protoFlag = "sctp"
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --proto sctp to be rejected")
+	}
+	protoFlag = savedProto
+
+	savedWidth, savedStyle := barWidthFlag, barStyleFlag
+	defer func() { barWidthFlag, barStyleFlag = savedWidth, savedStyle }()
+	barWidthFlag = 0
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --bar-width 0 to be rejected")
+	}
+	barWidthFlag, barStyleFlag = savedWidth, "dots"
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --bar-style dots to be rejected")
+	}
+	barStyleFlag = savedStyle
+
+	savedColor := colorFlag
+	defer func() { colorFlag = savedColor }()
+	colorFlag = "sometimes"
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --color sometimes to be rejected")
+	}
+	colorFlag = savedColor
+
+	savedFamily, savedIPv6 := familyFlag, ipv6Flag
+	defer func() { familyFlag, ipv6Flag = savedFamily, savedIPv6 }()
+	familyFlag = "5"
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --family 5 to be rejected")
+	}
+	familyFlag, ipv6Flag = "4", true
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --family 4 with --ipv6 to be rejected")
+	}
+	familyFlag, ipv6Flag = savedFamily, savedIPv6
+
+	savedPort := portFlag
+	defer func() { portFlag = savedPort }()
+	for _, port := range []int{0, 65536} {
+		portFlag = port
+		if err := validateFlags(); err == nil {
+			t.Errorf("Expected --port %d to be rejected", port)
+		}
+	}
+	portFlag = savedPort
+
+	savedDomains, savedWrite := domainFlag, writeFlag
+	defer func() { domainFlag, writeFlag = savedDomains, savedWrite }()
+	domainFlag, writeFlag = []string{"a.example", "b.example"}, "out.pcap"
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --write with several domains to be rejected")
+	}
+	domainFlag, writeFlag = savedDomains, savedWrite
+
+	savedFilter := filterFlag
+	defer func() { filterFlag = savedFilter }()
+	filterFlag = "port 53"
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --filter \"port 53\" to be rejected")
+	}
+	filterFlag = "net 10.0.0.0/8 and not host 10.0.0.2"
+	if err := validateFlags(); err != nil {
+		t.Errorf("Expected a host and net filter to be accepted, got %v", err)
+	}
+	filterFlag = savedFilter
+
+	savedSrc := srcFlag
+	defer func() { srcFlag = savedSrc }()
+	for _, src := range []string{"10.0.0", "192.0.2.77"} {
+		srcFlag = src
+		if err := validateFlags(); err == nil {
+			t.Errorf("Expected --src %s to be rejected", src)
+		}
+	}
+	srcFlag = savedSrc
+
+	savedSetup, savedNoRoot := checkSetupFlag, noRootFlag
+	defer func() { checkSetupFlag, noRootFlag = savedSetup, savedNoRoot }()
+	checkSetupFlag, noRootFlag = true, true
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --check-setup with --noroot to be rejected")
+	}
+	checkSetupFlag, noRootFlag = savedSetup, savedNoRoot
+
+	savedQuiet, savedJSON := quietFlag, jsonFlag
+	defer func() { quietFlag, jsonFlag = savedQuiet, savedJSON }()
+	quietFlag, jsonFlag = true, true
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --quiet with --json to be rejected")
+	}
+	quietFlag = savedQuiet
+
+	savedSummary := summaryFlag
+	defer func() { summaryFlag = savedSummary }()
+	summaryFlag = true
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --summary with --json to be rejected")
+	}
+	summaryFlag = savedSummary
+
+	savedSplit, savedDomains := splitDNSFlag, domainFlag
+	defer func() { splitDNSFlag, domainFlag = savedSplit, savedDomains }()
+	splitDNSFlag = true
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --split-dns with a single domain to be rejected")
+	}
+	domainFlag = []string{"intranet.example.com", "example.com"}
+	if err := validateFlags(); err != nil {
+		t.Errorf("Expected --split-dns with two domains to be accepted, got %v", err)
+	}
+	splitDNSFlag, domainFlag = savedSplit, savedDomains
+
+	savedMin, savedAll := minServersFlag, allFlag
+	defer func() { minServersFlag, allFlag = savedMin, savedAll }()
+	minServersFlag = 2
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --min-servers without --all to be rejected")
+	}
+	allFlag = true
+	if err := validateFlags(); err != nil {
+		t.Errorf("Expected --min-servers with --all to be accepted, got %v", err)
+	}
+	minServersFlag, allFlag = savedMin, savedAll
+
+	savedAttempts := attemptsFlag
+	defer func() { attemptsFlag = savedAttempts }()
+	attemptsFlag = 0
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --attempts 0 to be rejected")
+	}
+	attemptsFlag = savedAttempts
+
+	savedWait, savedWaitPcap := waitIfaceFlag, pcapFlag
+	defer func() { waitIfaceFlag, pcapFlag = savedWait, savedWaitPcap }()
+	waitIfaceFlag = -time.Second
+	if err := validateFlags(); err == nil {
+		t.Error("Expected a negative --wait-for-interface to be rejected")
+	}
+	waitIfaceFlag, pcapFlag = time.Minute, "capture.pcap"
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --wait-for-interface with --pcap to be rejected")
+	}
+	waitIfaceFlag, pcapFlag = savedWait, savedWaitPcap
+
+	savedLoopback, savedLoopbackIface := loopbackFlag, interfaceFlag
+	defer func() { loopbackFlag, interfaceFlag = savedLoopback, savedLoopbackIface }()
+	loopbackFlag, interfaceFlag = true, "eth0"
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --loopback with --interface to be rejected")
+	}
+	loopbackFlag, interfaceFlag = savedLoopback, savedLoopbackIface
+
+	savedSelftest, savedResolver := selftestFlag, resolverFlag
+	defer func() { selftestFlag, resolverFlag = savedSelftest, savedResolver }()
+	selftestFlag, resolverFlag = true, "9.9.9.9"
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --selftest with --resolver to be rejected")
+	}
+	resolverFlag = savedResolver
+	if err := validateFlags(); err != nil {
+		t.Errorf("Expected --selftest alone to be accepted, got %v", err)
+	}
+	selftestFlag = savedSelftest
+
+	savedCompletion := completionFlag
+	defer func() { completionFlag = savedCompletion }()
+	completionFlag = "tcsh"
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --completion tcsh to be rejected")
+	}
+	completionFlag = "zsh"
+	if err := validateFlags(); err != nil {
+		t.Errorf("Expected --completion zsh to be accepted, got %v", err)
+	}
+	completionFlag = savedCompletion
+
+	savedCount, savedInterval := countFlag, probeIntervalFlag
+	defer func() { countFlag, probeIntervalFlag = savedCount, savedInterval }()
+	countFlag, probeIntervalFlag = 4, time.Second
+	if err := validateFlags(); err == nil {
+		t.Error("Expected a fourth probe at 3s, past the 3s timeout, to be rejected")
+	}
+	probeIntervalFlag = 500 * time.Millisecond
+	if err := validateFlags(); err != nil {
+		t.Errorf("Expected probes every 500ms to fit the 3s timeout, got %v", err)
+	}
+	probeIntervalFlag = -time.Second
+	if err := validateFlags(); err == nil {
+		t.Error("Expected a negative --probe-interval to be rejected")
+	}
+	savedProbes := probesFlag
+	defer func() { probesFlag = savedProbes }()
+	countFlag, probesFlag, probeIntervalFlag = 1, 8, 500*time.Millisecond
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --probes, not --count, to decide when the last probe starts")
+	}
+	probesFlag = -1
+	if err := validateFlags(); err == nil {
+		t.Error("Expected negative --probes to be rejected")
+	}
+	countFlag, probesFlag, probeIntervalFlag = savedCount, savedProbes, savedInterval
+
+	savedExpected, savedCheck := expectedFlag, checkFlag
+	defer func() { expectedFlag, checkFlag = savedExpected, savedCheck }()
+	expectedFlag = []string{"10.0.0.53", "dns.example.com"}
+	if err := validateFlags(); err == nil {
+		t.Error("Expected a hostname in --compare-expected to be rejected")
+	}
+	expectedFlag = []string{"10.0.0.53", "2001:DB8::0:53"}
+	if err := validateFlags(); err != nil {
+		t.Errorf("Expected --compare-expected with two IPs to be accepted, got %v", err)
+	} else if expectedFlag[1] != "2001:db8::53" {
+		t.Errorf("Expected --compare-expected addresses in canonical form, got %s", expectedFlag[1])
+	}
+	checkFlag = true
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --compare-expected with --check to be rejected")
+	}
+	expectedFlag, checkFlag = savedExpected, savedCheck
+
+	savedWatch := watchFlag
+	defer func() { watchFlag = savedWatch }()
+	watchFlag = 30 * time.Second
+	if err := validateFlags(); err != nil {
+		t.Errorf("Expected --watch with --json to be accepted, got %v", err)
+	}
+	savedPcap := pcapFlag
+	defer func() { pcapFlag = savedPcap }()
+	pcapFlag = "capture.pcap"
+	if err := validateFlags(); err == nil {
+		t.Error("Expected --watch with --pcap to be rejected")
+	}
 }
 
-func TestFindDefaultNetworkInterface(t *testing.T) {
-	iface, err := findDefaultNetworkInterface()
+func TestShellQuote(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"192.168.1.1", "192.168.1.1"},
+		{"fe80::1%eth0", "fe80::1%eth0"},
+		{"", "''"},
+		{"1.1.1.1 8.8.8.8", "'1.1.1.1 8.8.8.8'"},
+		{"it's; rm -rf /", `'it'\''s; rm -rf /'`},
+		{"$(id)", "'$(id)'"},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		name  string
+		debug bool
+		want  slog.Level
+		ok    bool
+	}{
+		{"error", false, slog.LevelError, true},
+		{"warn", false, slog.LevelWarn, true},
+		{"INFO", false, slog.LevelInfo, true},
+		{"debug", false, slog.LevelDebug, true},
+		{"error", true, slog.LevelDebug, true},
+		{"trace", false, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseLogLevel(tt.name, tt.debug)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseLogLevel(%q, %v) = (%v, %v), want %v", tt.name, tt.debug, got, err, tt.want)
+		}
+	}
+}
+
+func TestAwaitInterface(t *testing.T) {
+	missing := errors.New("interface \"eth0\" does not exist")
+	eth0 := &net.Interface{Name: "eth0"}
+	tests := []struct {
+		name     string
+		wait     time.Duration
+		failures int
+		calls    int
+		ok       bool
+	}{
+		{"no wait, present", 0, 0, 1, true},
+		{"no wait, missing", 0, 1, 1, false},
+		{"appears while waiting", time.Second, 2, 3, true},
+		{"never appears", 5 * time.Millisecond, 1000, 0, false},
+	}
+
+	for _, tt := range tests {
+		calls := 0
+		iface, err := awaitInterface(tt.wait, time.Millisecond, func() (*net.Interface, error) {
+			calls++
+			if calls <= tt.failures {
+				return nil, missing
+			}
+			return eth0, nil
+		})
+		if (err == nil) != tt.ok || (tt.ok && iface != eth0) {
+			t.Errorf("%s: got (%v, %v)", tt.name, iface, err)
+		}
+		if tt.calls > 0 && calls != tt.calls {
+			t.Errorf("%s: expected %d lookups, got %d", tt.name, tt.calls, calls)
+		}
+		if !tt.ok && !errors.Is(err, missing) {
+			t.Errorf("%s: expected the last lookup error, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestDebugFile(t *testing.T) {
+	savedLogger, savedFile, savedLevel, savedDebug := logger, debugFileFlag, logLevelFlag, debugFlag
+	defer func() {
+		logger, whichdns.Logger, debugFileFlag, logLevelFlag, debugFlag = savedLogger, savedLogger, savedFile, savedLevel, savedDebug
+	}()
+
+	path := filepath.Join(t.TempDir(), "debug.log")
+	debugFileFlag, logLevelFlag, debugFlag = path, "warn", false
+	for _, msg := range []string{"first run", "second run"} {
+		if err := setupLogging(); err != nil {
+			t.Fatalf("setupLogging failed: %v", err)
+		}
+		if verbose {
+			t.Error("Expected the terminal to stay at warn level")
+		}
+		debugLog("%s", msg)
+		if err := closeDebugFile(); err != nil {
+			t.Fatalf("closeDebugFile failed: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
 	if err != nil {
-		t.Fatalf("Error finding default network interface: %v", err)
+		t.Fatalf("Failed to read the debug file: %v", err)
 	}
-	if iface == nil {
-		t.Fatal("Expected a valid network interface, got nil")
+	if !strings.Contains(string(data), "first run") || !strings.Contains(string(data), "second run") {
+		t.Errorf("Expected both runs appended to the debug file, got %q", data)
 	}
-	// Check that the interface has a valid name
-	if iface.Name == "" {
-		t.Errorf("Expected a valid interface name, got an empty string")
+
+	debugFileFlag = filepath.Join(t.TempDir(), "missing", "debug.log")
+	if err := setupLogging(); err == nil {
+		t.Error("Expected a debug file in a missing directory to be rejected")
+	}
+}
+
+func TestProgressBarEdgeCases(t *testing.T) {
+	// A hidden bar is nil and every method must be a no-op
+	var hidden *ProgressBar
+	hidden.Render()
+	hidden.Advance()
+	hidden.AdvanceTo(5)
+	hidden.Clear()
+	if !hidden.Finished() {
+		t.Error("Expected a nil bar to count as finished")
+	}
+
+	// An empty bar renders as complete instead of dividing by zero
+	empty := NewProgressBar(0, 10)
+	empty.Render()
+	if !empty.Finished() {
+		t.Error("Expected an empty bar to be finished")
+	}
+
+	bar := NewProgressBar(3, 10)
+	bar.AdvanceTo(10)
+	if bar.current != 3 {
+		t.Errorf("Expected AdvanceTo to stop at the total, got %d", bar.current)
+	}
+}
+
+func TestRegisterDomainStepsProbes(t *testing.T) {
+	saved := probesFlag
+	defer func() { probesFlag = saved }()
+
+	probesFlag = 1
+	few := newStepTracker()
+	registerDomainSteps(few, 0)
+	probesFlag = 50
+	many := newStepTracker()
+	registerDomainSteps(many, 0)
+	if few.Total() != many.Total() {
+		t.Errorf("Expected --probes to leave the steps alone, got %d and %d units", few.Total(), many.Total())
+	}
+	if lookupCount() != 50 {
+		t.Errorf("Expected --probes to set the lookup count, got %d", lookupCount())
+	}
+}
+
+func TestStepTracker(t *testing.T) {
+	steps := newStepTracker()
+	steps.Register("setup", 1)
+	steps.Register("lookup", 3)
+	steps.Register("wait", 5)
+	if steps.Total() != 9 {
+		t.Fatalf("Expected a total of 9 units, got %d", steps.Total())
+	}
+
+	steps.Advance("lookup") // Skips the unfinished setup step
+	if steps.completed != 2 {
+		t.Errorf("Expected 2 units after the first lookup, got %d", steps.completed)
+	}
+	for i := 0; i < 5; i++ {
+		steps.Advance("lookup")
+	}
+	if steps.completed != 4 {
+		t.Errorf("Expected lookups to stop at the end of their step, got %d", steps.completed)
+	}
+	steps.Done("wait")
+	steps.Done("setup") // Never moves back
+	if steps.completed != steps.Total() {
+		t.Errorf("Expected all %d units done, got %d", steps.Total(), steps.completed)
+	}
+
+	steps.Rewind("lookup") // Another attempt starts over from the lookups
+	if steps.completed != 1 {
+		t.Errorf("Expected a rewind to the start of the lookups, got %d", steps.completed)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("%w after 10s", whichdns.ErrTimeout), true},
+		{fmt.Errorf("%w: no such host", whichdns.ErrLookup), true},
+		{fmt.Errorf("%w: 192.168.1.1 port 53 refused the query", whichdns.ErrUnreachable), false},
+		{fmt.Errorf("%w: permission denied", whichdns.ErrCaptureOpen), true},
+		{whichdns.ErrResolvedLocally, false},
+		{context.Canceled, false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+	if isTerminal(file) {
+		t.Error("Expected a regular file not to be a terminal")
 	}
 }
 
 func TestGetDefaultNetworkInterface(t *testing.T) {
-	iface := getDefaultNetworkInterface(true, nil)
+	iface := getDefaultNetworkInterface(true)
 	if iface == nil {
 		t.Fatalf("Expected a network interface, got nil")
 	}
@@ -65,3 +537,240 @@ func TestIsRootManual(t *testing.T) {
 		t.Log("Test is running as a non-root user")
 	}
 }
+
+func TestBuildVersionInfo(t *testing.T) {
+	savedCommit, savedDate := commit, buildDate
+	defer func() { commit, buildDate = savedCommit, savedDate }()
+
+	commit, buildDate = "abc123", "2026-01-02T03:04:05Z"
+	info := buildVersionInfo()
+	if info.Version != appversion {
+		t.Errorf("Expected version %s, got %s", appversion, info.Version)
+	}
+	if info.Commit != commit || info.BuildDate != buildDate {
+		t.Errorf("Expected the link-time commit and date to win, got %q and %q", info.Commit, info.BuildDate)
+	}
+	if info.GoVersion == "" || info.Platform == "" || info.Capture == "" {
+		t.Errorf("Expected Go version, platform and capture to be set, got %+v", info)
+	}
+}
+
+func TestParseResolver(t *testing.T) {
+	tests := []struct {
+		in   string
+		ip   string
+		port int
+		ok   bool
+	}{
+		{"8.8.8.8", "8.8.8.8", 0, true},
+		{"8.8.8.8:5353", "8.8.8.8", 5353, true},
+		{"2001:4860:4860::8888", "2001:4860:4860::8888", 0, true},
+		{"[2001:4860:4860::8888]:53", "2001:4860:4860::8888", 53, true},
+		{"dns.google", "", 0, false},
+		{"8.8.8.8:0", "", 0, false},
+		{"8.8.8.8:dns", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, tt := range tests {
+		ip, port, err := parseResolver(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseResolver(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && (ip.String() != tt.ip || port != tt.port) {
+			t.Errorf("parseResolver(%q) = %v, %d, want %s, %d", tt.in, ip, port, tt.ip, tt.port)
+		}
+	}
+}
+
+func TestFormatL2(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	tests := []struct {
+		result whichdns.Result
+		want   string
+	}{
+		{whichdns.Result{Server: net.ParseIP("127.0.0.53")}, "no link-layer address"},
+		{whichdns.Result{Server: net.ParseIP("192.168.1.53"), MAC: mac, NextHop: net.ParseIP("192.168.1.53")}, "MAC 52:54:00:12:34:56, the server itself on the local segment"},
+		{whichdns.Result{Server: net.ParseIP("1.1.1.1"), MAC: mac, NextHop: net.ParseIP("192.168.1.1")}, "MAC 52:54:00:12:34:56 via 192.168.1.1"},
+		{whichdns.Result{Server: net.ParseIP("1.1.1.1"), MAC: mac}, "MAC 52:54:00:12:34:56"},
+	}
+	for _, tt := range tests {
+		if got := formatL2(tt.result); got != tt.want {
+			t.Errorf("formatL2(%v) = %q, want %q", tt.result.Server, got, tt.want)
+		}
+	}
+}
+
+func TestResolvConfOverride(t *testing.T) {
+	t.Setenv(resolvConfEnv, "")
+	if got := defaultResolvConf(); got != whichdns.DefaultResolvConf {
+		t.Errorf("Expected %s by default, got %s", whichdns.DefaultResolvConf, got)
+	}
+	t.Setenv(resolvConfEnv, "/srv/chroot/etc/resolv.conf")
+	if got := defaultResolvConf(); got != "/srv/chroot/etc/resolv.conf" {
+		t.Errorf("Expected $%s to set the default, got %s", resolvConfEnv, got)
+	}
+
+	saved := resolvConfFlag
+	defer func() { resolvConfFlag = saved }()
+	resolvConfFlag = t.TempDir() + "/resolv.conf"
+	if err := os.WriteFile(resolvConfFlag, []byte("nameserver 192.0.2.53\nnameserver 192.0.2.54\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configured, unexpected := compareWithConfigured([]string{"192.0.2.54", "198.51.100.1"})
+	if len(configured) != 2 || configured[0] != "192.0.2.53" {
+		t.Errorf("Expected the fixture's nameservers, got %v", configured)
+	}
+	if len(unexpected) != 1 || unexpected[0] != "198.51.100.1" {
+		t.Errorf("Expected only 198.51.100.1 to be unexpected, got %v", unexpected)
+	}
+}
+
+func TestIPScope(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1":        "private",
+		"172.16.5.4":      "private",
+		"192.168.1.1":     "private",
+		"100.100.100.100": "private",
+		"fd00::53":        "private",
+		"127.0.0.53":      "loopback",
+		"::1":             "loopback",
+		"169.254.1.1":     "link-local",
+		"fe80::1":         "link-local",
+		"1.1.1.1":         "public",
+		"2606:4700::1111": "public",
+		"not-an-ip":       "",
+	}
+	for ip, want := range tests {
+		if got := ipScope(ip); got != want {
+			t.Errorf("ipScope(%q) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestAmbiguousInterfaceMessage(t *testing.T) {
+	if got := ambiguousInterfaceMessage([]string{"eth0"}, "eth0"); got != "" {
+		t.Errorf("Expected no message for a single candidate, got %q", got)
+	}
+	want := "Multiple candidate interfaces found: eth0, wlan0; using wlan0 - specify --interface to override."
+	if got := ambiguousInterfaceMessage([]string{"eth0", "wlan0"}, "wlan0"); got != want {
+		t.Errorf("ambiguousInterfaceMessage = %q, want %q", got, want)
+	}
+}
+
+func TestDetectOptionsLoopback(t *testing.T) {
+	saved := loopbackFlag
+	defer func() { loopbackFlag = saved }()
+
+	lo := &net.Interface{Index: 1, Name: "lo", Flags: net.FlagUp | net.FlagLoopback}
+	loopbackFlag = true
+	if opts := detectOptions("example.com", lo); !opts.Loopback || opts.Interface != "" {
+		t.Errorf("Expected --loopback to set Loopback without an Interface, got %q, %v", opts.Interface, opts.Loopback)
+	}
+	loopbackFlag = false
+	if opts := detectOptions("example.com", lo); opts.Loopback || opts.Interface != "lo" {
+		t.Errorf("Expected the interface by name without --loopback, got %q, %v", opts.Interface, opts.Loopback)
+	}
+}
+
+func TestLoopbackCapture(t *testing.T) {
+	saved, savedResolver, savedIface, savedSrc := loopbackFlag, resolverFlag, interfaceFlag, srcFlag
+	defer func() {
+		loopbackFlag, resolverFlag, interfaceFlag, srcFlag = saved, savedResolver, savedIface, savedSrc
+	}()
+
+	tests := []struct {
+		loopback bool
+		resolver string
+		iface    string
+		src      string
+		want     bool
+	}{
+		{false, "", "", "", false},
+		{true, "", "", "", true},
+		{false, "127.0.0.1", "", "", true},
+		{false, "[::1]:5353", "", "", true},
+		{false, "192.168.1.1", "", "", false},
+		{false, "127.0.0.1", "eth0", "", false},
+		{false, "127.0.0.1", "", "192.168.1.10", false},
+	}
+	for _, tt := range tests {
+		loopbackFlag, resolverFlag, interfaceFlag, srcFlag = tt.loopback, tt.resolver, tt.iface, tt.src
+		if got := loopbackCapture(); got != tt.want {
+			t.Errorf("loopbackCapture() with %+v = %v, want %v", tt, got, tt.want)
+		}
+	}
+}
+
+func TestFormatTTL(t *testing.T) {
+	tests := []struct {
+		ttl  int
+		want string
+	}{
+		{64, "TTL 64, ~0 hops"},
+		{57, "TTL 57, ~7 hops"},
+		{63, "TTL 63, ~1 hop"},
+		{117, "TTL 117, ~11 hops"},
+		{250, "TTL 250, ~5 hops"},
+	}
+	for _, tt := range tests {
+		if got := formatTTL(tt.ttl); got != tt.want {
+			t.Errorf("formatTTL(%d) = %q, want %q", tt.ttl, got, tt.want)
+		}
+	}
+
+	saved := maskFlag
+	defer func() { maskFlag = saved }()
+	maskFlag = false
+	counts := map[string]map[int]int{"8.8.8.8": {117: 3, 120: 1}, "1.1.1.1": {57: 2}}
+	got := formatTTLCounts([]string{"1.1.1.1", "8.8.8.8"}, counts)
+	if want := "1.1.1.1: 57 (2); 8.8.8.8: 117 (3), 120 (1) - several nodes?"; got != want {
+		t.Errorf("formatTTLCounts = %q, want %q", got, want)
+	}
+}
+
+func TestFormatAnswerConflicts(t *testing.T) {
+	saved := maskFlag
+	defer func() { maskFlag = saved }()
+
+	conflicts := [][2]net.IP{{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}}
+	sets := map[string]map[string][]string{
+		"10.0.0.1": {"A": {"A 192.0.2.1", "A 192.0.2.2"}, "AAAA": {}},
+		"10.0.0.2": {"A": {}},
+	}
+	maskFlag = false
+	want := "example.com: Warning: answer inconsistency detected between 10.0.0.1 and 10.0.0.2\n  10.0.0.1: A query: A 192.0.2.1, A 192.0.2.2; AAAA query: none\n  10.0.0.2: A query: none"
+	if got := formatAnswerConflicts("example.com: ", conflicts, sets); got != want {
+		t.Errorf("formatAnswerConflicts = %q, want %q", got, want)
+	}
+
+	maskFlag = true
+	conflicts = [][2]net.IP{{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.2.1")}}
+	sets = map[string]map[string][]string{
+		"10.0.1.1": {"A": {"A 192.0.2.1", "A 192.0.2.2"}},
+		"10.0.2.1": {"A": {"CNAME www.example.com"}},
+	}
+	want = "Warning: answer inconsistency detected between 10.0.1.0 and 10.0.2.0\n  10.0.1.0: A query: A 192.0.2.0\n  10.0.2.0: A query: CNAME www.example.com"
+	if got := formatAnswerConflicts("", conflicts, sets); got != want {
+		t.Errorf("formatAnswerConflicts with --mask = %q, want %q", got, want)
+	}
+}
+
+func TestFormatAnswer(t *testing.T) {
+	saved := maskFlag
+	defer func() { maskFlag = saved }()
+
+	answer := whichdns.Answer{Name: "example.com", Type: "A", TTL: 300, Value: "93.184.216.34"}
+	maskFlag = false
+	if got := formatAnswer(answer); got != "example.com 300 A 93.184.216.34" {
+		t.Errorf("Unexpected answer %q", got)
+	}
+	maskFlag = true
+	if got := formatAnswer(answer); got != "example.com 300 A 93.184.216.0" {
+		t.Errorf("Expected the address to be masked, got %q", got)
+	}
+	answer = whichdns.Answer{Name: "example.com", Type: "MX", TTL: 60, Value: "10 mail.example.com"}
+	if got := formatAnswer(answer); got != "example.com 60 MX 10 mail.example.com" {
+		t.Errorf("Expected a non-address value unchanged, got %q", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"whichdns/whichdns"
+)
+
+// watchMetrics holds the latest watch results in the form served to Prometheus
+type watchMetrics struct {
+	mu       sync.Mutex
+	latency  map[string]float64 // Seconds until the last response, per domain
+	timeouts map[string]int     // Cycles without a response, per domain
+	servers  map[string]string  // Last responding server, per domain
+}
+
+// newWatchMetrics creates an empty metrics set
+func newWatchMetrics() *watchMetrics {
+	return &watchMetrics{
+		latency:  make(map[string]float64),
+		timeouts: make(map[string]int),
+		servers:  make(map[string]string),
+	}
+}
+
+// record updates the metrics with the outcome of one detection for domain
+func (m *watchMetrics) record(domain string, result whichdns.Result, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch {
+	case err == nil:
+		m.latency[domain] = result.Elapsed.Seconds()
+		m.servers[domain] = maskIP(result.Server.String())
+	case errors.Is(err, whichdns.ErrTimeout):
+		m.timeouts[domain]++
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *watchMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP whichdns_response_seconds Time from the first lookup to the DNS response in the last cycle.\n")
+	b.WriteString("# TYPE whichdns_response_seconds gauge\n")
+	for _, domain := range sortedKeys(m.latency) {
+		fmt.Fprintf(&b, "whichdns_response_seconds{domain=%q} %g\n", domain, m.latency[domain])
+	}
+	b.WriteString("# HELP whichdns_timeouts_total Cycles in which no DNS response was captured before the timeout.\n")
+	b.WriteString("# TYPE whichdns_timeouts_total counter\n")
+	for _, domain := range domainFlag {
+		fmt.Fprintf(&b, "whichdns_timeouts_total{domain=%q} %d\n", domain, m.timeouts[domain])
+	}
+	b.WriteString("# HELP whichdns_server_info The DNS server that answered in the last successful cycle.\n")
+	b.WriteString("# TYPE whichdns_server_info gauge\n")
+	for _, domain := range sortedKeys(m.servers) {
+		fmt.Fprintf(&b, "whichdns_server_info{domain=%q,server=%q} 1\n", domain, m.servers[domain])
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// serveMetrics starts an HTTP server exposing m on addr under /metrics
+func serveMetrics(addr string, m *watchMetrics) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	// Bind synchronously so a busy port is reported before the watch starts
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(fmt.Sprintf("Metrics server stopped: %v", err))
+		}
+	}()
+	infoLog("Serving Prometheus metrics on http://%s/metrics", listener.Addr())
+	return nil
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
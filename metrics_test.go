@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"whichdns/whichdns"
+)
+
+func TestWatchMetrics(t *testing.T) {
+	saved := domainFlag
+	defer func() { domainFlag = saved }()
+	domainFlag = []string{"example.com"}
+
+	metrics := newWatchMetrics()
+	metrics.record("example.com", whichdns.Result{Server: net.ParseIP("192.168.1.1"), Elapsed: 25 * time.Millisecond}, nil)
+	metrics.record("example.com", whichdns.Result{}, fmt.Errorf("%w after 10s", whichdns.ErrTimeout))
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE whichdns_response_seconds gauge\n",
+		`whichdns_response_seconds{domain="example.com"} 0.025` + "\n",
+		`whichdns_timeouts_total{domain="example.com"} 1` + "\n",
+		`whichdns_server_info{domain="example.com",server="192.168.1.1"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+)
+
+// resultWriter records the first write error, since the result lines are
+// printed with fmt functions whose errors are otherwise dropped
+type resultWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (r *resultWriter) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+var (
+	// stdout receives the results: standard output, or the --output file
+	stdout = &resultWriter{w: os.Stdout}
+	// outputFile is the open --output file, nil when writing to standard output
+	outputFile *os.File
+)
+
+// openOutput redirects the results to the --output file, creating or
+// truncating it; "-" and the empty path keep standard output
+func openOutput(path string) error {
+	if path == "" || path == "-" {
+		return nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	outputFile = file
+	stdout = &resultWriter{w: file}
+	return nil
+}
+
+// closeOutput flushes and closes the --output file, returning the first error
+// writing, syncing or closing it so a full disk cannot lose the result silently
+func closeOutput() error {
+	if outputFile == nil {
+		return nil
+	}
+	err := stdout.err
+	if syncErr := outputFile.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := outputFile.Close(); err == nil {
+		err = closeErr
+	}
+	outputFile = nil
+	if err != nil {
+		return fmt.Errorf("failed to write output file %s: %w", outputFlag, err)
+	}
+	return nil
+}
+
+// exit closes the --output and --debug-file files and exits with code, or
+// with exitCantCreate if the result could not be written
+func exit(code int) {
+	if err := closeOutput(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if code == exitOK || code == exitMismatch {
+			code = exitCantCreate
+		}
+	}
+	if err := closeDebugFile(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(code)
+}
+
+// maskIP hides the host part of an address for --mask: the last octet of an
+// IPv4 address or the last 80 bits of an IPv6 one. Without --mask, or for
+// anything but an IP address, s is returned unchanged.
+func maskIP(s string) string {
+	ip := net.ParseIP(s)
+	if !maskFlag || ip == nil {
+		return s
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// maskMAC formats a MAC address, hiding the device part (the last three
+// octets) with --mask so only the vendor prefix remains; nil gives ""
+func maskMAC(mac net.HardwareAddr) string {
+	if mac == nil {
+		return ""
+	}
+	if maskFlag && len(mac) == 6 {
+		mac = append(net.HardwareAddr{}, mac[:3]...)
+		mac = append(mac, 0, 0, 0)
+	}
+	return mac.String()
+}
+
+// maskIPs applies maskIP to each address, dropping the duplicates that masking
+// creates so a /24 with two servers is listed once
+func maskIPs(ips []string) []string {
+	var masked []string
+	for _, ip := range ips {
+		if m := maskIP(ip); !slices.Contains(masked, m) {
+			masked = append(masked, m)
+		}
+	}
+	return masked
+}
+
+// maskCounts applies maskIP to the keys of a response tally, adding up the
+// counts of servers that mask to the same address
+func maskCounts(counts map[string]int) map[string]int {
+	if counts == nil {
+		return nil
+	}
+	masked := make(map[string]int, len(counts))
+	for ip, n := range counts {
+		masked[maskIP(ip)] += n
+	}
+	return masked
+}
+
+// maskTTLCounts applies maskIP to the servers of --all TTL counts, adding up
+// the counts of servers that mask to the same address
+func maskTTLCounts(counts map[string]map[int]int) map[string]map[int]int {
+	if counts == nil {
+		return nil
+	}
+	masked := make(map[string]map[int]int, len(counts))
+	for ip, ttls := range counts {
+		key := maskIP(ip)
+		if masked[key] == nil {
+			masked[key] = make(map[int]int, len(ttls))
+		}
+		for ttl, n := range ttls {
+			masked[key][ttl] += n
+		}
+	}
+	return masked
+}
+
+// maskAnswerSets applies maskIP to the servers of --all answer sets and to the
+// addresses they returned, merging the sets of servers that mask to the same
+// address
+func maskAnswerSets(sets map[string]map[string][]string) map[string]map[string][]string {
+	if sets == nil {
+		return nil
+	}
+	masked := make(map[string]map[string][]string, len(sets))
+	for ip, types := range sets {
+		key := maskIP(ip)
+		if masked[key] == nil {
+			masked[key] = make(map[string][]string, len(types))
+		}
+		for qtype, records := range types {
+			set := masked[key][qtype]
+			if set == nil {
+				set = []string{}
+			}
+			for _, record := range records {
+				if rrType, value, ok := strings.Cut(record, " "); ok {
+					record = rrType + " " + maskIP(value)
+				}
+				if !slices.Contains(set, record) {
+					set = append(set, record)
+				}
+			}
+			slices.Sort(set)
+			masked[key][qtype] = set
+		}
+	}
+	return masked
+}
+
+// maskKeys applies maskIP to the keys of a per-server map; of servers that
+// mask to the same address, an arbitrary one's value is kept
+func maskKeys(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	masked := make(map[string]string, len(m))
+	for ip, v := range m {
+		masked[maskIP(ip)] = v
+	}
+	return masked
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failingWriter fails every write, like a file on a full disk
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("no space left on device") }
+
+func TestOutputFile(t *testing.T) {
+	saved := stdout
+	defer func() { stdout = saved }()
+
+	path := filepath.Join(t.TempDir(), "result.txt")
+	if err := openOutput(path); err != nil {
+		t.Fatalf("Failed to open output: %v", err)
+	}
+	fmt.Fprintln(stdout, "192.168.1.1")
+	if err := closeOutput(); err != nil {
+		t.Fatalf("Failed to close output: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if string(data) != "192.168.1.1\n" {
+		t.Errorf("Expected the result in the file, got %q", data)
+	}
+
+	// A failed write is reported when the file is closed
+	if err := openOutput(path); err != nil {
+		t.Fatalf("Failed to open output: %v", err)
+	}
+	stdout.w = failingWriter{}
+	fmt.Fprintln(stdout, "192.168.1.1")
+	if err := closeOutput(); err == nil {
+		t.Error("Expected the failed write to be reported")
+	}
+}
+
+func TestMaskIP(t *testing.T) {
+	saved := maskFlag
+	defer func() { maskFlag = saved }()
+
+	maskFlag = false
+	if got := maskIP("192.168.1.53"); got != "192.168.1.53" {
+		t.Errorf("Expected no masking without --mask, got %s", got)
+	}
+
+	maskFlag = true
+	tests := map[string]string{
+		"192.168.1.53":           "192.168.1.0",
+		"2001:db8:1234:5678::53": "2001:db8:1234::",
+		"not an ip":              "not an ip",
+	}
+	for ip, want := range tests {
+		if got := maskIP(ip); got != want {
+			t.Errorf("maskIP(%q) = %q, want %q", ip, got, want)
+		}
+	}
+
+	if got := maskIPs([]string{"10.0.0.1", "10.0.0.2", "10.0.1.1"}); len(got) != 2 {
+		t.Errorf("Expected servers in one /24 to be listed once, got %v", got)
+	}
+	if got := maskCounts(map[string]int{"10.0.0.1": 2, "10.0.0.2": 3}); got["10.0.0.0"] != 5 {
+		t.Errorf("Expected the counts of masked servers to add up, got %v", got)
+	}
+}
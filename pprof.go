@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// servePprof serves the net/http/pprof profiles on addr under /debug/pprof/,
+// e.g. to profile the packet processing of a long --watch or --all run. The
+// endpoint is unauthenticated and exposes the process's memory and stacks,
+// so it belongs on a loopback address.
+func servePprof(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	// Bind synchronously so a busy port is reported before capturing
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	if host, _, err := net.SplitHostPort(listener.Addr().String()); err == nil && !net.ParseIP(host).IsLoopback() {
+		warnLog("Serving profiles on %s, reachable from other hosts; bind --pprof to 127.0.0.1 unless that is intended.", listener.Addr())
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(fmt.Sprintf("Profiling server stopped: %v", err))
+		}
+	}()
+	infoLog("Serving profiles on http://%s/debug/pprof/", listener.Addr())
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServePprofBusyPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	if err := servePprof(listener.Addr().String()); err == nil {
+		t.Error("Expected a busy --pprof address to be reported")
+	}
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// isRoot checks if the current user is root
+func isRoot() bool {
+	debugLog("Checking if the current user is root.")
+	currentUser, err := user.Current()
+	if err != nil {
+		log.Printf("Failed to get current user: %v", err)
+		exit(exitFailure)
+	}
+	debugLog("Current user UID: %s", currentUser.Uid)
+	return currentUser.Uid == "0"
+}
+
+// dropPrivileges switches to the user that invoked sudo, taken from SUDO_UID
+// and SUDO_GID. It does nothing when not running as root via sudo.
+func dropPrivileges() error {
+	uid, gid, ok, err := sudoIDs()
+	if err != nil || !ok || os.Geteuid() != 0 {
+		return err
+	}
+
+	// Supplementary groups first, then the group, while we still may
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("failed to drop supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set group ID %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set user ID %d: %w", uid, err)
+	}
+	debugLog("Dropped privileges to UID %d, GID %d.", uid, gid)
+	return nil
+}
+
+// sudoIDs returns the invoking user's IDs from SUDO_UID and SUDO_GID, with ok
+// false when they are not set
+func sudoIDs() (int, int, bool, error) {
+	uidStr, gidStr := os.Getenv("SUDO_UID"), os.Getenv("SUDO_GID")
+	if uidStr == "" || gidStr == "" {
+		return 0, 0, false, nil
+	}
+	uid, err := strconv.Atoi(uidStr)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("invalid SUDO_UID %q", uidStr)
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("invalid SUDO_GID %q", gidStr)
+	}
+	return uid, gid, true, nil
+}
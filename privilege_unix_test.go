@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import "testing"
+
+func TestSudoIDs(t *testing.T) {
+	t.Setenv("SUDO_UID", "")
+	t.Setenv("SUDO_GID", "")
+	if _, _, ok, err := sudoIDs(); ok || err != nil {
+		t.Errorf("Expected no sudo user, got ok=%v err=%v", ok, err)
+	}
+
+	t.Setenv("SUDO_UID", "1000")
+	t.Setenv("SUDO_GID", "100")
+	uid, gid, ok, err := sudoIDs()
+	if !ok || err != nil || uid != 1000 || gid != 100 {
+		t.Errorf("Expected 1000/100, got %d/%d ok=%v err=%v", uid, gid, ok, err)
+	}
+
+	t.Setenv("SUDO_UID", "root")
+	if _, _, _, err := sudoIDs(); err == nil {
+		t.Error("Expected an invalid SUDO_UID to be rejected")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+// isRoot always reports false on Windows: live capture is Linux-only, so no
+// run needs administrator rights and there is no elevation to check for
+func isRoot() bool {
+	return false
+}
+
+// dropPrivileges does nothing on Windows, where there is no sudo user to return to
+func dropPrivileges() error {
+	return nil
+}
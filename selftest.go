@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"whichdns/whichdns"
+)
+
+// Public resolvers --selftest sends its lookup to: Cloudflare's, reachable
+// from most networks and independent of the host's DNS configuration
+var (
+	selftestResolver  = net.IPv4(1, 1, 1, 1)
+	selftestResolver6 = net.ParseIP("2606:4700:4700::1111")
+)
+
+// jsonSelftest is the object printed in JSON mode with --selftest
+type jsonSelftest struct {
+	OK        bool   `json:"ok"`
+	Resolver  string `json:"resolver"`
+	DNSServer string `json:"dns_server,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	ElapsedMS int64  `json:"elapsed_ms,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	elapsed time.Duration
+}
+
+// runSelftest looks up the domain straight at a known public resolver and
+// checks that the capture sees the response come from that address, which
+// exercises capture, filtering, decoding and matching end to end whatever the
+// host's resolv.conf says. It prints PASS or FAIL and exits 0 on a pass, 3
+// when another server answered (the traffic is redirected), or with the code
+// of the failure.
+func runSelftest(ctx context.Context) {
+	resolver := selftestResolver
+	if ipv6Flag {
+		resolver = selftestResolver6
+	}
+	out := jsonSelftest{Resolver: resolver.String()}
+	code, err := selftest(ctx, resolver, &out)
+	if err != nil {
+		out.Error = err.Error()
+	}
+	out.OK = code == exitOK
+	debugLog("Self-test against %v: %+v", resolver, out)
+
+	switch {
+	case jsonFlag:
+		printJSON(out)
+	case quietFlag:
+	case out.OK:
+		fmt.Fprintf(stdout, "%s: response from %s captured on %s in %v\n", colorize("PASS", colorGreen, colorStdout), out.DNSServer, out.Interface, out.elapsed.Round(10*time.Microsecond))
+	default:
+		fmt.Fprintf(stdout, "%s: %s\n", colorize("FAIL", colorRed, colorStdout), out.Error)
+	}
+	exit(code)
+}
+
+// selftest runs the --selftest detection against resolver, filling in out,
+// and returns the exit code and the reason for a failure
+func selftest(ctx context.Context, resolver net.IP, out *jsonSelftest) (int, error) {
+	if !isRoot() && !hasCaptureCapability() {
+		return exitNoPrivilege, errors.New("root privileges or CAP_NET_RAW are required to capture")
+	}
+	if interfaceFlag != "" && !allIfacesFlag {
+		if _, err := whichdns.InterfaceByName(interfaceFlag, ipv6Flag); err != nil {
+			return exitUnavailable, err
+		}
+	}
+	opts := whichdns.Options{
+		Domain:        domainFlag[0],
+		Interface:     interfaceFlag,
+		AllInterfaces: allIfacesFlag,
+		Resolver:      resolver,
+		Type:          "A",
+		Count:         1,
+		Timeout:       timeoutFlag,
+		IPv6:          ipv6Flag,
+		Family:        familyFlag,
+		Retries:       retriesFlag,
+	}
+	if ipv6Flag {
+		opts.Type = "AAAA"
+	}
+	result, err := whichdns.Detect(ctx, opts)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted, errors.New("interrupted")
+	case errors.Is(err, whichdns.ErrNoInterface):
+		return exitNoInterface, err
+	case errors.Is(err, whichdns.ErrCaptureOpen):
+		return exitUnavailable, err
+	case errors.Is(err, whichdns.ErrUnreachable):
+		return exitLookup, err
+	case errors.Is(err, whichdns.ErrLookup):
+		return exitLookup, fmt.Errorf("%w; is outbound DNS to %v blocked?", err, resolver)
+	case errors.Is(err, whichdns.ErrTimeout), errors.Is(err, whichdns.ErrNoResponse):
+		return exitTimeout, fmt.Errorf("no response from %v was captured: %w", resolver, err)
+	case err != nil:
+		return exitCapture, err
+	}
+
+	out.DNSServer = maskIP(result.Server.String())
+	out.Interface = result.Interface
+	out.ElapsedMS = result.Elapsed.Milliseconds()
+	out.elapsed = result.Elapsed
+	if !result.Server.Equal(resolver) {
+		return exitMismatch, fmt.Errorf("the response came from %s instead of %v; DNS traffic is redirected", out.DNSServer, resolver)
+	}
+	return exitOK, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"whichdns/whichdns"
+)
+
+// setupCheck is one step validated by --check-setup. run returns a short
+// description of what was found; on failure the run exits with code.
+type setupCheck struct {
+	name string
+	code int
+	run  func() (string, error)
+}
+
+// jsonSetupCheck is the outcome of one step printed in JSON mode with --check-setup
+type jsonSetupCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// jsonSetup is the object printed in JSON mode with --check-setup
+type jsonSetup struct {
+	OK     bool             `json:"ok"`
+	Checks []jsonSetupCheck `json:"checks"`
+}
+
+// runSetupCheck validates that a detection could run on this host: the
+// privileges, the capture interface and opening the capture. No lookups are
+// made and nothing is waited for. It exits 0 if every step passes, or with the
+// code of the first failing one.
+func runSetupCheck(ctx context.Context) {
+	opts := whichdns.Options{
+		Interface:     interfaceFlag,
+		AllInterfaces: allIfacesFlag,
+		Loopback:      loopbackFlag,
+		Source:        net.ParseIP(srcFlag),
+		IPv6:          ipv6Flag,
+		Family:        familyFlag,
+		Filter:        filterFlag,
+		Retries:       retriesFlag,
+	}
+	checks := []setupCheck{
+		{"Privileges", exitNoPrivilege, func() (string, error) {
+			switch {
+			case isRoot():
+				return "running as root", nil
+			case hasCaptureCapability():
+				return "CAP_NET_RAW", nil
+			}
+			return "", errors.New("root privileges or CAP_NET_RAW are required")
+		}},
+		{"Interface", exitUnavailable, func() (string, error) {
+			names, err := whichdns.CaptureInterfaces(opts)
+			return strings.Join(names, ", "), err
+		}},
+		{"Capture", exitUnavailable, func() (string, error) {
+			return "AF_PACKET socket opened and closed", whichdns.CheckCapture(ctx, opts)
+		}},
+	}
+
+	exitCode := exitOK
+	out := jsonSetup{OK: true}
+	for _, check := range checks {
+		detail, err := check.run()
+		debugLog("Setup check %s: %q, error: %v", check.name, detail, err)
+		if err != nil && exitCode == exitOK {
+			exitCode = check.code
+			if errors.Is(err, whichdns.ErrNoInterface) {
+				exitCode = exitNoInterface
+			}
+		}
+
+		result := jsonSetupCheck{Name: check.name, OK: err == nil, Detail: detail}
+		if err != nil {
+			out.OK = false
+			result.Detail, result.Error = "", err.Error()
+		}
+		out.Checks = append(out.Checks, result)
+
+		if !jsonFlag && !quietFlag {
+			printSetupCheck(result)
+		}
+	}
+
+	if jsonFlag {
+		printJSON(out)
+	}
+	exit(exitCode)
+}
+
+// printSetupCheck prints one step with a status mark, coloured on a terminal
+func printSetupCheck(check jsonSetupCheck) {
+	mark, color, detail := "ok", colorGreen, check.Detail
+	if !check.OK {
+		mark, color, detail = "FAIL", colorRed, check.Error
+	}
+	mark = colorize(mark, color, colorStdout)
+	fmt.Fprintf(stdout, "[%s] %s: %s\n", mark, check.Name, detail)
+}
@@ -0,0 +1,22 @@
+package main
+
+import "fmt"
+
+// jsonSplitDNS is the object printed in JSON mode with --split-dns
+type jsonSplitDNS struct {
+	SplitDNS       bool          `json:"split_dns"`
+	InternalServer string        `json:"internal_server"`
+	PublicServer   string        `json:"public_server"`
+	Domains        []interface{} `json:"domains"`
+}
+
+// printSplitDNS prints the --split-dns verdict given the internal and public
+// domains and the server that answered each
+func printSplitDNS(domains, servers []string) {
+	if servers[0] != servers[1] {
+		fmt.Fprintln(stdout, green(fmt.Sprintf("Split DNS: in effect, %s is answered by %s and %s by %s",
+			domains[0], maskIP(servers[0]), domains[1], maskIP(servers[1]))))
+		return
+	}
+	fmt.Fprintln(stdout, green(fmt.Sprintf("Split DNS: not in effect, both domains are answered by %s", maskIP(servers[0]))))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"whichdns/whichdns"
+)
+
+// Setup steps, run once before any domain is checked
+const (
+	stepPrivileges = "privileges"
+	stepInterface  = "interface"
+)
+
+// step is a stage of the run taking up units of the progress bar
+type step struct {
+	start int // Units of the steps registered before this one
+	units int
+}
+
+// stepTracker drives the progress bar from named steps. Every stage is
+// registered up front, so the bar's total always matches the work that
+// follows; stages then report progress by name.
+type stepTracker struct {
+	mu        sync.Mutex
+	steps     map[string]*step
+	total     int
+	completed int
+	bar       *ProgressBar // nil while the bar is hidden
+}
+
+// newStepTracker creates a tracker with no steps
+func newStepTracker() *stepTracker {
+	return &stepTracker{steps: make(map[string]*step)}
+}
+
+// Register adds a step of the given number of units after the ones already registered
+func (t *stepTracker) Register(name string, units int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.steps[name]; ok {
+		panic(fmt.Sprintf("step %q registered twice", name))
+	}
+	t.steps[name] = &step{start: t.total, units: units}
+	t.total += units
+}
+
+// Total returns the number of units of all registered steps
+func (t *stepTracker) Total() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total
+}
+
+// Show creates the progress bar for the registered steps and draws it
+func (t *stepTracker) Show(barLength int, style barStyle) *ProgressBar {
+	t.bar = NewProgressBar(t.Total(), barLength)
+	t.bar.style = style
+	t.bar.Render()
+	return t.bar
+}
+
+// Advance moves one unit into the named step, never past its end; any
+// earlier steps left unfinished count as done
+func (t *stepTracker) Advance(name string) {
+	t.mu.Lock()
+	s := t.step(name)
+	t.completed = max(t.completed, s.start)
+	if t.completed < s.start+s.units {
+		t.completed++
+	}
+	completed := t.completed
+	t.mu.Unlock()
+	t.bar.AdvanceTo(completed)
+}
+
+// Done completes the named step, skipping any units it did not report
+func (t *stepTracker) Done(name string) {
+	t.mu.Lock()
+	s := t.step(name)
+	t.completed = max(t.completed, s.start+s.units)
+	completed := t.completed
+	t.mu.Unlock()
+	t.bar.AdvanceTo(completed)
+}
+
+// Rewind moves the progress back to the start of the named step, so it and
+// the steps after it can be run again
+func (t *stepTracker) Rewind(name string) {
+	t.mu.Lock()
+	s := t.step(name)
+	t.completed = min(t.completed, s.start)
+	completed := t.completed
+	t.mu.Unlock()
+	t.bar.Reset(completed)
+}
+
+// AdvanceEvery advances the named step once per interval until it is
+// complete or done is closed, e.g. to fill the bar while waiting
+func (t *stepTracker) AdvanceEvery(name string, interval time.Duration, done chan struct{}) {
+	t.mu.Lock()
+	units := t.step(name).units
+	t.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 0; i < units; i++ {
+		select {
+		case <-ticker.C:
+			t.Advance(name)
+		case <-done:
+			return
+		}
+	}
+}
+
+// step returns the named step, which must have been registered; the caller
+// must hold t.mu
+func (t *stepTracker) step(name string) *step {
+	s, ok := t.steps[name]
+	if !ok {
+		panic(fmt.Sprintf("step %q not registered", name))
+	}
+	return s
+}
+
+// domainStep names a library step for the i-th domain; the index keeps the
+// names unique when a domain is given twice
+func domainStep(i int, name string) string {
+	return fmt.Sprintf("domain %d: %s", i, name)
+}
+
+// registerDomainSteps registers the steps of the detection for the i-th
+// domain. The lookups are one unit however many are sent, so --probes does
+// not change the bar.
+func registerDomainSteps(t *stepTracker, i int) {
+	t.Register(domainStep(i, whichdns.StepOpenCapture), 1)
+	t.Register(domainStep(i, whichdns.StepFilter), 1)
+	t.Register(domainStep(i, whichdns.StepStartCapture), 1)
+	t.Register(domainStep(i, whichdns.StepLookup), 1)
+	t.Register(domainStep(i, whichdns.StepWait), waitSteps(timeoutFlag))
+}
+
+// forDomain returns the step callback for the i-th domain's detection. The
+// wait step fills one unit per second until waitDone is closed.
+func (t *stepTracker) forDomain(i int) func(step string, waitDone chan struct{}) {
+	return func(step string, waitDone chan struct{}) {
+		switch step {
+		case whichdns.StepWait:
+			go t.AdvanceEvery(domainStep(i, step), time.Second, waitDone)
+		default:
+			t.Done(domainStep(i, step))
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"whichdns/whichdns"
+)
+
+// printSummary prints the --summary report for a detection: the build, the
+// capture interface and its addresses, the configured and observed servers
+// and whether they agree, laid out for pasting into a bug report
+func printSummary(domain string, dnsIPs []string, result whichdns.Result) {
+	// Unlike --check, an unreadable resolv.conf is part of the report
+	var configured, unexpected []string
+	servers, err := whichdns.ConfiguredNameservers(resolvConfFlag)
+	for _, server := range servers {
+		configured = append(configured, server.String())
+	}
+	for _, ip := range dnsIPs {
+		if !slices.Contains(configured, ip) {
+			unexpected = append(unexpected, ip)
+		}
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	line := func(label, value string) {
+		if label != "" {
+			label += ":"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", label, value)
+	}
+
+	info := buildVersionInfo()
+	line("Version", fmt.Sprintf("%s (%s, %s)", info.Version, info.Platform, info.Capture))
+	line("Interface", summaryInterface(result))
+	switch {
+	case err != nil:
+		line("Configured servers", "unknown: "+err.Error())
+	case len(configured) == 0:
+		line("Configured servers", "none in "+resolvConfFlag)
+	default:
+		line("Configured servers", fmt.Sprintf("%s (%s)", strings.Join(maskIPs(configured), ", "), resolvConfFlag))
+	}
+	line("Domain", domain)
+	for i, dnsIP := range dnsIPs {
+		label := "Observed server"
+		if i > 0 {
+			label = ""
+		}
+		value := maskIP(dnsIP)
+		if name := lookupServerName(dnsIP); name != "" {
+			value += " (" + name + ")"
+		}
+		if allFlag && result.Counts != nil {
+			value += fmt.Sprintf(", %d responses", result.Counts[dnsIP])
+		}
+		line(label, value)
+	}
+	protocol := protocolLabels[result.Protocol]
+	if protocol == "" {
+		protocol = "plaintext DNS"
+	}
+	line("Protocol", protocol)
+	if result.SNI != "" {
+		line("TLS server name", result.SNI)
+	}
+	if result.Query != "" {
+		line("Query", result.Query)
+	}
+	line("Response time", result.Elapsed.Round(10*time.Microsecond).String())
+	if result.ServerPort != 0 {
+		ports := fmt.Sprintf("%d -> %d", result.ServerPort, result.ClientPort)
+		if portRewritten(result) {
+			ports += fmt.Sprintf(" (warning: not from port %d, NAT or a proxy rewrote the response)", portFlag)
+		}
+		line("Response ports", ports)
+	}
+
+	match := "yes"
+	switch {
+	case err != nil:
+		match = "unknown"
+	case len(unexpected) > 0:
+		match = "no, " + strings.Join(maskIPs(unexpected), ", ") + " is not configured"
+	}
+	line("Matches configuration", match)
+	w.Flush()
+}
+
+// summaryInterface describes the interface the response was captured on and
+// its addresses, e.g. "eth0 (192.168.1.10/24, fe80::1/64)"
+func summaryInterface(result whichdns.Result) string {
+	names := []string{result.Interface}
+	if allIfacesFlag {
+		names = names[:0]
+		for _, name := range result.Interfaces {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+	}
+
+	var parts []string
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			parts = append(parts, name)
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		var ips []string
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				ones, _ := ipnet.Mask.Size()
+				ips = append(ips, fmt.Sprintf("%s/%d", maskIP(ipnet.IP.String()), ones))
+			}
+		}
+		parts = append(parts, fmt.Sprintf("%s (%s)", name, strings.Join(ips, ", ")))
+	}
+	if len(parts) == 0 {
+		return "none (capture file)"
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// terminalWidth returns 0, meaning unknown: the console width is not queried
+// on Windows, so the bar keeps its requested width
+func terminalWidth(f *os.File) int {
+	return 0
+}
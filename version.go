@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"whichdns/whichdns"
+)
+
+// Build metadata, set at link time with e.g.
+// -ldflags "-X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)".
+// When unset they are taken from the VCS stamp Go embeds in the binary.
+var (
+	commit    string
+	buildDate string
+)
+
+// versionInfo is the build metadata printed by the version command, also its
+// JSON form with --json
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+	Capture   string `json:"capture"`
+}
+
+// buildVersionInfo gathers the version, preferring the link-time commit and
+// build date over the VCS stamp from debug.ReadBuildInfo
+func buildVersionInfo() versionInfo {
+	info := versionInfo{
+		Version:   appversion,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Capture:   whichdns.CaptureBackend,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// printVersion prints the build metadata, as a JSON object with --json
+func printVersion() {
+	info := buildVersionInfo()
+	if jsonFlag {
+		printJSON(info)
+		return
+	}
+
+	fmt.Fprintf(stdout, "Version: %s\n", info.Version)
+	if info.Commit != "" {
+		suffix := ""
+		if info.Modified {
+			suffix = " (modified)"
+		}
+		fmt.Fprintf(stdout, "Commit: %s%s\n", info.Commit, suffix)
+	}
+	if info.BuildDate != "" {
+		fmt.Fprintf(stdout, "Built: %s\n", info.BuildDate)
+	}
+	fmt.Fprintf(stdout, "Go: %s %s\n", info.GoVersion, info.Platform)
+	fmt.Fprintf(stdout, "Capture: %s\n", info.Capture)
+}
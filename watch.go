@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"whichdns/whichdns"
+)
+
+// watchTimeFormat is the timestamp printed at the start of each watch line
+const watchTimeFormat = "2006-01-02 15:04:05"
+
+// jsonWatchLine is the object printed for each domain and cycle in watch mode
+// with --json, one per line
+type jsonWatchLine struct {
+	Time       string            `json:"time"`
+	Domain     string            `json:"domain"`
+	DNSServer  string            `json:"dns_server,omitempty"`
+	DNSServers []string          `json:"dns_servers,omitempty"`
+	Interfaces map[string]string `json:"interfaces,omitempty"`
+	ElapsedMS  int64             `json:"elapsed_ms"`
+	Changed    bool              `json:"changed"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// runWatch repeats the detection for every domain each watchFlag interval
+// until ctx is cancelled, printing one timestamped line per domain and cycle
+// and flagging the lines where the responding server changed. Each result is
+// also recorded in metrics if it is not nil.
+func runWatch(ctx context.Context, iface *net.Interface, metrics *watchMetrics) {
+	if !ipOnlyFlag && !quietFlag && !jsonFlag {
+		name := "all interfaces"
+		if iface != nil {
+			name = iface.Name
+		}
+		fmt.Fprintf(stdout, "Watching DNS servers on %v every %v; press Ctrl-C to stop.\n", name, watchFlag)
+	}
+
+	previous := make(map[string]string)
+	for cycle := 1; ; cycle++ {
+		start := time.Now()
+		debugLog("Starting watch cycle %d.", cycle)
+		for _, domain := range domainFlag {
+			result, err := detectDomain(ctx, domain, iface, nil, false)
+			if ctx.Err() != nil {
+				break
+			}
+			watchLine(start, domain, result, err, previous)
+			if metrics != nil {
+				metrics.record(domain, result, err)
+			}
+		}
+
+		// Wait out the rest of the interval; a slow cycle starts the next one at once
+		select {
+		case <-ctx.Done():
+			infoLog("Watch stopped after %d cycles.", cycle)
+			return
+		case <-time.After(time.Until(start.Add(watchFlag))):
+		}
+	}
+}
+
+// watchLine prints the outcome of one detection in watch mode and records the
+// server seen for domain in previous. With --once-per-server an unchanged
+// server is not printed again.
+func watchLine(at time.Time, domain string, result whichdns.Result, err error, previous map[string]string) {
+	stamp := at.Format(watchTimeFormat)
+	label := ""
+	if len(domainFlag) > 1 {
+		label = domain + " "
+	}
+
+	if err != nil {
+		if errors.Is(err, whichdns.ErrTimeout) {
+			err = errors.New("no DNS response")
+		}
+		if jsonFlag {
+			printJSON(jsonWatchLine{Time: at.Format(time.RFC3339), Domain: domain, Error: err.Error()})
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s %s%v\n", stamp, label, err)
+		return
+	}
+
+	ips := []string{result.Server.String()}
+	if allFlag {
+		ips = ips[:0]
+		for _, server := range result.Servers {
+			ips = append(ips, server.String())
+		}
+	}
+	servers := make([]string, len(ips))
+	for i, ip := range ips {
+		servers[i] = maskIP(ip)
+		if allIfacesFlag {
+			servers[i] += " via " + result.Interfaces[ip]
+		}
+	}
+	current := strings.Join(servers, ", ")
+	last, seen := previous[domain]
+	previous[domain] = current
+	changed := seen && last != current
+
+	switch {
+	case (quietFlag || oncePerServerFlag && seen) && !changed:
+		debugLog("Watch: %s unchanged at %s.", domain, current)
+	case jsonFlag:
+		line := jsonWatchLine{
+			Time:      at.Format(time.RFC3339),
+			Domain:    domain,
+			DNSServer: maskIP(result.Server.String()),
+			ElapsedMS: result.Elapsed.Milliseconds(),
+			Changed:   changed,
+		}
+		if allFlag {
+			line.DNSServers = maskIPs(ips)
+		}
+		if allIfacesFlag {
+			line.Interfaces = maskKeys(result.Interfaces)
+		}
+		printJSON(line)
+	case ipOnlyFlag:
+		fmt.Fprintln(stdout, current)
+	case changed:
+		fmt.Fprintf(stdout, "%s %s%s (responded in %v) ** changed from %s **\n", stamp, label, current, result.Elapsed.Round(10*time.Microsecond), last)
+	default:
+		fmt.Fprintf(stdout, "%s %s%s (responded in %v)\n", stamp, label, current, result.Elapsed.Round(10*time.Microsecond))
+	}
+}
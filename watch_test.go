@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"whichdns/whichdns"
+)
+
+func TestWatchLineOncePerServer(t *testing.T) {
+	savedStdout, savedOnce := stdout, oncePerServerFlag
+	defer func() { stdout, oncePerServerFlag = savedStdout, savedOnce }()
+	var buf bytes.Buffer
+	stdout = &resultWriter{w: &buf}
+	oncePerServerFlag = true
+
+	previous := make(map[string]string)
+	for _, server := range []string{"192.168.1.1", "192.168.1.1", "10.8.0.1", "10.8.0.1"} {
+		result := whichdns.Result{Server: net.ParseIP(server)}
+		watchLine(time.Now(), "example.com", result, nil, previous)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected the first server and the change only, got %q", lines)
+	}
+	if !strings.Contains(lines[1], "10.8.0.1") || !strings.Contains(lines[1], "changed from 192.168.1.1") {
+		t.Errorf("Expected the change to be marked, got %q", lines[1])
+	}
+}
+
+func TestWatchLineJSON(t *testing.T) {
+	savedStdout, savedJSON := stdout, jsonFlag
+	defer func() { stdout, jsonFlag = savedStdout, savedJSON }()
+	var buf bytes.Buffer
+	stdout = &resultWriter{w: &buf}
+	jsonFlag = true
+
+	previous := make(map[string]string)
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, server := range []string{"192.168.1.1", "10.8.0.1"} {
+		result := whichdns.Result{Server: net.ParseIP(server), Elapsed: 12 * time.Millisecond}
+		watchLine(at, "example.com", result, nil, previous)
+	}
+	watchLine(at, "example.com", whichdns.Result{}, whichdns.ErrTimeout, previous)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{
+		`{"time":"2024-05-01T12:00:00Z","domain":"example.com","dns_server":"192.168.1.1","elapsed_ms":12,"changed":false}`,
+		`{"time":"2024-05-01T12:00:00Z","domain":"example.com","dns_server":"10.8.0.1","elapsed_ms":12,"changed":true}`,
+		`{"time":"2024-05-01T12:00:00Z","domain":"example.com","elapsed_ms":0,"changed":false,"error":"no DNS response"}`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Expected one JSON line per detection, got %q", lines)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("Line %d: got %s, want %s", i+1, lines[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package whichdns
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Answer is a record from the answer section of a matched DNS response, e.g.
+// to check the addresses a server returned for Options.Domain
+type Answer struct {
+	// Name is the owner name of the record, without the trailing dot
+	Name string
+	// Type is the record type, e.g. "A", or "TYPE65" for one without a name
+	Type string
+	// TTL is the time to live in seconds
+	TTL uint32
+	// Value is the record data in presentation form: an address, a name,
+	// "10 mail.example.com" for MX or quoted strings for TXT; types without
+	// a name are shown as in RFC 3597, e.g. "\# 2 abcd"
+	Value string
+}
+
+// String formats the record as in a zone file, without the class
+func (a Answer) String() string {
+	return fmt.Sprintf("%s %d %s %s", a.Name, a.TTL, a.Type, a.Value)
+}
+
+// addAnswers adds the records of answers missing from set, a sorted
+// Result.AnswerSets entry, and returns it; it is never nil, so a server that
+// answered without records still has an entry
+func addAnswers(set []string, answers []Answer) []string {
+	if set == nil {
+		set = []string{}
+	}
+	for _, answer := range answers {
+		record := answer.Type + " " + answer.Value
+		if i, found := slices.BinarySearch(set, record); !found {
+			set = slices.Insert(set, i, record)
+		}
+	}
+	return set
+}
+
+// AnswerConflicts returns the pairs of servers, in the order of
+// Result.Servers, that disagree on the answer to the lookups: for a query
+// type both answered, their AnswerSets have no record in common, such as two
+// different addresses or an address and NXDOMAIN. Servers sharing a record
+// are taken to agree, as a load-balanced name may return a different subset
+// of its addresses each time.
+func (r Result) AnswerConflicts() [][2]net.IP {
+	var conflicts [][2]net.IP
+	for i, server := range r.Servers {
+		for _, other := range r.Servers[i+1:] {
+			if answersDiffer(r.AnswerSets[server.String()], r.AnswerSets[other.String()]) {
+				conflicts = append(conflicts, [2]net.IP{server, other})
+			}
+		}
+	}
+	return conflicts
+}
+
+// answersDiffer reports whether two servers' answer sets, keyed by query
+// type, disagree for a type both of them answered
+func answersDiffer(sets, others map[string][]string) bool {
+	for qtype, set := range sets {
+		other, ok := others[qtype]
+		if !ok || (len(set) == 0 && len(other) == 0) {
+			continue
+		}
+		if !slices.ContainsFunc(set, func(record string) bool { return slices.Contains(other, record) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAnswers decodes the count answer records starting at offset, stopping
+// at the first malformed one
+func parseAnswers(data []byte, offset, count int) []Answer {
+	var answers []Answer
+	for i := 0; i < count; i++ {
+		// NAME, then TYPE, CLASS, TTL and RDLENGTH
+		name, next, ok := readDNSName(data, offset)
+		if !ok || next+10 > len(data) {
+			break
+		}
+		rrType := binary.BigEndian.Uint16(data[next : next+2])
+		ttl := binary.BigEndian.Uint32(data[next+4 : next+8])
+		rdLen := int(binary.BigEndian.Uint16(data[next+8 : next+10]))
+		rdata := next + 10
+		if rdata+rdLen > len(data) {
+			break
+		}
+		value, ok := formatRData(data, rrType, rdata, rdLen)
+		if !ok {
+			break
+		}
+		answers = append(answers, Answer{Name: name, Type: typeName(rrType), TTL: ttl, Value: value})
+		offset = rdata + rdLen
+	}
+	return answers
+}
+
+// formatRData returns the presentation form of the rdLen bytes of record data
+// at offset in the message data; names in it may point anywhere in data
+func formatRData(data []byte, rrType uint16, offset, rdLen int) (string, bool) {
+	rdata := data[offset : offset+rdLen]
+	switch rrType {
+	case queryTypes["A"]:
+		if rdLen != net.IPv4len {
+			return "", false
+		}
+		return net.IP(rdata).String(), true
+	case queryTypes["AAAA"]:
+		if rdLen != net.IPv6len {
+			return "", false
+		}
+		return net.IP(rdata).String(), true
+	case queryTypes["CNAME"], queryTypes["NS"]:
+		name, _, ok := readDNSName(data, offset)
+		return name, ok
+	case queryTypes["MX"]:
+		if rdLen < 3 {
+			return "", false
+		}
+		name, _, ok := readDNSName(data, offset+2)
+		return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rdata), name), ok
+	case queryTypes["SRV"]:
+		if rdLen < 7 {
+			return "", false
+		}
+		name, _, ok := readDNSName(data, offset+6)
+		return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:]),
+			binary.BigEndian.Uint16(rdata[4:]), name), ok
+	case queryTypes["TXT"]:
+		var texts []string
+		for i := 0; i < rdLen; {
+			n := int(rdata[i])
+			if i+1+n > rdLen {
+				return "", false
+			}
+			texts = append(texts, strconv.Quote(string(rdata[i+1:i+1+n])))
+			i += 1 + n
+		}
+		return strings.Join(texts, " "), true
+	}
+	return fmt.Sprintf("\\# %d %s", rdLen, hex.EncodeToString(rdata)), true
+}
+
+// typeName returns the name of record type code, or "TYPE" and the code for
+// a type Options.Type does not accept
+func typeName(code uint16) string {
+	for name, c := range queryTypes {
+		if c == code {
+			return name
+		}
+	}
+	return fmt.Sprintf("TYPE%d", code)
+}
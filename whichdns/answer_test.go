@@ -0,0 +1,101 @@
+package whichdns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// appendRecord adds an answer record owned by the question name (a pointer to
+// offset 12) with the given type, TTL 300 and rdata to msg, counting it in the header
+func appendRecord(msg []byte, rrType uint16, rdata []byte) []byte {
+	msg[7]++
+	msg = append(msg, 0xC0, dnsHeaderLen, byte(rrType>>8), byte(rrType), 0x00, 0x01, 0, 0, 0x01, 0x2C)
+	msg = append(msg, byte(len(rdata)>>8), byte(len(rdata)))
+	return append(msg, rdata...)
+}
+
+func TestParseAnswers(t *testing.T) {
+	msg := buildDNSPayload(1, true, "example.com")
+	msg = appendRecord(msg, queryTypes["CNAME"], []byte{3, 'w', 'w', 'w', 0xC0, dnsHeaderLen})
+	msg = appendRecord(msg, queryTypes["A"], []byte{93, 184, 216, 34})
+	msg = appendRecord(msg, queryTypes["AAAA"], []byte{0x20, 0x01, 0x0d, 0xb8, 15: 1})
+	msg = appendRecord(msg, queryTypes["MX"], []byte{0, 10, 4, 'm', 'a', 'i', 'l', 0xC0, dnsHeaderLen})
+	msg = appendRecord(msg, queryTypes["TXT"], []byte{2, 'h', 'i', 3, 'a', '"', 'b'})
+	msg = appendRecord(msg, 65, []byte{0xab, 0xcd})
+
+	parsed, ok := parseDNSMessage(msg)
+	if !ok {
+		t.Fatal("Expected the response to parse")
+	}
+	if parsed.qtype != queryTypes["A"] {
+		t.Errorf("Expected the question type A, got %s", typeName(parsed.qtype))
+	}
+	var got []string
+	for _, answer := range parsed.answers {
+		got = append(got, answer.String())
+	}
+	want := []string{
+		"example.com 300 CNAME www.example.com",
+		"example.com 300 A 93.184.216.34",
+		"example.com 300 AAAA 2001:db8::1",
+		"example.com 300 MX 10 mail.example.com",
+		`example.com 300 TXT "hi" "a\"b"`,
+		`example.com 300 TYPE65 \# 2 abcd`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got answers\n%q\nwant\n%q", got, want)
+	}
+
+	// A truncated record ends the list without failing the message
+	parsed, ok = parseDNSMessage(msg[:len(msg)-1])
+	if !ok || len(parsed.answers) != len(want)-1 {
+		t.Errorf("Expected the records before a truncated one, got %v (ok %v)", parsed.answers, ok)
+	}
+
+	// Queries carry no answers
+	if parsed, _ := parseDNSMessage(buildDNSPayload(1, false, "example.com")); parsed.answers != nil {
+		t.Errorf("Expected no answers in a query, got %v", parsed.answers)
+	}
+}
+
+func TestAnswerConflicts(t *testing.T) {
+	set := addAnswers(nil, []Answer{{Type: "A", Value: "192.0.2.2"}, {Type: "A", Value: "192.0.2.1"}})
+	set = addAnswers(set, []Answer{{Type: "A", Value: "192.0.2.1"}, {Type: "A", Value: "192.0.2.3"}})
+	if want := []string{"A 192.0.2.1", "A 192.0.2.2", "A 192.0.2.3"}; !reflect.DeepEqual(set, want) {
+		t.Errorf("Got answer set %q, want %q", set, want)
+	}
+	if empty := addAnswers(nil, nil); empty == nil || len(empty) != 0 {
+		t.Errorf("Expected an empty, non-nil answer set, got %#v", empty)
+	}
+
+	servers := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.4")}
+	result := Result{
+		Servers: servers,
+		AnswerSets: map[string]map[string][]string{
+			"10.0.0.1": {"A": {"A 192.0.2.1", "A 192.0.2.2"}, "AAAA": {}},
+			"10.0.0.2": {"A": {"A 192.0.2.2"}},    // Shares a record with 10.0.0.1: a load-balanced subset
+			"10.0.0.3": {"A": {"A 198.51.100.7"}}, // Split brain
+			"10.0.0.4": {"A": {}},                 // NXDOMAIN
+		},
+	}
+	var got []string
+	for _, pair := range result.AnswerConflicts() {
+		got = append(got, pair[0].String()+"/"+pair[1].String())
+	}
+	want := []string{"10.0.0.1/10.0.0.3", "10.0.0.1/10.0.0.4", "10.0.0.2/10.0.0.3", "10.0.0.2/10.0.0.4", "10.0.0.3/10.0.0.4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got conflicts %q, want %q", got, want)
+	}
+
+	// Servers that both answered without records agree, and answers to
+	// different query types are not compared
+	result.AnswerSets = map[string]map[string][]string{
+		"10.0.0.1": {"A": {}, "AAAA": {"AAAA 2001:db8::1"}},
+		"10.0.0.2": {"A": {}},
+		"10.0.0.3": {"MX": {"MX 10 mail.example.com"}},
+	}
+	if conflicts := result.AnswerConflicts(); conflicts != nil {
+		t.Errorf("Expected no conflicts between two empty answers, got %v", conflicts)
+	}
+}
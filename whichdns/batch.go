@@ -0,0 +1,97 @@
+package whichdns
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// DefaultWorkers is the number of domains DetectDomains checks at once when
+// workers is zero
+const DefaultWorkers = 8
+
+// DetectDomains runs a detection for each of domains with opts, Domain
+// aside, checking at most workers of them at once over a single capture
+// shared by all. fn is called with each domain's index and outcome as it
+// completes, one call at a time. A domain listed more than once is checked
+// once, since lookups of the same name could not be told apart in the shared
+// capture, and reported for each of its indexes. The capture is opened once, so OnCaptureOpen
+// is called once; OnStep and OnPacket are called for every domain. PcapFile
+// and WriteFile are not supported: use Detect for each domain instead. The
+// error reports a capture that could not be opened, in which case fn is never
+// called, or ctx.Err() if ctx was cancelled before every domain was checked.
+func DetectDomains(ctx context.Context, opts Options, domains []string, workers int, fn func(i int, result Result, err error)) error {
+	opts = opts.withDefaults()
+	if opts.PcapFile != "" || opts.WriteFile != "" {
+		return errors.New("DetectDomains does not support PcapFile or WriteFile")
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	for _, domain := range domains {
+		if err := ValidateDomain(domain); err != nil {
+			return err
+		}
+	}
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	src, ifaces, err := openSource(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if opts.OnCaptureOpen != nil {
+		if err := opts.OnCaptureOpen(); err != nil {
+			return err
+		}
+	}
+	shared := newSharedSource(src)
+
+	// Group the indexes of each name; DNS names are case-insensitive
+	var names []string
+	indexesOf := make(map[string][]int)
+	for i, domain := range domains {
+		name := strings.ToLower(strings.TrimSuffix(domain, "."))
+		if _, ok := indexesOf[name]; !ok {
+			names = append(names, name)
+		}
+		indexesOf[name] = append(indexesOf[name], i)
+	}
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for range min(workers, len(names)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				indexes := indexesOf[name]
+				domainOpts := opts
+				domainOpts.Domain = domains[indexes[0]]
+				reader := shared.reader()
+				result, err := detectOn(ctx, domainOpts, reader, ifaces, nil)
+				reader.Close()
+
+				mu.Lock()
+				for _, i := range indexes {
+					fn(i, result, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	infof("Checking %d domains, %d at a time, over one capture.", len(names), workers)
+	for _, name := range names {
+		if !sendCtx(ctx, work, name) {
+			break
+		}
+	}
+	close(work)
+	wg.Wait()
+	return ctx.Err()
+}
@@ -0,0 +1,184 @@
+package whichdns
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// CaptureBackend names the mechanism used for live captures
+const CaptureBackend = "AF_PACKET"
+
+// LiveCapture reports whether this platform can capture from an interface
+const LiveCapture = true
+
+// AF_PACKET constants
+const (
+	afPacket = syscall.AF_PACKET
+	sockRaw  = syscall.SOCK_RAW
+)
+
+// sockaddrLl structure for AF_PACKET
+type sockaddrLl struct {
+	sllFamily   uint16
+	sllProtocol uint16
+	sllIfindex  int32
+	sllHatype   uint16
+	sllPkttype  uint8
+	sllHalen    uint8
+	sllAddr     [8]uint8
+}
+
+// packetOutgoing is the sll_pkttype of a packet sent by this host
+const packetOutgoing = 4 // PACKET_OUTGOING
+
+// afPacketSource captures live packets from an AF_PACKET socket
+type afPacketSource struct {
+	fd      int
+	iface   string
+	snaplen int
+	// loopback is set on a loopback interface, where every packet is seen
+	// twice: once sent and once received
+	loopback bool
+}
+
+// openAFPacketSource opens a live capture bound to iface keeping up to snaplen
+// bytes of each frame, with a receive buffer of bufferSize bytes if positive
+func openAFPacketSource(iface *net.Interface, snaplen, bufferSize int) (*afPacketSource, error) {
+	fd, err := openAFPacketSocket(iface, bufferSize)
+	if err != nil {
+		return nil, err
+	}
+	return &afPacketSource{fd: fd, iface: iface.Name, snaplen: snaplen, loopback: iface.Flags&net.FlagLoopback != 0}, nil
+}
+
+// readPacket reads the next packet from the socket without blocking. On
+// loopback the sent copy of each packet is dropped, so responses are not
+// counted twice.
+func (s *afPacketSource) readPacket() (*capturedPacket, error) {
+	packet, err := readPacket(s.fd, s.snaplen, s.loopback)
+	if packet != nil {
+		packet.iface = s.iface
+	}
+	return packet, err
+}
+
+// Close closes the socket
+func (s *afPacketSource) Close() error {
+	debugf("AF_PACKET socket on %v closed.", s.iface)
+	return syscall.Close(s.fd)
+}
+
+// openAFPacketSocket creates a raw AF_PACKET socket for packet capture. It
+// joins no PACKET_MR_PROMISC membership: the lookups' own traffic reaches the
+// socket without promiscuous mode.
+func openAFPacketSocket(iface *net.Interface, bufferSize int) (int, error) {
+	// Create raw socket to capture all Ethernet frames
+	fd, err := syscall.Socket(afPacket, sockRaw, int(htons(ethPAll)))
+	if err != nil {
+		return -1, fmt.Errorf("failed to create AF_PACKET socket: %w", err)
+	}
+
+	// Bind to interface
+	sa := &sockaddrLl{
+		sllFamily:   afPacket,
+		sllProtocol: htons(ethPAll),
+		sllIfindex:  int32(iface.Index),
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(sa)), unsafe.Sizeof(*sa))
+	if errno != 0 {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("failed to bind socket to interface: %w", errno)
+	}
+
+	// Ask the kernel to timestamp each captured packet
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1); err != nil {
+		debugf("Kernel packet timestamps unavailable, falling back to receive time: %v", err)
+	}
+
+	// Enlarge the receive buffer; SO_RCVBUFFORCE (root only) may exceed the
+	// rmem_max limit that caps SO_RCVBUF
+	if bufferSize > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, bufferSize); err != nil {
+			debugf("SO_RCVBUFFORCE failed, falling back to SO_RCVBUF: %v", err)
+			if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, bufferSize); err != nil {
+				syscall.Close(fd)
+				return -1, fmt.Errorf("failed to set receive buffer size: %w", err)
+			}
+		}
+		if size, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err == nil {
+			debugf("Receive buffer size is %d bytes", size)
+		}
+	}
+
+	// Set socket to non-blocking mode
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("failed to set socket to non-blocking mode: %w", err)
+	}
+
+	debugf("AF_PACKET socket created and bound to interface %s (index %d)", iface.Name, iface.Index)
+	return fd, nil
+}
+
+// htons converts host byte order to network byte order (big endian)
+func htons(x uint16) uint16 {
+	return (x<<8)&0xff00 | x>>8
+}
+
+// readPacket reads a single packet from the AF_PACKET socket, skipping it if
+// it was sent by this host and skipOutgoing is set; the kernel drops whatever
+// does not fit in snaplen bytes
+func readPacket(fd int, snaplen int, skipOutgoing bool) (*capturedPacket, error) {
+	buf := make([]byte, snaplen)
+	oob := make([]byte, syscall.CmsgSpace(int(unsafe.Sizeof(syscall.Timespec{}))))
+
+	// MSG_TRUNC makes n the length on the wire even when the frame is cut off
+	n, oobn, _, from, err := syscall.Recvmsg(fd, buf, oob, syscall.MSG_TRUNC)
+	if err != nil {
+		if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+			// No data available, try again
+			return nil, nil
+		}
+		debugf("Recvmsg error: %v", err)
+		return nil, err
+	}
+
+	if n == 0 {
+		// Empty packet, skip
+		debugf("Received empty packet (n=0)")
+		return nil, nil
+	}
+
+	if sll, ok := from.(*syscall.SockaddrLinklayer); ok && skipOutgoing && sll.Pkttype == packetOutgoing {
+		return nil, nil
+	}
+
+	debugf("Received packet with %d bytes", n)
+	return &capturedPacket{
+		data:      buf[:min(n, snaplen)],
+		timestamp: packetTimestamp(oob[:oobn]),
+		length:    n,
+	}, nil
+}
+
+// packetTimestamp extracts the kernel capture timestamp from the control
+// messages of a received packet, falling back to the current time
+func packetTimestamp(oob []byte) time.Time {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Now()
+	}
+
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.SOL_SOCKET && msg.Header.Type == syscall.SO_TIMESTAMPNS &&
+			len(msg.Data) >= int(unsafe.Sizeof(syscall.Timespec{})) {
+			ts := (*syscall.Timespec)(unsafe.Pointer(&msg.Data[0]))
+			return time.Unix(ts.Unix())
+		}
+	}
+	return time.Now()
+}
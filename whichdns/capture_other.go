@@ -0,0 +1,36 @@
+//go:build !linux
+
+package whichdns
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// CaptureBackend names the mechanism used for live captures: none here
+const CaptureBackend = "unsupported"
+
+// LiveCapture reports whether this platform can capture from an interface.
+// Live capture is built on AF_PACKET sockets to stay free of libpcap and cgo,
+// so there is deliberately no Npcap or BPF device backend: on Windows and
+// macOS only capture files can be analysed.
+const LiveCapture = false
+
+// afPacketSource stands in for the Linux AF_PACKET capture on other platforms
+type afPacketSource struct{}
+
+// openAFPacketSource reports that live capture is unavailable on this platform
+func openAFPacketSource(iface *net.Interface, snaplen, bufferSize int) (*afPacketSource, error) {
+	return nil, fmt.Errorf("live capture is not supported on %s; analyse a saved capture with --pcap instead", runtime.GOOS)
+}
+
+// readPacket never returns packets
+func (s *afPacketSource) readPacket() (*capturedPacket, error) {
+	return nil, nil
+}
+
+// Close does nothing
+func (s *afPacketSource) Close() error {
+	return nil
+}
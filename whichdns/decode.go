@@ -0,0 +1,565 @@
+package whichdns
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// Network protocol constants
+const (
+	ethPAll    = 0x0003 // Ethernet protocol: All packets
+	ethPIPv4   = 0x0800 // Ethernet protocol: IPv4
+	ethPIPv6   = 0x86DD // Ethernet protocol: IPv6
+	ethP8021Q  = 0x8100 // Ethernet protocol: 802.1Q VLAN tag
+	ethP8021AD = 0x88A8 // Ethernet protocol: 802.1ad (QinQ) service tag
+	ipProtoTCP = 6      // IP protocol: TCP
+	ipProtoUDP = 17     // IP protocol: UDP
+	dnsPort    = 53     // Default DNS service port
+)
+
+// Packet size constants
+const (
+	ethHeaderLen = 14  // Ethernet header length
+	vlanTagLen   = 4   // 802.1Q tag length (TCI and inner EtherType)
+	maxVLANTags  = 2   // Tags skipped in one frame (QinQ)
+	ipHeaderMin  = 20  // Minimum IP header length
+	udpHeaderLen = 8   // UDP header length
+	tcpHeaderMin = 20  // Minimum TCP header length
+	ipSrcOffset  = 12  // IP source address offset in header
+	ip6HeaderLen = 40  // IPv6 fixed header length
+	ip6SrcOffset = 8   // IPv6 source address offset in header
+	dnsHeaderLen = 12  // DNS message header length
+	dnsUDPMaxLen = 512 // Largest DNS message over UDP without EDNS0
+)
+
+// IPv6 extension header numbers skipped while looking for the transport header
+const (
+	ip6HopByHop = 0  // Hop-by-Hop Options
+	ip6Routing  = 43 // Routing
+	ip6Fragment = 44 // Fragment
+	ip6DestOpts = 60 // Destination Options
+)
+
+// DNS message constants
+const (
+	dnsFlagQR      = 0x8000 // DNS header flag: message is a response
+	dnsFlagTC      = 0x0200 // DNS header flag: message was truncated
+	dnsFlagAD      = 0x0020 // DNS header flag: authenticated data (DNSSEC validated)
+	dnsMaxPointers = 16     // Maximum compression pointers followed in one name
+)
+
+// parseEthernetFrame parses basic Ethernet frame to extract IP packet, skipping
+// any 802.1Q or QinQ VLAN tags, as seen on trunk ports whose NIC does not
+// strip them
+func parseEthernetFrame(frame []byte) ([]byte, bool) {
+	if len(frame) < ethHeaderLen {
+		return nil, false
+	}
+
+	offset := ethHeaderLen
+	etherType := uint16(frame[12])<<8 | uint16(frame[13])
+	for tags := 0; etherType == ethP8021Q || etherType == ethP8021AD; tags++ {
+		if tags == maxVLANTags || len(frame) < offset+vlanTagLen {
+			return nil, false
+		}
+		// The tag's last two bytes carry the EtherType of what follows
+		etherType = uint16(frame[offset+2])<<8 | uint16(frame[offset+3])
+		offset += vlanTagLen
+	}
+
+	// Check if it's IPv4 (EtherType 0x0800) or IPv6 (EtherType 0x86DD)
+	if etherType != ethPIPv4 && etherType != ethPIPv6 {
+		return nil, false
+	}
+
+	return frame[offset:], true
+}
+
+// Ethernet header offsets of the MAC addresses
+const (
+	ethDstOffset = 0
+	ethSrcOffset = 6
+)
+
+// frameMAC returns the MAC address at offset in the Ethernet header of frame,
+// or nil if the frame is too short or the address is all zeroes, as on
+// loopback, where there is no link-layer addressing
+func frameMAC(frame []byte, offset int) net.HardwareAddr {
+	if len(frame) < ethHeaderLen {
+		return nil
+	}
+	mac := frame[offset : offset+6]
+	if strings.Trim(string(mac), "\x00") == "" {
+		return nil
+	}
+	return append(net.HardwareAddr(nil), mac...)
+}
+
+// describeFrame summarises a frame for debug logs as its transport protocol
+// and addresses, e.g. "UDP 192.168.1.1:53 -> 192.168.1.10:40000", so it is
+// clear why it was or was not matched
+func describeFrame(frame []byte) string {
+	ipPacket, ok := parseEthernetFrame(frame)
+	if !ok {
+		return "not an IP frame"
+	}
+	transport, proto, srcIP, dstIP, ok := parseIPPacket(ipPacket)
+	if !ok {
+		return "not a UDP or TCP packet"
+	}
+	name := "UDP"
+	if proto == ipProtoTCP {
+		name = "TCP"
+	}
+	src := &net.UDPAddr{IP: srcIP, Port: int(transport[0])<<8 | int(transport[1])}
+	dst := &net.UDPAddr{IP: dstIP, Port: int(transport[2])<<8 | int(transport[3])}
+	return name + " " + src.String() + " -> " + dst.String()
+}
+
+// parseIPPacket extracts the UDP or TCP packet, its protocol number and the
+// addresses from an IPv4 or IPv6 packet
+func parseIPPacket(ipPacket []byte) ([]byte, byte, net.IP, net.IP, bool) {
+	if len(ipPacket) < 1 {
+		return nil, 0, nil, nil, false
+	}
+
+	switch ipPacket[0] >> 4 {
+	case 4:
+		return parseIPv4Packet(ipPacket)
+	case 6:
+		return parseIPv6Packet(ipPacket)
+	}
+	return nil, 0, nil, nil, false
+}
+
+// Header offsets of the IPv4 TTL and the IPv6 hop limit
+const (
+	ipTTLOffset       = 8
+	ip6HopLimitOffset = 7
+)
+
+// ipTTL returns the TTL of an IPv4 packet or the hop limit of an IPv6 one,
+// which the routers on the way have counted down from the sender's initial value
+func ipTTL(ipPacket []byte) int {
+	switch {
+	case len(ipPacket) >= ipHeaderMin && ipPacket[0]>>4 == 4:
+		return int(ipPacket[ipTTLOffset])
+	case len(ipPacket) >= ip6HeaderLen && ipPacket[0]>>4 == 6:
+		return int(ipPacket[ip6HopLimitOffset])
+	}
+	return 0
+}
+
+// transportHeaderMin returns the minimum header length of a supported
+// transport protocol, or zero if the protocol is not supported
+func transportHeaderMin(proto byte) int {
+	switch proto {
+	case ipProtoUDP:
+		return udpHeaderLen
+	case ipProtoTCP:
+		return tcpHeaderMin
+	}
+	return 0
+}
+
+// parseIPv4Packet extracts the UDP or TCP packet and addresses from an IPv4 packet
+func parseIPv4Packet(ipPacket []byte) ([]byte, byte, net.IP, net.IP, bool) {
+	if len(ipPacket) < ipHeaderMin {
+		return nil, 0, nil, nil, false
+	}
+
+	// Check if it's UDP or TCP
+	proto := ipPacket[9]
+	minLen := transportHeaderMin(proto)
+	if minLen == 0 {
+		return nil, 0, nil, nil, false
+	}
+
+	// Get header length (first 4 bits * 4)
+	headerLen := int(ipPacket[0]&0x0F) * 4
+	if len(ipPacket) < headerLen+minLen {
+		return nil, 0, nil, nil, false
+	}
+
+	// Trim Ethernet padding so TCP payload lengths are exact
+	end := len(ipPacket)
+	if totalLen := int(ipPacket[2])<<8 | int(ipPacket[3]); totalLen >= headerLen+minLen && totalLen < end {
+		end = totalLen
+	}
+
+	srcIP := net.IP(ipPacket[ipSrcOffset : ipSrcOffset+4])
+	dstIP := net.IP(ipPacket[ipSrcOffset+4 : ipSrcOffset+8])
+	return ipPacket[headerLen:end], proto, srcIP, dstIP, true
+}
+
+// parseIPv6Packet extracts the UDP or TCP packet and addresses from an IPv6
+// packet, skipping any extension headers in front of it
+func parseIPv6Packet(ipPacket []byte) ([]byte, byte, net.IP, net.IP, bool) {
+	if len(ipPacket) < ip6HeaderLen {
+		return nil, 0, nil, nil, false
+	}
+
+	// Trim Ethernet padding so TCP payload lengths are exact
+	if end := ip6HeaderLen + (int(ipPacket[4])<<8 | int(ipPacket[5])); end < len(ipPacket) {
+		ipPacket = ipPacket[:end]
+	}
+
+	srcIP := net.IP(ipPacket[ip6SrcOffset : ip6SrcOffset+16])
+	dstIP := net.IP(ipPacket[ip6SrcOffset+16 : ip6SrcOffset+32])
+
+	nextHeader := ipPacket[6]
+	offset := ip6HeaderLen
+	for {
+		switch nextHeader {
+		case ipProtoUDP, ipProtoTCP:
+			if len(ipPacket) < offset+transportHeaderMin(nextHeader) {
+				return nil, 0, nil, nil, false
+			}
+			return ipPacket[offset:], nextHeader, srcIP, dstIP, true
+		case ip6HopByHop, ip6Routing, ip6DestOpts:
+			if len(ipPacket) < offset+2 {
+				return nil, 0, nil, nil, false
+			}
+			nextHeader = ipPacket[offset]
+			offset += (int(ipPacket[offset+1]) + 1) * 8
+		case ip6Fragment:
+			// Only an unfragmented or first fragment carries the transport header
+			if len(ipPacket) < offset+8 {
+				return nil, 0, nil, nil, false
+			}
+			if fragOffset := uint16(ipPacket[offset+2])<<8 | uint16(ipPacket[offset+3]); fragOffset>>3 != 0 {
+				return nil, 0, nil, nil, false
+			}
+			nextHeader = ipPacket[offset]
+			offset += 8
+		default:
+			return nil, 0, nil, nil, false
+		}
+	}
+}
+
+// parseUDPPacket extracts the payload and ports from a UDP packet
+func parseUDPPacket(udpPacket []byte) ([]byte, uint16, uint16, bool) {
+	if len(udpPacket) < udpHeaderLen {
+		return nil, 0, 0, false
+	}
+
+	srcPort := uint16(udpPacket[0])<<8 | uint16(udpPacket[1])
+	dstPort := uint16(udpPacket[2])<<8 | uint16(udpPacket[3])
+
+	// Get UDP data length
+	dataLen := uint16(udpPacket[4])<<8 | uint16(udpPacket[5])
+	if dataLen < udpHeaderLen || len(udpPacket) < int(dataLen) {
+		return nil, 0, 0, false
+	}
+
+	return udpPacket[udpHeaderLen:dataLen], srcPort, dstPort, true
+}
+
+// dnsMessage holds the parts of a DNS message used for matching
+type dnsMessage struct {
+	id        uint16
+	response  bool
+	flags     uint16
+	questions []string
+	qtype     uint16   // Type of the first question
+	edns      *EDNS    // OPT record from the additional section, if any
+	answers   []Answer // Records of the answer section of a response
+}
+
+// parseDNSMessage decodes the DNS header and question section
+func parseDNSMessage(data []byte) (*dnsMessage, bool) {
+	if len(data) < dnsHeaderLen {
+		return nil, false
+	}
+
+	flags := uint16(data[2])<<8 | uint16(data[3])
+	qdCount := int(uint16(data[4])<<8 | uint16(data[5]))
+	msg := &dnsMessage{
+		id:       uint16(data[0])<<8 | uint16(data[1]),
+		response: flags&dnsFlagQR != 0,
+		flags:    flags,
+	}
+
+	offset := dnsHeaderLen
+	for i := 0; i < qdCount; i++ {
+		name, next, ok := readDNSName(data, offset)
+		if !ok {
+			return nil, false
+		}
+		// QTYPE, then QCLASS
+		if len(data) < next+4 {
+			return nil, false
+		}
+		if i == 0 {
+			msg.qtype = uint16(data[next])<<8 | uint16(data[next+1])
+		}
+		msg.questions = append(msg.questions, name)
+		offset = next + 4
+	}
+
+	// The OPT record follows the answer and authority records
+	anCount := int(uint16(data[6])<<8 | uint16(data[7]))
+	nsCount := int(uint16(data[8])<<8 | uint16(data[9]))
+	arCount := int(uint16(data[10])<<8 | uint16(data[11]))
+	if msg.response && anCount > 0 {
+		msg.answers = parseAnswers(data, offset, anCount)
+	}
+	if arCount > 0 {
+		msg.edns = parseOPT(data, offset, anCount+nsCount+arCount)
+	}
+
+	return msg, true
+}
+
+// readDNSName decodes a possibly compressed domain name starting at offset,
+// returning the name and the offset just past it
+func readDNSName(data []byte, offset int) (string, int, bool) {
+	var labels []string
+	next := -1
+	pointers := 0
+
+	for {
+		if offset >= len(data) {
+			return "", 0, false
+		}
+		length := int(data[offset])
+
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, true
+		case length&0xC0 == 0xC0:
+			// Compression pointer to an earlier name
+			if offset+1 >= len(data) {
+				return "", 0, false
+			}
+			pointers++
+			if pointers > dnsMaxPointers {
+				return "", 0, false
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(data[offset]&0x3F)<<8 | int(data[offset+1])
+		case length&0xC0 != 0:
+			// Reserved label types are not supported
+			return "", 0, false
+		default:
+			if offset+1+length > len(data) {
+				return "", 0, false
+			}
+			labels = append(labels, string(data[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// matchesDomain reports whether a question name belongs to a lookup for domain,
+// allowing for search suffixes appended by the resolver
+func matchesDomain(name, domain string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	return name == domain || strings.HasPrefix(name, domain+".")
+}
+
+// dnsPacket is a decoded DNS message together with its addressing
+type dnsPacket struct {
+	srcIP     net.IP
+	dstIP     net.IP
+	srcPort   uint16
+	dstPort   uint16
+	ttl       int // IP TTL or hop limit
+	msg       *dnsMessage
+	timestamp time.Time
+}
+
+// packetDecoder turns captured Ethernet frames into DNS messages, keeping the
+// IP fragments and TCP stream state needed to reassemble them
+type packetDecoder struct {
+	proto     string
+	port      uint16
+	fragments *ipFragments
+	streams   *tcpStreams
+	// expecting, if set, reports whether a query was sent from a client
+	// port, so a UDP response to it is decoded even when a middlebox has
+	// rewritten its source port
+	expecting func(port uint16) bool
+}
+
+// newPacketDecoder creates a decoder accepting DNS on port over proto (one of
+// the Proto constants)
+func newPacketDecoder(proto string, port uint16) *packetDecoder {
+	return &packetDecoder{proto: proto, port: port, fragments: newIPFragments(), streams: newTCPStreams()}
+}
+
+// decode returns the DNS messages completed by frame; a TCP segment can
+// complete none or several of them
+func (d *packetDecoder) decode(frame []byte) []*dnsPacket {
+	// Parse Ethernet frame
+	ipPacket, ok := parseEthernetFrame(frame)
+	if !ok {
+		return nil
+	}
+
+	// Reassemble fragmented datagrams, e.g. large EDNS0 responses
+	ipPacket, ok = d.fragments.add(ipPacket)
+	if !ok {
+		return nil
+	}
+
+	// Parse IP packet
+	transport, proto, srcIP, dstIP, ok := parseIPPacket(ipPacket)
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case proto == ipProtoUDP && d.proto != ProtoTCP:
+		// Parse UDP packet and keep only DNS traffic in either direction
+		payload, srcPort, dstPort, ok := parseUDPPacket(transport)
+		if !ok || (srcPort != d.port && dstPort != d.port && (d.expecting == nil || !d.expecting(dstPort))) {
+			return nil
+		}
+
+		// Decode DNS layer
+		msg, ok := parseDNSMessage(payload)
+		if !ok {
+			return nil
+		}
+		return []*dnsPacket{{srcIP: srcIP, dstIP: dstIP, srcPort: srcPort, dstPort: dstPort, ttl: ipTTL(ipPacket), msg: msg}}
+	case proto == ipProtoTCP && d.proto != ProtoUDP:
+		seg, ok := parseTCPSegment(transport)
+		if !ok || (seg.srcPort != d.port && seg.dstPort != d.port) {
+			return nil
+		}
+
+		var pkts []*dnsPacket
+		for _, payload := range d.streams.add(srcIP, dstIP, seg) {
+			msg, ok := parseDNSMessage(payload)
+			if !ok {
+				continue
+			}
+			pkts = append(pkts, &dnsPacket{srcIP: srcIP, dstIP: dstIP, srcPort: seg.srcPort, dstPort: seg.dstPort, ttl: ipTTL(ipPacket), msg: msg})
+		}
+		return pkts
+	}
+	return nil
+}
+
+// queryKey identifies an outstanding DNS query by transaction ID and client port
+type queryKey struct {
+	id   uint16
+	port uint16
+}
+
+// pendingQuery is a captured query awaiting its response
+type pendingQuery struct {
+	sent time.Time
+	do   bool // The query carried the EDNS0 DNSSEC OK flag
+}
+
+// queryTracker correlates captured DNS responses with the queries we sent
+type queryTracker struct {
+	domains  []string
+	port     uint16
+	pending  map[queryKey]pendingQuery
+	answered map[queryKey]bool
+}
+
+// newQueryTracker creates a tracker for queries about any of domains sent to servers on port
+func newQueryTracker(domains []string, port uint16) *queryTracker {
+	return &queryTracker{
+		domains:  domains,
+		port:     port,
+		pending:  make(map[queryKey]pendingQuery),
+		answered: make(map[queryKey]bool),
+	}
+}
+
+// observe records outgoing queries for the domains and returns the server IP when
+// pkt is a response to one of them
+func (t *queryTracker) observe(pkt *dnsPacket) (net.IP, bool) {
+	if _, ok := t.question(pkt.msg); !ok {
+		if pkt.msg.response {
+			debugf("Skipping DNS response from %v: question %v does not match %v", pkt.srcIP, pkt.msg.questions, t.domains)
+		} else {
+			debugf("Skipping DNS packet for unrelated questions: %v", pkt.msg.questions)
+		}
+		return nil, false
+	}
+
+	if !pkt.msg.response {
+		if pkt.dstPort == t.port {
+			debugf("DNS query sent to %v with ID %#04x from port %d", pkt.dstIP, pkt.msg.id, pkt.srcPort)
+			t.pending[queryKey{id: pkt.msg.id, port: pkt.srcPort}] = pendingQuery{
+				sent: pkt.timestamp,
+				do:   pkt.msg.edns != nil && pkt.msg.edns.DO,
+			}
+		}
+		return nil, false
+	}
+
+	key := queryKey{id: pkt.msg.id, port: pkt.dstPort}
+	if _, ok := t.pending[key]; !ok {
+		debugf("Skipping DNS response from %v with unknown ID %#04x", pkt.srcIP, pkt.msg.id)
+		return nil, false
+	}
+	if pkt.srcPort != t.port {
+		debugf("DNS response from %v came from port %d instead of %d; NAT or a proxy rewrote it", pkt.srcIP, pkt.srcPort, t.port)
+	}
+
+	t.answered[key] = true
+	return pkt.srcIP, true
+}
+
+// expecting reports whether a captured query is awaiting its response on
+// client port
+func (t *queryTracker) expecting(port uint16) bool {
+	for key := range t.pending {
+		if key.port == port {
+			return true
+		}
+	}
+	return false
+}
+
+// sawQueries reports whether any query for the domains has been seen
+func (t *queryTracker) sawQueries() bool {
+	return len(t.pending) > 0
+}
+
+// allAnswered reports whether at least one query was seen and every one has been answered
+func (t *queryTracker) allAnswered() bool {
+	return len(t.pending) > 0 && len(t.answered) == len(t.pending)
+}
+
+// sentAt returns the capture time of the query that response pkt answers
+func (t *queryTracker) sentAt(pkt *dnsPacket) time.Time {
+	return t.pending[queryKey{id: pkt.msg.id, port: pkt.dstPort}].sent
+}
+
+// dnssec returns the DNSSEC flags of response pkt and the query it answers
+func (t *queryTracker) dnssec(pkt *dnsPacket) DNSSEC {
+	return DNSSEC{
+		QueryDO: t.pending[queryKey{id: pkt.msg.id, port: pkt.dstPort}].do,
+		AD:      pkt.msg.flags&dnsFlagAD != 0,
+		TC:      pkt.msg.flags&dnsFlagTC != 0,
+	}
+}
+
+// question returns the first question in msg that is about a tracked domain,
+// without the trailing dot
+func (t *queryTracker) question(msg *dnsMessage) (string, bool) {
+	for _, question := range msg.questions {
+		for _, domain := range t.domains {
+			if matchesDomain(question, domain) {
+				return strings.TrimSuffix(question, "."), true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,417 @@
+package whichdns
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// buildDNSPayload builds a minimal DNS message with a single A question
+func buildDNSPayload(id uint16, response bool, qname string) []byte {
+	msg := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+	if response {
+		msg[2] |= 0x80
+	}
+	for _, label := range strings.Split(qname, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0x00, 0x00, 0x01, 0x00, 0x01)
+}
+
+// buildUDPFrame wraps payload in UDP, IPv4 and Ethernet headers
+func buildUDPFrame(srcIP, dstIP string, srcPort, dstPort uint16, payload []byte) []byte {
+	udpLen := udpHeaderLen + len(payload)
+	udp := []byte{byte(srcPort >> 8), byte(srcPort), byte(dstPort >> 8), byte(dstPort), byte(udpLen >> 8), byte(udpLen), 0, 0}
+	udp = append(udp, payload...)
+
+	ipLen := ipHeaderMin + len(udp)
+	ip := []byte{0x45, 0, byte(ipLen >> 8), byte(ipLen), 0, 0, 0, 0, 64, ipProtoUDP, 0, 0}
+	ip = append(ip, net.ParseIP(srcIP).To4()...)
+	ip = append(ip, net.ParseIP(dstIP).To4()...)
+	ip = append(ip, udp...)
+
+	eth := make([]byte, 12, ethHeaderLen+len(ip))
+	eth = append(eth, byte(ethPIPv4>>8), byte(ethPIPv4&0xff))
+	return append(eth, ip...)
+}
+
+// vlanTag inserts 802.1Q tags with the given VLAN IDs after the MAC addresses
+// of an Ethernet frame, outermost first
+func vlanTag(frame []byte, ids ...uint16) []byte {
+	tagged := append([]byte{}, frame[:12]...)
+	for _, id := range ids {
+		tagged = append(tagged, byte(ethP8021Q>>8), byte(ethP8021Q&0xff), byte(id>>8), byte(id))
+	}
+	return append(tagged, frame[12:]...)
+}
+
+// buildUDP6Frame wraps payload in UDP, IPv6 and Ethernet headers
+func buildUDP6Frame(srcIP, dstIP string, srcPort, dstPort uint16, payload []byte) []byte {
+	udpLen := udpHeaderLen + len(payload)
+	udp := []byte{byte(srcPort >> 8), byte(srcPort), byte(dstPort >> 8), byte(dstPort), byte(udpLen >> 8), byte(udpLen), 0, 0}
+	udp = append(udp, payload...)
+
+	ip := []byte{0x60, 0, 0, 0, byte(udpLen >> 8), byte(udpLen), ipProtoUDP, 64}
+	ip = append(ip, net.ParseIP(srcIP).To16()...)
+	ip = append(ip, net.ParseIP(dstIP).To16()...)
+	ip = append(ip, udp...)
+
+	eth := make([]byte, 12, ethHeaderLen+len(ip))
+	eth = append(eth, byte(ethPIPv6>>8), byte(ethPIPv6&0xff))
+	return append(eth, ip...)
+}
+
+func TestParseDNSMessage(t *testing.T) {
+	payload := buildDNSPayload(0x1234, true, "example.com")
+	// Append an answer whose name is a compression pointer to the question
+	payload[7] = 1
+	payload = append(payload, 0xC0, dnsHeaderLen, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 93, 184, 216, 34)
+
+	msg, ok := parseDNSMessage(payload)
+	if !ok {
+		t.Fatal("Expected DNS message to parse")
+	}
+	if msg.id != 0x1234 || !msg.response {
+		t.Errorf("Unexpected header: id=%#x response=%v", msg.id, msg.response)
+	}
+	if len(msg.questions) != 1 || msg.questions[0] != "example.com" {
+		t.Errorf("Unexpected questions: %v", msg.questions)
+	}
+
+	name, _, ok := readDNSName(payload, len(payload)-16)
+	if !ok || name != "example.com" {
+		t.Errorf("Expected compressed name example.com, got %q (ok=%v)", name, ok)
+	}
+
+	if _, ok := parseDNSMessage(payload[:5]); ok {
+		t.Error("Expected truncated message to fail")
+	}
+}
+
+// TestQueryTracker feeds frames through packetDecoder and queryTracker, which
+// together are the response matching: a response only matches a query seen
+// before it, so there is no single-packet match function to test
+func TestQueryTracker(t *testing.T) {
+	query := func(id, port uint16, qname string) []byte {
+		return buildUDPFrame("192.168.1.10", "192.168.1.1", port, 53, buildDNSPayload(id, false, qname))
+	}
+	response := func(id, port uint16, qname string) []byte {
+		return buildUDPFrame("192.168.1.1", "192.168.1.10", 53, port, buildDNSPayload(id, true, qname))
+	}
+
+	tests := []struct {
+		name       string
+		frames     [][]byte
+		want       string
+		ok         bool
+		sawQueries bool
+	}{
+		{"matching response", [][]byte{query(1, 40000, "example.com"), response(1, 40000, "example.com")}, "192.168.1.1", true, true},
+		{"search suffix", [][]byte{query(1, 40000, "example.com.lan"), response(1, 40000, "example.com.lan")}, "192.168.1.1", true, true},
+		{"no query seen", [][]byte{response(1, 40000, "example.com")}, "", false, false},
+		{"different id", [][]byte{query(1, 40000, "example.com"), response(2, 40000, "example.com")}, "", false, true},
+		{"different port", [][]byte{query(1, 40000, "example.com"), response(1, 40001, "example.com")}, "", false, true},
+		{"ipv6", [][]byte{
+			buildUDP6Frame("2001:db8::10", "2001:db8::1", 40000, 53, buildDNSPayload(1, false, "example.com")),
+			buildUDP6Frame("2001:db8::1", "2001:db8::10", 53, 40000, buildDNSPayload(1, true, "example.com")),
+		}, "2001:db8::1", true, true},
+		{"unrelated domain", [][]byte{query(1, 40000, "other.org"), response(1, 40000, "other.org")}, "", false, false},
+		{"response for another name", [][]byte{query(1, 40000, "example.com"), response(1, 40000, "other.org")}, "", false, true},
+		{"not dns", [][]byte{query(1, 40000, "example.com"), buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, []byte{1, 2, 3})}, "", false, true},
+		{"query only", [][]byte{query(1, 40000, "example.com"), query(2, 40001, "example.com")}, "", false, true},
+		{"vlan tagged", [][]byte{vlanTag(query(1, 40000, "example.com"), 10), vlanTag(response(1, 40000, "example.com"), 10)}, "192.168.1.1", true, true},
+		{"other port", [][]byte{
+			buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 5353, buildDNSPayload(1, false, "example.com")),
+			buildUDPFrame("192.168.1.1", "192.168.1.10", 5353, 40000, buildDNSPayload(1, true, "example.com")),
+		}, "", false, false},
+		{"rewritten source port", [][]byte{
+			query(1, 40000, "example.com"),
+			buildUDPFrame("192.168.1.1", "192.168.1.10", 1053, 40000, buildDNSPayload(1, true, "example.com")),
+		}, "192.168.1.1", true, true},
+	}
+
+	for _, tt := range tests {
+		tracker := newQueryTracker([]string{"example.com"}, dnsPort)
+		decoder := newPacketDecoder(ProtoAny, dnsPort)
+		decoder.expecting = tracker.expecting
+		var got string
+		var ok bool
+		for _, frame := range tt.frames {
+			for _, pkt := range decoder.decode(frame) {
+				var ip net.IP
+				if ip, ok = tracker.observe(pkt); ok {
+					got = ip.String()
+				}
+			}
+		}
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("%s: got (%q, %v), want (%q, %v)", tt.name, got, ok, tt.want, tt.ok)
+		}
+		if tracker.allAnswered() != tt.ok {
+			t.Errorf("%s: allAnswered() = %v, want %v", tt.name, !tt.ok, tt.ok)
+		}
+		if tracker.sawQueries() != tt.sawQueries {
+			t.Errorf("%s: sawQueries() = %v, want %v", tt.name, !tt.sawQueries, tt.sawQueries)
+		}
+	}
+}
+
+func TestDecodeVLAN(t *testing.T) {
+	query := buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(7, false, "example.com"))
+	response := buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, buildDNSPayload(7, true, "example.com"))
+
+	tests := []struct {
+		name string
+		ids  []uint16
+		want bool
+	}{
+		{"single tag", []uint16{100}, true},
+		{"qinq", []uint16{200, 100}, true},
+		{"too many tags", []uint16{300, 200, 100}, false},
+	}
+
+	for _, tt := range tests {
+		tracker := newQueryTracker([]string{"example.com"}, dnsPort)
+		decoder := newPacketDecoder(ProtoAny, dnsPort)
+		var got net.IP
+		for _, frame := range [][]byte{vlanTag(query, tt.ids...), vlanTag(response, tt.ids...)} {
+			for _, pkt := range decoder.decode(frame) {
+				if ip, ok := tracker.observe(pkt); ok {
+					got = ip
+				}
+			}
+		}
+		if (got != nil) != tt.want {
+			t.Errorf("%s: got server %v, want match %v", tt.name, got, tt.want)
+		}
+		if tt.want && !got.Equal(net.ParseIP("192.168.1.1")) {
+			t.Errorf("%s: expected server 192.168.1.1, got %v", tt.name, got)
+		}
+	}
+
+	// A tag cut short must not be read past the end of the frame
+	if _, ok := parseEthernetFrame(vlanTag(query, 100)[:16]); ok {
+		t.Error("Expected a truncated VLAN tag to be rejected")
+	}
+}
+
+func TestQueryTrackerQuestion(t *testing.T) {
+	tracker := newQueryTracker([]string{"example.com"}, dnsPort)
+	tests := []struct {
+		questions []string
+		want      string
+		ok        bool
+	}{
+		{[]string{"example.com."}, "example.com", true},
+		{[]string{"other.org.", "Example.com.lan."}, "Example.com.lan", true},
+		{[]string{"example.org."}, "", false},
+		{nil, "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := tracker.question(&dnsMessage{questions: tt.questions})
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("question(%v) = (%q, %v), want (%q, %v)", tt.questions, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// buildTCPFrame wraps payload in TCP, IPv4 and Ethernet headers
+func buildTCPFrame(srcIP, dstIP string, srcPort, dstPort uint16, seq uint32, flags byte, payload []byte) []byte {
+	tcp := []byte{byte(srcPort >> 8), byte(srcPort), byte(dstPort >> 8), byte(dstPort),
+		byte(seq >> 24), byte(seq >> 16), byte(seq >> 8), byte(seq), 0, 0, 0, 0, 0x50, flags, 0xff, 0xff, 0, 0, 0, 0}
+	tcp = append(tcp, payload...)
+
+	ipLen := ipHeaderMin + len(tcp)
+	ip := []byte{0x45, 0, byte(ipLen >> 8), byte(ipLen), 0, 0, 0, 0, 64, ipProtoTCP, 0, 0}
+	ip = append(ip, net.ParseIP(srcIP).To4()...)
+	ip = append(ip, net.ParseIP(dstIP).To4()...)
+	ip = append(ip, tcp...)
+
+	eth := make([]byte, 12, ethHeaderLen+len(ip))
+	eth = append(eth, byte(ethPIPv4>>8), byte(ethPIPv4&0xff))
+	return append(eth, ip...)
+}
+
+// tcpDNSPayload prefixes a DNS message with its two-byte TCP length
+func tcpDNSPayload(msg []byte) []byte {
+	return append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func TestDecodeTCP(t *testing.T) {
+	query := tcpDNSPayload(buildDNSPayload(7, false, "example.com"))
+	answer := tcpDNSPayload(buildDNSPayload(7, true, "example.com"))
+	frames := [][]byte{
+		buildTCPFrame("192.168.1.10", "192.168.1.1", 40000, 53, 999, tcpFlagSYN, nil),
+		buildTCPFrame("192.168.1.10", "192.168.1.1", 40000, 53, 1000, 0x18, query),
+		// The response is split across two segments
+		buildTCPFrame("192.168.1.1", "192.168.1.10", 53, 40000, 5000, 0x18, answer[:5]),
+		buildTCPFrame("192.168.1.1", "192.168.1.10", 53, 40000, 5005, 0x18, answer[5:]),
+	}
+
+	tests := []struct {
+		proto string
+		want  string
+		ok    bool
+	}{
+		{ProtoAny, "192.168.1.1", true},
+		{ProtoTCP, "192.168.1.1", true},
+		{ProtoUDP, "", false},
+	}
+
+	for _, tt := range tests {
+		decoder := newPacketDecoder(tt.proto, dnsPort)
+		tracker := newQueryTracker([]string{"example.com"}, dnsPort)
+		var got string
+		var ok bool
+		for _, frame := range frames {
+			for _, pkt := range decoder.decode(frame) {
+				var ip net.IP
+				if ip, ok = tracker.observe(pkt); ok {
+					got = ip.String()
+				}
+			}
+		}
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("proto %s: got (%q, %v), want (%q, %v)", tt.proto, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// A segment arriving out of order must not produce a message
+	decoder := newPacketDecoder(ProtoAny, dnsPort)
+	decoder.decode(buildTCPFrame("192.168.1.1", "192.168.1.10", 53, 40000, 5000, 0x18, answer[:5]))
+	if pkts := decoder.decode(buildTCPFrame("192.168.1.1", "192.168.1.10", 53, 40000, 5010, 0x18, answer[5:])); len(pkts) != 0 {
+		t.Errorf("Expected out-of-order segment to be dropped, got %d messages", len(pkts))
+	}
+}
+
+// fragmentFrame splits the IP payload of an IPv4 or IPv6 Ethernet frame from
+// buildUDPFrame or buildUDP6Frame into two fragments at split, a multiple of 8
+func fragmentFrame(frame []byte, id uint32, split int) [][]byte {
+	eth, ip := frame[:ethHeaderLen], frame[ethHeaderLen:]
+	headerLen := ipHeaderMin
+	if ip[0]>>4 == 6 {
+		headerLen = ip6HeaderLen
+	}
+	header, payload := ip[:headerLen], ip[headerLen:]
+
+	var frames [][]byte
+	for i, part := range [][]byte{payload[:split], payload[split:]} {
+		offset, more := 0, 1
+		if i == 1 {
+			offset, more = split, 0
+		}
+		frag := append([]byte{}, eth...)
+		if header[0]>>4 == 4 {
+			h := append([]byte{}, header...)
+			length := ipHeaderMin + len(part)
+			h[2], h[3] = byte(length>>8), byte(length)
+			h[4], h[5] = byte(id>>8), byte(id)
+			field := more<<13 | offset/8
+			h[6], h[7] = byte(field>>8), byte(field)
+			frag = append(append(frag, h...), part...)
+		} else {
+			h := append([]byte{}, header...)
+			length := ip6FragHeaderLen + len(part)
+			h[4], h[5], h[6] = byte(length>>8), byte(length), ip6Fragment
+			field := offset | more
+			frag = append(frag, h...)
+			frag = append(frag, header[6], 0, byte(field>>8), byte(field), byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+			frag = append(frag, part...)
+		}
+		frames = append(frames, frag)
+	}
+	return frames
+}
+
+func TestDecodeFragmented(t *testing.T) {
+	payload := buildDNSPayload(7, true, "example.com")
+	// Stand in for a large EDNS0 response with trailing bytes the parser ignores
+	payload = append(payload, make([]byte, 64)...)
+	for _, frame := range [][]byte{
+		buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, payload),
+		buildUDP6Frame("2001:db8::53", "2001:db8::10", 53, 40000, payload),
+	} {
+		frags := fragmentFrame(frame, 0x1234, 40)
+		// Fragments may arrive in either order
+		for _, order := range [][][]byte{{frags[0], frags[1]}, {frags[1], frags[0]}} {
+			decoder := newPacketDecoder(ProtoAny, dnsPort)
+			if pkts := decoder.decode(order[0]); len(pkts) != 0 {
+				t.Errorf("Expected nothing from a lone fragment, got %d messages", len(pkts))
+			}
+			pkts := decoder.decode(order[1])
+			if len(pkts) != 1 || pkts[0].msg.id != 7 || pkts[0].srcPort != 53 || pkts[0].dstPort != 40000 || pkts[0].ttl != 64 {
+				t.Fatalf("Expected the reassembled response, got %+v", pkts)
+			}
+			if len(decoder.fragments.datagrams) != 0 {
+				t.Errorf("Expected the datagram to be released, %d left", len(decoder.fragments.datagrams))
+			}
+		}
+
+		// An overlapping fragment drops the datagram
+		decoder := newPacketDecoder(ProtoAny, dnsPort)
+		decoder.decode(frags[0])
+		overlap := fragmentFrame(frame, 0x1234, 32)[1]
+		if pkts := decoder.decode(overlap); len(pkts) != 0 {
+			t.Errorf("Expected overlapping fragments to be dropped, got %d messages", len(pkts))
+		}
+		if pkts := decoder.decode(frags[1]); len(pkts) != 0 {
+			t.Errorf("Expected the dropped datagram not to complete, got %d messages", len(pkts))
+		}
+	}
+}
+
+func TestDescribeFrame(t *testing.T) {
+	tests := []struct {
+		frame []byte
+		want  string
+	}{
+		{buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, nil), "UDP 192.168.1.1:53 -> 192.168.1.10:40000"},
+		{buildUDP6Frame("2001:db8::1", "2001:db8::2", 40000, 53, nil), "UDP [2001:db8::1]:40000 -> [2001:db8::2]:53"},
+		{make([]byte, ethHeaderLen), "not an IP frame"},
+	}
+	for _, tt := range tests {
+		if got := describeFrame(tt.frame); got != tt.want {
+			t.Errorf("describeFrame() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestFrameMAC(t *testing.T) {
+	frame := buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, buildDNSPayload(7, true, "example.com"))
+	if mac := frameMAC(frame, ethSrcOffset); mac != nil {
+		t.Errorf("Expected no MAC for an all-zero address, as on loopback, got %v", mac)
+	}
+
+	copy(frame[ethSrcOffset:], []byte{0x52, 0x54, 0x00, 0x12, 0x34, 0x56})
+	if mac := frameMAC(frame, ethSrcOffset); mac.String() != "52:54:00:12:34:56" {
+		t.Errorf("Expected source MAC 52:54:00:12:34:56, got %v", mac)
+	}
+	if mac := frameMAC(frame[:ethHeaderLen-1], ethSrcOffset); mac != nil {
+		t.Errorf("Expected no MAC for a truncated frame, got %v", mac)
+	}
+}
+
+func TestIPTTL(t *testing.T) {
+	v4, _ := parseEthernetFrame(buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, nil))
+	v4[ipTTLOffset] = 57
+	v6, _ := parseEthernetFrame(buildUDP6Frame("2001:db8::1", "2001:db8::10", 53, 40000, nil))
+	v6[ip6HopLimitOffset] = 120
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   int
+	}{
+		{"ipv4", v4, 57},
+		{"ipv6", v6, 120},
+		{"truncated", v4[:10], 0},
+		{"empty", nil, 0},
+	}
+	for _, tt := range tests {
+		if got := ipTTL(tt.packet); got != tt.want {
+			t.Errorf("%s: ipTTL() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
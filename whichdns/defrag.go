@@ -0,0 +1,245 @@
+package whichdns
+
+import (
+	"fmt"
+	"net"
+)
+
+// IPv4 header fields used to reassemble fragments
+const (
+	ipIDOffset       = 4      // Identification
+	ipFlagsOffset    = 6      // Flags and fragment offset
+	ipFlagMF         = 0x2000 // More Fragments flag
+	ipFragOffsetMask = 0x1FFF // Fragment offset in 8-byte units
+)
+
+// ip6FragHeaderLen is the length of the IPv6 Fragment extension header
+const ip6FragHeaderLen = 8
+
+// fragMaxDatagrams bounds the datagrams reassembled at once; the oldest is
+// dropped to make room, so fragments that never complete cannot pile up
+const fragMaxDatagrams = 64
+
+// fragMaxLen bounds a reassembled datagram's payload: the largest an IP
+// length field allows
+const fragMaxLen = 65535
+
+// fragment is the payload of one fragment and where it goes in the datagram
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+// ipDatagram collects the fragments of one fragmented IP datagram
+type ipDatagram struct {
+	seq       int    // Order of arrival of the first fragment, for eviction
+	header    []byte // IP header of the first fragment, once seen
+	fragments []fragment
+	received  int // Payload bytes received so far
+	total     int // Payload length, known once the last fragment arrives
+}
+
+// ipFragments reassembles fragmented IPv4 and IPv6 datagrams, e.g. large
+// EDNS0 responses over UDP, so they can be decoded like any other packet
+type ipFragments struct {
+	datagrams map[string]*ipDatagram
+	seq       int
+}
+
+// newIPFragments creates an empty reassembly table
+func newIPFragments() *ipFragments {
+	return &ipFragments{datagrams: make(map[string]*ipDatagram)}
+}
+
+// add returns the IP packet to decode for ipPacket: ipPacket itself unless it
+// is a fragment, or the reassembled datagram once its last missing fragment
+// arrives. It returns false while fragments are outstanding or when they
+// cannot be reassembled.
+func (f *ipFragments) add(ipPacket []byte) ([]byte, bool) {
+	if len(ipPacket) < 1 {
+		return nil, false
+	}
+	switch ipPacket[0] >> 4 {
+	case 4:
+		return f.addIPv4(ipPacket)
+	case 6:
+		return f.addIPv6(ipPacket)
+	}
+	return ipPacket, true
+}
+
+// addIPv4 feeds an IPv4 packet into its datagram if it is a fragment
+func (f *ipFragments) addIPv4(ipPacket []byte) ([]byte, bool) {
+	if len(ipPacket) < ipHeaderMin {
+		return ipPacket, true
+	}
+	field := int(ipPacket[ipFlagsOffset])<<8 | int(ipPacket[ipFlagsOffset+1])
+	if field&(ipFlagMF|ipFragOffsetMask) == 0 {
+		return ipPacket, true
+	}
+
+	headerLen := int(ipPacket[0]&0x0F) * 4
+	totalLen := int(ipPacket[2])<<8 | int(ipPacket[3])
+	if headerLen < ipHeaderMin || totalLen < headerLen || totalLen > len(ipPacket) {
+		return nil, false
+	}
+	srcIP := net.IP(ipPacket[ipSrcOffset : ipSrcOffset+4])
+	dstIP := net.IP(ipPacket[ipSrcOffset+4 : ipSrcOffset+8])
+	key := fmt.Sprintf("%v>%v/%d/%d", srcIP, dstIP, ipPacket[9], int(ipPacket[ipIDOffset])<<8|int(ipPacket[ipIDOffset+1]))
+
+	var header []byte
+	if field&ipFragOffsetMask == 0 {
+		header = ipPacket[:headerLen]
+	}
+	d, ok := f.fragment(key, header, (field&ipFragOffsetMask)*8, ipPacket[headerLen:totalLen], field&ipFlagMF == 0)
+	if !ok {
+		return nil, false
+	}
+
+	// The first fragment's header, unfragmented, with the full length
+	payload := d.payload()
+	packet := make([]byte, 0, len(d.header)+len(payload))
+	packet = append(packet, d.header...)
+	packet = append(packet, payload...)
+	length := len(packet)
+	packet[2], packet[3] = byte(length>>8), byte(length)
+	packet[ipFlagsOffset] &^= byte((ipFlagMF | ipFragOffsetMask) >> 8)
+	packet[ipFlagsOffset+1] = 0
+	return packet, true
+}
+
+// addIPv6 feeds an IPv6 packet into its datagram if it carries a Fragment header
+func (f *ipFragments) addIPv6(ipPacket []byte) ([]byte, bool) {
+	if len(ipPacket) < ip6HeaderLen {
+		return ipPacket, true
+	}
+	// Trim Ethernet padding so the last fragment's length is exact
+	if end := ip6HeaderLen + (int(ipPacket[4])<<8 | int(ipPacket[5])); end < len(ipPacket) {
+		ipPacket = ipPacket[:end]
+	}
+	offset, ok := ip6FragmentOffset(ipPacket)
+	if !ok {
+		return ipPacket, true
+	}
+	if len(ipPacket) < offset+ip6FragHeaderLen {
+		return nil, false
+	}
+
+	frag := ipPacket[offset : offset+ip6FragHeaderLen]
+	field := int(frag[2])<<8 | int(frag[3])
+	fragOffset := field &^ 0x7 // 8-byte units above the reserved bits and M flag
+	srcIP := net.IP(ipPacket[ip6SrcOffset : ip6SrcOffset+16])
+	dstIP := net.IP(ipPacket[ip6SrcOffset+16 : ip6SrcOffset+32])
+	key := fmt.Sprintf("%v>%v/%d", srcIP, dstIP, uint32(frag[4])<<24|uint32(frag[5])<<16|uint32(frag[6])<<8|uint32(frag[7]))
+
+	var header []byte
+	if fragOffset == 0 {
+		// Keep the fixed header only, followed directly by the fragmented
+		// protocol: extension headers are not needed to decode the transport
+		header = append([]byte(nil), ipPacket[:ip6HeaderLen]...)
+		header[6] = frag[0]
+	}
+	d, ok := f.fragment(key, header, fragOffset, ipPacket[offset+ip6FragHeaderLen:], field&0x1 == 0)
+	if !ok {
+		return nil, false
+	}
+
+	payload := d.payload()
+	packet := make([]byte, 0, ip6HeaderLen+len(payload))
+	packet = append(packet, d.header...)
+	packet = append(packet, payload...)
+	packet[4], packet[5] = byte(len(payload)>>8), byte(len(payload))
+	return packet, true
+}
+
+// ip6FragmentOffset returns the offset of the Fragment header of an IPv6
+// packet, skipping the extension headers in front of it
+func ip6FragmentOffset(ipPacket []byte) (int, bool) {
+	nextHeader := ipPacket[6]
+	offset := ip6HeaderLen
+	for {
+		switch nextHeader {
+		case ip6Fragment:
+			return offset, true
+		case ip6HopByHop, ip6Routing, ip6DestOpts:
+			if len(ipPacket) < offset+2 {
+				return 0, false
+			}
+			nextHeader = ipPacket[offset]
+			offset += (int(ipPacket[offset+1]) + 1) * 8
+		default:
+			return 0, false
+		}
+	}
+}
+
+// fragment adds the payload of a fragment at offset to the datagram key,
+// with the header to rebuild it from if this is the first fragment, and
+// returns the datagram, reporting whether it is now complete. Overlapping
+// fragments drop the datagram, as RFC 5722 requires for IPv6.
+func (f *ipFragments) fragment(key string, header []byte, offset int, data []byte, last bool) (*ipDatagram, bool) {
+	d, ok := f.datagrams[key]
+	if !ok {
+		if len(f.datagrams) >= fragMaxDatagrams {
+			f.evict()
+		}
+		f.seq++
+		d = &ipDatagram{seq: f.seq}
+		f.datagrams[key] = d
+	}
+
+	end := offset + len(data)
+	if end > fragMaxLen || (d.total > 0 && (end > d.total || (last && end != d.total))) {
+		debugf("Dropping IP datagram %s: fragment at %d-%d is out of bounds", key, offset, end)
+		delete(f.datagrams, key)
+		return nil, false
+	}
+	for _, other := range d.fragments {
+		otherEnd := other.offset + len(other.data)
+		if last && otherEnd > end {
+			debugf("Dropping IP datagram %s: fragment at %d-%d lies past the last one", key, other.offset, otherEnd)
+			delete(f.datagrams, key)
+			return nil, false
+		}
+		if offset < otherEnd && other.offset < end {
+			debugf("Dropping IP datagram %s: fragment at %d-%d overlaps another", key, offset, end)
+			delete(f.datagrams, key)
+			return nil, false
+		}
+	}
+
+	d.fragments = append(d.fragments, fragment{offset: offset, data: append([]byte(nil), data...)})
+	d.received += len(data)
+	if header != nil {
+		d.header = append([]byte(nil), header...)
+	}
+	if last {
+		d.total = end
+	}
+	if d.header == nil || d.total == 0 || d.received != d.total {
+		return d, false
+	}
+	delete(f.datagrams, key)
+	return d, true
+}
+
+// evict drops the datagram whose first fragment arrived earliest
+func (f *ipFragments) evict() {
+	var oldest string
+	for key, d := range f.datagrams {
+		if oldest == "" || d.seq < f.datagrams[oldest].seq {
+			oldest = key
+		}
+	}
+	debugf("Dropping incomplete IP datagram %s to make room", oldest)
+	delete(f.datagrams, oldest)
+}
+
+// payload returns the reassembled payload of a complete datagram
+func (d *ipDatagram) payload() []byte {
+	payload := make([]byte, d.total)
+	for _, frag := range d.fragments {
+		copy(payload[frag.offset:], frag.data)
+	}
+	return payload
+}
@@ -0,0 +1,58 @@
+package whichdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Hostname limits from RFC 1035
+const (
+	maxDomainLen = 253 // Longest name in text form, without the trailing dot
+	maxLabelLen  = 63  // Longest label between dots
+)
+
+// ErrIPAddress is returned by ValidateDomain for an IP literal, which needs no
+// DNS lookup and so cannot reveal the DNS server
+var ErrIPAddress = errors.New("is an IP address, so no DNS lookup is needed")
+
+// ValidateDomain reports whether name is a syntactically valid hostname that
+// can be looked up: at most 253 characters in labels of 1 to 63 letters,
+// digits, hyphens or underscores, none starting or ending with a hyphen. A
+// single trailing dot is allowed.
+func ValidateDomain(name string) error {
+	if name == "" {
+		return errors.New("domain is empty")
+	}
+	if net.ParseIP(strings.Trim(name, "[]")) != nil {
+		return fmt.Errorf("%s %w", name, ErrIPAddress)
+	}
+	trimmed := strings.TrimSuffix(name, ".")
+	if len(trimmed) > maxDomainLen {
+		return fmt.Errorf("domain %.20q... is %d characters long, more than %d", name, len(trimmed), maxDomainLen)
+	}
+	for _, label := range strings.Split(trimmed, ".") {
+		if label == "" {
+			return fmt.Errorf("domain %q has an empty label", name)
+		}
+		if len(label) > maxLabelLen {
+			return fmt.Errorf("domain %q has a label of %d characters, more than %d", name, len(label), maxLabelLen)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("domain %q has a label starting or ending with a hyphen", name)
+		}
+		for _, c := range label {
+			if !isHostnameChar(c) {
+				return fmt.Errorf("domain %q contains the invalid character %q", name, c)
+			}
+		}
+	}
+	return nil
+}
+
+// isHostnameChar reports whether c may appear in a hostname label. Underscores
+// are not valid in hostnames but are common in service names, so they pass.
+func isHostnameChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
@@ -0,0 +1,42 @@
+package whichdns
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateDomain(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"example.com", true},
+		{"example.com.", true},
+		{"localhost", true},
+		{"_dmarc.example.com", true},
+		{"xn--bcher-kva.example", true},
+		{strings.Repeat("a", 63) + ".com", true},
+		{"", false},
+		{"exa mple.com", false},
+		{"example..com", false},
+		{".example.com", false},
+		{"-example.com", false},
+		{"example-.com", false},
+		{"exam!ple.com", false},
+		{strings.Repeat("a", 64) + ".com", false},
+		{strings.Repeat("abcdefghi.", 26) + "com", false},
+	}
+	for _, tt := range tests {
+		err := ValidateDomain(tt.name)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidateDomain(%q) = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1", "[2001:db8::1]"} {
+		if err := ValidateDomain(ip); !errors.Is(err, ErrIPAddress) {
+			t.Errorf("ValidateDomain(%q) = %v, want ErrIPAddress", ip, err)
+		}
+	}
+}
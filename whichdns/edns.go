@@ -0,0 +1,179 @@
+package whichdns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EDNS0 constants
+const (
+	dnsTypeA          = 1               // Resource record type: A
+	dnsTypeOPT        = 41              // Resource record type: EDNS0 OPT pseudo-record
+	dnsClassIN        = 1               // Resource record class: Internet
+	dnsFlagRD         = 0x0100          // DNS header flag: recursion desired
+	ednsFlagDO        = 0x8000          // EDNS0 flag: DNSSEC OK
+	ednsBufferSize    = 4096            // UDP payload size advertised in our queries
+	ednsLookupTimeout = 2 * time.Second // How long each nameserver gets to answer
+)
+
+// EDNS describes the EDNS0 OPT pseudo-record of a DNS response
+type EDNS struct {
+	// PayloadSize is the largest UDP payload the server accepts
+	PayloadSize uint16
+	// Version is the EDNS version, 0 for EDNS0
+	Version uint8
+	// DO reports the DNSSEC OK flag
+	DO bool
+	// Flags holds every EDNS flag bit, DO included
+	Flags uint16
+}
+
+// DNSSEC holds the flags of a query and its response that show whether the
+// server validates DNSSEC
+type DNSSEC struct {
+	// QueryDO reports that the query asked for DNSSEC records (the DO bit)
+	QueryDO bool
+	// AD reports that the server marked the answer as validated (Authenticated Data)
+	AD bool
+	// TC reports that the response was truncated
+	TC bool
+}
+
+// buildEDNSQuery encodes a recursive query of type qtype for name with the
+// given ID and an OPT record advertising ednsBufferSize, setting the DO flag if
+// do is set
+func buildEDNSQuery(id uint16, name string, qtype uint16, do bool) []byte {
+	msg := make([]byte, dnsHeaderLen, dnsHeaderLen+len(name)+17)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], dnsFlagRD)
+	binary.BigEndian.PutUint16(msg[4:6], 1)   // One question
+	binary.BigEndian.PutUint16(msg[10:12], 1) // One additional record: the OPT
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	// OPT: root name, the payload size in place of the class, then extended
+	// rcode, version and flags in place of the TTL, and no options
+	var flags uint16
+	if do {
+		flags = ednsFlagDO
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeOPT)
+	msg = binary.BigEndian.AppendUint16(msg, ednsBufferSize)
+	msg = append(msg, 0, 0)
+	msg = binary.BigEndian.AppendUint16(msg, flags)
+	return binary.BigEndian.AppendUint16(msg, 0)
+}
+
+// parseOPT looks for an OPT record among the count resource records starting
+// at offset, returning nil if there is none or the records are malformed
+func parseOPT(data []byte, offset, count int) *EDNS {
+	for i := 0; i < count; i++ {
+		// NAME, then TYPE, CLASS, TTL and RDLENGTH
+		_, next, ok := readDNSName(data, offset)
+		if !ok || next+10 > len(data) {
+			return nil
+		}
+		rrType := binary.BigEndian.Uint16(data[next : next+2])
+		rdLen := int(binary.BigEndian.Uint16(data[next+8 : next+10]))
+		if next+10+rdLen > len(data) {
+			return nil
+		}
+		if rrType == dnsTypeOPT {
+			flags := binary.BigEndian.Uint16(data[next+6 : next+8])
+			return &EDNS{
+				PayloadSize: binary.BigEndian.Uint16(data[next+2 : next+4]),
+				Version:     data[next+5],
+				DO:          flags&ednsFlagDO != 0,
+				Flags:       flags,
+			}
+		}
+		offset = next + 10 + rdLen
+	}
+	return nil
+}
+
+// ednsLookup sends an EDNS0 query for name of the record type opts.Type to
+// opts.Resolver, or else to each nameserver in /etc/resolv.conf in turn, from
+// opts.Source if it is set, until one answers. The DO bit is set with
+// opts.DNSSEC. Any answer will do, whatever its response code: the point is
+// the traffic.
+func ednsLookup(ctx context.Context, name string, opts Options) error {
+	servers, port := []net.IP{opts.Resolver}, opts.Port
+	if opts.Resolver == nil {
+		var err error
+		if servers, err = ConfiguredNameservers(DefaultResolvConf); err != nil {
+			return err
+		}
+		if len(servers) == 0 {
+			return fmt.Errorf("no nameservers configured in %s", DefaultResolvConf)
+		}
+		port = dnsPort
+	}
+
+	var errs []error
+	for _, server := range servers {
+		err := ednsQuery(ctx, server, port, name, queryType(opts.Type), opts.Source, opts.DNSSEC)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		debugf("EDNS0 query to %v failed: %v", server, err)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ednsQuery sends one EDNS0 query for name to server and waits for its answer
+func ednsQuery(ctx context.Context, server net.IP, port int, name string, qtype uint16, source net.IP, do bool) error {
+	ctx, cancel := context.WithTimeout(ctx, ednsLookupTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	if source != nil {
+		dialer.LocalAddr = &net.UDPAddr{IP: source}
+	}
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(server.String(), strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("failed to query %v: %w", server, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var idBytes [2]byte
+	rand.Read(idBytes[:])
+	id := binary.BigEndian.Uint16(idBytes[:])
+	debugf("Sending EDNS0 query for %v to %v with ID %#04x", name, server, id)
+	if _, err := conn.Write(buildEDNSQuery(id, name, qtype, do)); err != nil {
+		return fmt.Errorf("failed to query %v: %w", server, err)
+	}
+
+	buf := make([]byte, ednsBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("no answer from %v: %w", server, err)
+		}
+		msg, ok := parseDNSMessage(buf[:n])
+		if ok && msg.response && msg.id == id {
+			return nil
+		}
+		debugf("Skipping unexpected packet from %v", server)
+	}
+}
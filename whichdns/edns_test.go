@@ -0,0 +1,102 @@
+package whichdns
+
+import (
+	"testing"
+)
+
+// buildEDNSResponse answers an A query for name with one answer record and,
+// if payload is not zero, an OPT record with that payload size and flags
+func buildEDNSResponse(id uint16, name string, payload, flags uint16) []byte {
+	resp := buildDNSPayload(id, true, name)
+	resp[7] = 1 // One answer
+	resp = append(resp, 0xC0, dnsHeaderLen, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0x0E, 0x10, 0, 4, 93, 184, 216, 34)
+	if payload != 0 {
+		resp[11] = 1 // One additional record
+		resp = append(resp, 0, 0, dnsTypeOPT, byte(payload>>8), byte(payload), 0, 0, byte(flags>>8), byte(flags), 0, 0)
+	}
+	return resp
+}
+
+func TestBuildEDNSQuery(t *testing.T) {
+	for _, do := range []bool{false, true} {
+		query := buildEDNSQuery(0xBEEF, "example.com.", dnsTypeA, do)
+		msg, ok := parseDNSMessage(query)
+		if !ok {
+			t.Fatalf("Failed to parse query")
+		}
+		if msg.id != 0xBEEF || msg.response || len(msg.questions) != 1 || msg.questions[0] != "example.com" {
+			t.Errorf("Unexpected query header or question: %+v", msg)
+		}
+		if msg.edns == nil || msg.edns.PayloadSize != ednsBufferSize || msg.edns.DO != do {
+			t.Errorf("Expected an OPT record advertising %d bytes with DO %v, got %+v", ednsBufferSize, do, msg.edns)
+		}
+	}
+}
+
+func TestParseOPT(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		want  *EDNS
+		valid bool
+	}{
+		{"edns0", buildEDNSResponse(1, "example.com", 1232, 0), &EDNS{PayloadSize: 1232}, true},
+		{"dnssec ok", buildEDNSResponse(1, "example.com", 4096, ednsFlagDO), &EDNS{PayloadSize: 4096, DO: true, Flags: ednsFlagDO}, true},
+		{"no opt", buildEDNSResponse(1, "example.com", 0, 0), nil, true},
+		{"truncated opt", buildEDNSResponse(1, "example.com", 1232, 0)[:50], nil, true},
+	}
+
+	for _, tt := range tests {
+		msg, ok := parseDNSMessage(tt.data)
+		if ok != tt.valid {
+			t.Errorf("%s: parseDNSMessage ok = %v, want %v", tt.name, ok, tt.valid)
+			continue
+		}
+		switch {
+		case tt.want == nil && msg.edns != nil:
+			t.Errorf("%s: expected no OPT record, got %+v", tt.name, msg.edns)
+		case tt.want != nil && (msg.edns == nil || *msg.edns != *tt.want):
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.want, msg.edns)
+		}
+	}
+}
+
+func TestQueryTrackerDNSSEC(t *testing.T) {
+	tests := []struct {
+		name  string
+		do    bool
+		flags byte // Second flags byte of the response
+		want  DNSSEC
+	}{
+		{"validated", true, 0x20, DNSSEC{QueryDO: true, AD: true}},
+		{"not validated", true, 0, DNSSEC{QueryDO: true}},
+		{"truncated without do", false, 0, DNSSEC{TC: true}},
+	}
+
+	for _, tt := range tests {
+		resp := buildEDNSResponse(9, "example.com", 1232, 0)
+		resp[3] |= tt.flags
+		if tt.want.TC {
+			resp[2] |= 0x02
+		}
+		frames := [][]byte{
+			buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildEDNSQuery(9, "example.com", dnsTypeA, tt.do)),
+			buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, resp),
+		}
+
+		tracker := newQueryTracker([]string{"example.com"}, dnsPort)
+		decoder := newPacketDecoder(ProtoAny, dnsPort)
+		var got DNSSEC
+		var matched bool
+		for _, frame := range frames {
+			for _, pkt := range decoder.decode(frame) {
+				if _, ok := tracker.observe(pkt); ok {
+					got, matched = tracker.dnssec(pkt), true
+				}
+			}
+		}
+		if !matched || got != tt.want {
+			t.Errorf("%s: got %+v (matched %v), want %+v", tt.name, got, matched, tt.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package whichdns
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// Address directions a filter term can be restricted to
+const (
+	filterAny = iota // Source or destination
+	filterSrc        // Source only
+	filterDst        // Destination only
+)
+
+// filterTerm matches packets whose source and/or destination lies in a network
+type filterTerm struct {
+	negate  bool
+	dir     int
+	network *net.IPNet
+}
+
+// packetFilter keeps the packets matching every one of its terms. It is
+// applied in userspace before decoding, in place of a kernel BPF program.
+type packetFilter struct {
+	terms []filterTerm
+	// local, if set, also requires the source or destination to be one of
+	// these single-address networks: the host's own addresses
+	local []*net.IPNet
+}
+
+// ValidateFilter reports whether expr is a valid Options.Filter expression
+func ValidateFilter(expr string) error {
+	_, err := parseFilter(expr)
+	return err
+}
+
+// parseFilter compiles a filter expression: terms such as "host 10.0.0.1",
+// "src net 192.168.0.0/16" or "not dst host 8.8.8.8" joined with "and". An
+// empty expression yields a nil filter, which keeps every packet.
+func parseFilter(expr string) (*packetFilter, error) {
+	words := strings.Fields(strings.ToLower(expr))
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	filter := &packetFilter{}
+	for len(words) > 0 {
+		var term filterTerm
+		if words[0] == "not" || words[0] == "!" {
+			term.negate = true
+			words = words[1:]
+		}
+		if len(words) > 0 && (words[0] == "src" || words[0] == "dst") {
+			term.dir = filterSrc
+			if words[0] == "dst" {
+				term.dir = filterDst
+			}
+			words = words[1:]
+		}
+		if len(words) < 2 {
+			return nil, fmt.Errorf("invalid filter %q: expected \"host <ip>\" or \"net <cidr>\"", expr)
+		}
+
+		switch words[0] {
+		case "host":
+			ip := net.ParseIP(words[1])
+			if ip == nil {
+				return nil, fmt.Errorf("invalid filter %q: %q is not an IP address", expr, words[1])
+			}
+			term.network = hostNetwork(ip)
+		case "net":
+			_, network, err := net.ParseCIDR(words[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter %q: %q is not a network in CIDR notation", expr, words[1])
+			}
+			term.network = network
+		default:
+			return nil, fmt.Errorf("invalid filter %q: unsupported primitive %q (use host or net)", expr, words[0])
+		}
+		filter.terms = append(filter.terms, term)
+		words = words[2:]
+
+		if len(words) > 0 {
+			if words[0] != "and" && words[0] != "&&" {
+				return nil, fmt.Errorf("invalid filter %q: expected \"and\" before %q", expr, words[0])
+			}
+			words = words[1:]
+			if len(words) == 0 {
+				return nil, fmt.Errorf("invalid filter %q: dangling \"and\"", expr)
+			}
+		}
+	}
+	return filter, nil
+}
+
+// hostNetwork returns the single-address network holding ip
+func hostNetwork(ip net.IP) *net.IPNet {
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// match reports whether frame is an IP packet accepted by every term. Only
+// the IP header is looked at, so fragments and ICMP errors about the DNS
+// traffic are kept as well for the decoder to handle.
+func (f *packetFilter) match(frame []byte) bool {
+	if f == nil {
+		return true
+	}
+	ipPacket, ok := parseEthernetFrame(frame)
+	if !ok {
+		return false
+	}
+	srcIP, dstIP, ok := ipAddresses(ipPacket)
+	if !ok {
+		return false
+	}
+
+	for _, term := range f.terms {
+		var hit bool
+		switch term.dir {
+		case filterSrc:
+			hit = term.network.Contains(srcIP)
+		case filterDst:
+			hit = term.network.Contains(dstIP)
+		default:
+			hit = term.network.Contains(srcIP) || term.network.Contains(dstIP)
+		}
+		if hit == term.negate {
+			return false
+		}
+	}
+	if len(f.local) > 0 && !slices.ContainsFunc(f.local, func(n *net.IPNet) bool { return n.Contains(srcIP) || n.Contains(dstIP) }) {
+		return false
+	}
+	return true
+}
+
+// ipAddresses returns the source and destination addresses from the fixed
+// header of an IPv4 or IPv6 packet, whatever it carries: a fragment after the
+// first or an ICMP error has no UDP or TCP header to parse
+func ipAddresses(ipPacket []byte) (net.IP, net.IP, bool) {
+	switch {
+	case len(ipPacket) >= ipHeaderMin && ipPacket[0]>>4 == 4:
+		return net.IP(ipPacket[ipSrcOffset : ipSrcOffset+4]), net.IP(ipPacket[ipSrcOffset+4 : ipSrcOffset+8]), true
+	case len(ipPacket) >= ip6HeaderLen && ipPacket[0]>>4 == 6:
+		return net.IP(ipPacket[ip6SrcOffset : ip6SrcOffset+16]), net.IP(ipPacket[ip6SrcOffset+16 : ip6SrcOffset+32]), true
+	}
+	return nil, nil, false
+}
+
+// localAddresses returns the addresses of ifaces as single-address networks,
+// skipping an interface whose addresses cannot be listed
+func localAddresses(ifaces []net.Interface) []*net.IPNet {
+	var local []*net.IPNet
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			debugf("Could not get addresses for interface %v: %v", ifaces[i].Name, err)
+			continue
+		}
+		for _, addr := range addrs {
+			if ip := addrIP(addr); ip != nil {
+				local = append(local, hostNetwork(ip))
+			}
+		}
+	}
+	return local
+}
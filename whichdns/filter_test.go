@@ -0,0 +1,84 @@
+package whichdns
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestPacketFilter(t *testing.T) {
+	query := buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(1, false, "example.com"))
+	query6 := buildUDP6Frame("2001:db8::10", "2001:db8::1", 40000, 53, buildDNSPayload(1, false, "example.com"))
+
+	tests := []struct {
+		expr  string
+		frame []byte
+		want  bool
+	}{
+		{"", query, true},
+		{"host 192.168.1.1", query, true},
+		{"host 10.0.0.1", query, false},
+		{"net 192.168.0.0/16", query, true},
+		{"src net 192.168.1.0/24 and dst host 192.168.1.1", query, true},
+		{"dst host 192.168.1.10", query, false},
+		{"not host 192.168.1.1", query, false},
+		{"net 192.168.0.0/16 and not host 192.168.1.99", query, true},
+		{"host 2001:db8::1", query6, true},
+		{"net 192.168.0.0/16", query6, false},
+	}
+
+	for _, tt := range tests {
+		filter, err := parseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.expr, err)
+			continue
+		}
+		if got := filter.match(tt.frame); got != tt.want {
+			t.Errorf("%q: match = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestPacketFilterLocal(t *testing.T) {
+	query := buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(1, false, "example.com"))
+	response := buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, buildDNSPayload(1, true, "example.com"))
+	other := buildUDPFrame("192.168.1.1", "192.168.1.20", 53, 40000, buildDNSPayload(1, true, "example.com"))
+
+	filter := &packetFilter{local: []*net.IPNet{hostNetwork(net.ParseIP("192.168.1.10")), hostNetwork(net.ParseIP("2001:db8::10"))}}
+	if !filter.match(query) || !filter.match(response) {
+		t.Error("Expected this host's query and response to be kept")
+	}
+	if filter.match(other) {
+		t.Error("Expected a response to another host to be dropped")
+	}
+
+	// ICMP errors and trailing fragments carry no UDP header but are kept
+	// on their IP addresses alone
+	payload := append(buildDNSPayload(1, true, "example.com"), make([]byte, 64)...)
+	frags := fragmentFrame(buildUDP6Frame("2001:db8::53", "2001:db8::10", 53, 40000, payload), 1, 40)
+	icmp := buildICMPFrame("192.168.1.1", "192.168.1.10", 3, query)
+	if !filter.match(frags[1]) || !filter.match(icmp) {
+		t.Error("Expected a trailing fragment and an ICMP error to this host to be kept")
+	}
+	if filter.match(buildICMPFrame("192.168.1.1", "192.168.1.20", 3, query)) {
+		t.Error("Expected an ICMP error to another host to be dropped")
+	}
+
+	// The addresses of loopback include 127.0.0.1
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("No loopback interface here: %v", err)
+	}
+	local := localAddresses([]net.Interface{*lo})
+	if !slices.ContainsFunc(local, func(n *net.IPNet) bool { return n.Contains(net.IPv4(127, 0, 0, 1)) }) {
+		t.Errorf("Expected 127.0.0.1 among the loopback addresses, got %v", local)
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{"port 53", "host", "host example.com", "net 10.0.0.0", "host 10.0.0.1 or host 10.0.0.2", "host 10.0.0.1 and"} {
+		if _, err := parseFilter(expr); err == nil {
+			t.Errorf("Expected filter %q to be rejected", expr)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package whichdns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// version.bind query constants
+const (
+	dnsTypeTXT       = 16             // Resource record type: TXT
+	dnsClassCHAOS    = 3              // Resource record class: CHAOS
+	dnsRcodeMask     = 0x000F         // DNS header flags: response code
+	versionQueryName = "version.bind" // Name queried for the server version
+	versionMaxLen    = 4096           // Largest version.bind response read
+)
+
+var (
+	// ErrNoVersion is returned by ServerVersion when the server does not reveal its software
+	ErrNoVersion = errors.New("no version reported")
+	// errWrongID marks a response to some other query
+	errWrongID = errors.New("response ID does not match the query")
+)
+
+// dnsRcodeNames names the response codes servers commonly use to decline a version.bind query
+var dnsRcodeNames = map[int]string{
+	1: "format error",
+	2: "server failure",
+	3: "no such name",
+	4: "not implemented",
+	5: "refused",
+}
+
+// ServerVersion sends a version.bind CHAOS TXT query straight to the DNS
+// server at ip and port and returns the version string it reports, such as
+// "9.18.1-1ubuntu1". Servers that refuse, ignore or answer without a TXT record
+// yield an error wrapping ErrNoVersion that says why.
+func ServerVersion(ctx context.Context, ip net.IP, port int, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		return "", fmt.Errorf("failed to query %v: %w", ip, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var idBytes [2]byte
+	rand.Read(idBytes[:])
+	id := binary.BigEndian.Uint16(idBytes[:])
+	debugf("Sending version.bind query to %v with ID %#04x", ip, id)
+	if _, err := conn.Write(buildVersionQuery(id)); err != nil {
+		return "", fmt.Errorf("failed to query %v: %w", ip, err)
+	}
+
+	buf := make([]byte, versionMaxLen)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return "", fmt.Errorf("%w: no answer", ErrNoVersion)
+			}
+			return "", fmt.Errorf("failed to read version from %v: %w", ip, err)
+		}
+		version, err := parseVersionResponse(id, buf[:n])
+		if errors.Is(err, errWrongID) {
+			debugf("Skipping version.bind response with unexpected ID")
+			continue
+		}
+		return version, err
+	}
+}
+
+// buildVersionQuery encodes a version.bind CHAOS TXT query with the given ID
+func buildVersionQuery(id uint16) []byte {
+	msg := make([]byte, dnsHeaderLen, dnsHeaderLen+len(versionQueryName)+6)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[4:6], 1) // One question, recursion not desired
+	for _, label := range strings.Split(versionQueryName, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeTXT)
+	return binary.BigEndian.AppendUint16(msg, dnsClassCHAOS)
+}
+
+// parseVersionResponse returns the first TXT string in a version.bind response
+// to the query with the given ID
+func parseVersionResponse(id uint16, data []byte) (string, error) {
+	if len(data) < dnsHeaderLen {
+		return "", fmt.Errorf("%w: truncated response", ErrNoVersion)
+	}
+	if binary.BigEndian.Uint16(data[0:2]) != id {
+		return "", errWrongID
+	}
+	flags := binary.BigEndian.Uint16(data[2:4])
+	if flags&dnsFlagQR == 0 {
+		return "", errWrongID
+	}
+	if rcode := int(flags & dnsRcodeMask); rcode != 0 {
+		name, ok := dnsRcodeNames[rcode]
+		if !ok {
+			name = fmt.Sprintf("rcode %d", rcode)
+		}
+		return "", fmt.Errorf("%w: %s", ErrNoVersion, name)
+	}
+
+	qdCount := int(binary.BigEndian.Uint16(data[4:6]))
+	anCount := int(binary.BigEndian.Uint16(data[6:8]))
+	offset := dnsHeaderLen
+	for i := 0; i < qdCount; i++ {
+		_, next, ok := readDNSName(data, offset)
+		if !ok || next+4 > len(data) {
+			return "", fmt.Errorf("%w: malformed response", ErrNoVersion)
+		}
+		offset = next + 4
+	}
+
+	for i := 0; i < anCount; i++ {
+		// NAME, then TYPE, CLASS, TTL and RDLENGTH
+		_, next, ok := readDNSName(data, offset)
+		if !ok || next+10 > len(data) {
+			return "", fmt.Errorf("%w: malformed response", ErrNoVersion)
+		}
+		rrType := binary.BigEndian.Uint16(data[next : next+2])
+		rdLen := int(binary.BigEndian.Uint16(data[next+8 : next+10]))
+		rdata := next + 10
+		if rdata+rdLen > len(data) {
+			return "", fmt.Errorf("%w: malformed response", ErrNoVersion)
+		}
+		if rrType == dnsTypeTXT && rdLen > 0 {
+			// The first character-string of the TXT record
+			n := int(data[rdata])
+			if 1+n <= rdLen {
+				return string(data[rdata+1 : rdata+1+n]), nil
+			}
+		}
+		offset = rdata + rdLen
+	}
+	return "", fmt.Errorf("%w: empty answer", ErrNoVersion)
+}
@@ -0,0 +1,69 @@
+package whichdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// buildVersionResponse answers query with rcode and, if version is not empty, a TXT record
+func buildVersionResponse(query []byte, rcode byte, version string) []byte {
+	resp := append([]byte{}, query...)
+	resp[2] |= 0x84 // QR and AA
+	resp[3] = rcode
+	if version != "" {
+		resp[7] = 1
+		resp = append(resp, 0xC0, dnsHeaderLen) // Pointer to the question name
+		resp = append(resp, 0, dnsTypeTXT, 0, dnsClassCHAOS, 0, 0, 0, 0)
+		resp = append(resp, 0, byte(1+len(version)), byte(len(version)))
+		resp = append(resp, version...)
+	}
+	return resp
+}
+
+func TestParseVersionResponse(t *testing.T) {
+	query := buildVersionQuery(0x1234)
+	tests := []struct {
+		name    string
+		data    []byte
+		version string
+		err     error
+	}{
+		{"version", buildVersionResponse(query, 0, "9.18.1-1ubuntu1"), "9.18.1-1ubuntu1", nil},
+		{"refused", buildVersionResponse(query, 5, ""), "", ErrNoVersion},
+		{"no answer", buildVersionResponse(query, 0, ""), "", ErrNoVersion},
+		{"truncated", buildVersionResponse(query, 0, "9.18.1")[:dnsHeaderLen+4], "", ErrNoVersion},
+		{"wrong id", buildVersionResponse(buildVersionQuery(0x4321), 0, "9.18.1"), "", errWrongID},
+	}
+
+	for _, tt := range tests {
+		version, err := parseVersionResponse(0x1234, tt.data)
+		if version != tt.version || !errors.Is(err, tt.err) {
+			t.Errorf("%s: got (%q, %v), want (%q, %v)", tt.name, version, err, tt.version, tt.err)
+		}
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteTo(buildVersionResponse(buf[:n], 0, "unbound 1.19.0"), addr)
+	}()
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	version, err := ServerVersion(context.Background(), net.ParseIP("127.0.0.1"), port, time.Second)
+	if err != nil || version != "unbound 1.19.0" {
+		t.Errorf("Expected unbound 1.19.0, got (%q, %v)", version, err)
+	}
+}
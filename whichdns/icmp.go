@@ -0,0 +1,132 @@
+package whichdns
+
+import (
+	"fmt"
+	"net"
+)
+
+// ICMP constants
+const (
+	ipProtoICMP         = 1  // IP protocol: ICMP
+	ipProtoICMPv6       = 58 // IP protocol: ICMPv6
+	icmpHeaderLen       = 8  // Type, code, checksum and unused word before the quoted packet
+	icmpDestUnreachable = 3  // ICMP type: destination unreachable
+	icmp6DestUnreach    = 1  // ICMPv6 type: destination unreachable
+)
+
+// icmpCodes name the destination unreachable codes of ICMP and ICMPv6
+var (
+	icmpCodes = map[byte]string{
+		0:  "network unreachable",
+		1:  "host unreachable",
+		2:  "protocol unreachable",
+		3:  "port unreachable",
+		9:  "network administratively prohibited",
+		10: "host administratively prohibited",
+		13: "communication administratively prohibited",
+	}
+	icmp6Codes = map[byte]string{
+		0: "no route to destination",
+		1: "communication administratively prohibited",
+		3: "address unreachable",
+		4: "port unreachable",
+		5: "source address failed policy",
+		6: "reject route to destination",
+	}
+)
+
+// icmpUnreachable is an ICMP destination unreachable message about a packet
+// sent to a DNS server, as a router or the server's host returns when the
+// server is down or the traffic is blocked
+type icmpUnreachable struct {
+	from    net.IP // Sender of the ICMP message
+	server  net.IP // Destination of the quoted packet
+	srcPort uint16 // Source port of the quoted packet, i.e. the query's
+	dstPort uint16
+	reason  string // The code, e.g. "port unreachable"
+}
+
+// Error describes the message for ErrUnreachable, e.g. "10.0.0.1 port 53
+// refused the query (ICMP port unreachable from 10.0.0.1)"
+func (u icmpUnreachable) Error() string {
+	verb := "is unreachable for the query"
+	if u.reason == icmpCodes[3] {
+		verb = "refused the query"
+	}
+	return fmt.Sprintf("%v port %d %s (ICMP %s from %v)", u.server, u.dstPort, verb, u.reason, u.from)
+}
+
+// decodeICMPUnreachable decodes an ICMP or ICMPv6 destination unreachable
+// message quoting a UDP or TCP packet sent to port. The quoted packet
+// holds at least the first 8 bytes of the transport header, enough for the ports.
+func decodeICMPUnreachable(frame []byte, port uint16) (icmpUnreachable, bool) {
+	ipPacket, ok := parseEthernetFrame(frame)
+	if !ok || len(ipPacket) < 1 {
+		return icmpUnreachable{}, false
+	}
+
+	var u icmpUnreachable
+	var icmp []byte
+	var codes map[byte]string
+	switch ipPacket[0] >> 4 {
+	case 4:
+		if len(ipPacket) < ipHeaderMin || ipPacket[9] != ipProtoICMP {
+			return icmpUnreachable{}, false
+		}
+		headerLen := int(ipPacket[0]&0x0F) * 4
+		if headerLen < ipHeaderMin || len(ipPacket) < headerLen+icmpHeaderLen || ipPacket[headerLen] != icmpDestUnreachable {
+			return icmpUnreachable{}, false
+		}
+		u.from = net.IP(ipPacket[ipSrcOffset : ipSrcOffset+4])
+		icmp, codes = ipPacket[headerLen:], icmpCodes
+	case 6:
+		// ICMPv6 errors come straight after the fixed header
+		if len(ipPacket) < ip6HeaderLen+icmpHeaderLen || ipPacket[6] != ipProtoICMPv6 || ipPacket[ip6HeaderLen] != icmp6DestUnreach {
+			return icmpUnreachable{}, false
+		}
+		u.from = net.IP(ipPacket[ip6SrcOffset : ip6SrcOffset+16])
+		icmp, codes = ipPacket[ip6HeaderLen:], icmp6Codes
+	default:
+		return icmpUnreachable{}, false
+	}
+
+	if u.reason = codes[icmp[1]]; u.reason == "" {
+		u.reason = fmt.Sprintf("destination unreachable, code %d", icmp[1])
+	}
+	quoted, proto, _, dstIP, ok := parseQuotedPacket(icmp[icmpHeaderLen:])
+	if !ok || (proto != ipProtoUDP && proto != ipProtoTCP) {
+		return icmpUnreachable{}, false
+	}
+	u.server = dstIP
+	u.srcPort = uint16(quoted[0])<<8 | uint16(quoted[1])
+	u.dstPort = uint16(quoted[2])<<8 | uint16(quoted[3])
+	if u.dstPort != port {
+		return icmpUnreachable{}, false
+	}
+	return u, true
+}
+
+// parseQuotedPacket parses the IP packet quoted in an ICMP error, of which
+// only the first 8 bytes of the transport header are guaranteed to be present
+func parseQuotedPacket(ipPacket []byte) ([]byte, byte, net.IP, net.IP, bool) {
+	if len(ipPacket) < 1 {
+		return nil, 0, nil, nil, false
+	}
+	switch ipPacket[0] >> 4 {
+	case 4:
+		if len(ipPacket) < ipHeaderMin {
+			return nil, 0, nil, nil, false
+		}
+		headerLen := int(ipPacket[0]&0x0F) * 4
+		if headerLen < ipHeaderMin || len(ipPacket) < headerLen+udpHeaderLen {
+			return nil, 0, nil, nil, false
+		}
+		return ipPacket[headerLen:], ipPacket[9], net.IP(ipPacket[ipSrcOffset : ipSrcOffset+4]), net.IP(ipPacket[ipSrcOffset+4 : ipSrcOffset+8]), true
+	case 6:
+		if len(ipPacket) < ip6HeaderLen+udpHeaderLen {
+			return nil, 0, nil, nil, false
+		}
+		return ipPacket[ip6HeaderLen:], ipPacket[6], net.IP(ipPacket[ip6SrcOffset : ip6SrcOffset+16]), net.IP(ipPacket[ip6SrcOffset+16 : ip6SrcOffset+32]), true
+	}
+	return nil, 0, nil, nil, false
+}
@@ -0,0 +1,70 @@
+package whichdns
+
+import (
+	"net"
+	"testing"
+)
+
+// buildICMPFrame wraps an ICMP destination unreachable message with code,
+// quoting the IP packet of the Ethernet frame quoted, in IPv4 or IPv6 and
+// Ethernet headers
+func buildICMPFrame(srcIP, dstIP string, code byte, quoted []byte) []byte {
+	src := net.ParseIP(srcIP)
+	eth := make([]byte, 12, ethHeaderLen)
+	if src.To4() != nil {
+		icmp := append([]byte{icmpDestUnreachable, code, 0, 0, 0, 0, 0, 0}, quoted[ethHeaderLen:]...)
+		ipLen := ipHeaderMin + len(icmp)
+		ip := []byte{0x45, 0, byte(ipLen >> 8), byte(ipLen), 0, 0, 0, 0, 64, ipProtoICMP, 0, 0}
+		ip = append(ip, src.To4()...)
+		ip = append(ip, net.ParseIP(dstIP).To4()...)
+		eth = append(eth, byte(ethPIPv4>>8), byte(ethPIPv4&0xff))
+		return append(append(eth, ip...), icmp...)
+	}
+	icmp := append([]byte{icmp6DestUnreach, code, 0, 0, 0, 0, 0, 0}, quoted[ethHeaderLen:]...)
+	ip := []byte{0x60, 0, 0, 0, byte(len(icmp) >> 8), byte(len(icmp)), ipProtoICMPv6, 64}
+	ip = append(ip, src.To16()...)
+	ip = append(ip, net.ParseIP(dstIP).To16()...)
+	eth = append(eth, byte(ethPIPv6>>8), byte(ethPIPv6&0xff))
+	return append(append(eth, ip...), icmp...)
+}
+
+func TestDecodeICMPUnreachable(t *testing.T) {
+	query := buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(7, false, "example.com"))
+	query6 := buildUDP6Frame("2001:db8::10", "2001:db8::1", 40001, 53, buildDNSPayload(8, false, "example.com"))
+
+	tests := []struct {
+		name  string
+		frame []byte
+		ok    bool
+		want  string
+	}{
+		{"port unreachable", buildICMPFrame("192.168.1.1", "192.168.1.10", 3, query), true,
+			"192.168.1.1 port 53 refused the query (ICMP port unreachable from 192.168.1.1)"},
+		{"host unreachable from a router", buildICMPFrame("10.0.0.1", "192.168.1.10", 1, query), true,
+			"192.168.1.1 port 53 is unreachable for the query (ICMP host unreachable from 10.0.0.1)"},
+		{"only 8 bytes of the transport header quoted", buildICMPFrame("192.168.1.1", "192.168.1.10", 13, query[:ethHeaderLen+ipHeaderMin+udpHeaderLen]), true,
+			"192.168.1.1 port 53 is unreachable for the query (ICMP communication administratively prohibited from 192.168.1.1)"},
+		{"IPv6 port unreachable", buildICMPFrame("2001:db8::1", "2001:db8::10", 4, query6), true,
+			"2001:db8::1 port 53 refused the query (ICMP port unreachable from 2001:db8::1)"},
+		{"unknown code", buildICMPFrame("2001:db8::1", "2001:db8::10", 9, query6), true,
+			"2001:db8::1 port 53 is unreachable for the query (ICMP destination unreachable, code 9 from 2001:db8::1)"},
+		{"other port", buildICMPFrame("192.168.1.1", "192.168.1.10", 3, buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 123, nil)), false, ""},
+		{"quoted packet cut short", buildICMPFrame("192.168.1.1", "192.168.1.10", 3, query[:ethHeaderLen+ipHeaderMin+4]), false, ""},
+		{"not ICMP", query, false, ""},
+	}
+	for _, tt := range tests {
+		u, ok := decodeICMPUnreachable(tt.frame, dnsPort)
+		if ok != tt.ok {
+			t.Errorf("%s: got ok=%v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && u.Error() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, u.Error(), tt.want)
+		}
+	}
+
+	u, _ := decodeICMPUnreachable(buildICMPFrame("192.168.1.1", "192.168.1.10", 3, query), dnsPort)
+	if u.srcPort != 40000 {
+		t.Errorf("Expected the query's port 40000, got %d", u.srcPort)
+	}
+}
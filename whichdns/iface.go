@@ -0,0 +1,232 @@
+package whichdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// DefaultInterface returns the interface used for capture when none is requested:
+// the up interface carrying the default route, or failing that the first up
+// interface with a global unicast address, restricted to IPv6 when ipv6 is set
+func DefaultInterface(ipv6 bool) (*net.Interface, error) {
+	return findDefaultNetworkInterface(systemInterfaces{}, ipv6)
+}
+
+// InterfaceByName returns the named interface if it is up and has a usable address
+func InterfaceByName(name string, ipv6 bool) (*net.Interface, error) {
+	return findNamedNetworkInterface(systemInterfaces{}, name, ipv6)
+}
+
+// LoopbackInterface returns the loopback interface, for capturing the traffic
+// of a resolver bound to a local address such as 127.0.0.1
+func LoopbackInterface(ipv6 bool) (*net.Interface, error) {
+	return findLoopbackInterface(systemInterfaces{}, ipv6)
+}
+
+// InterfaceForIP returns the interface the address ip is assigned to
+func InterfaceForIP(ip net.IP) (*net.Interface, error) {
+	return findInterfaceWithIP(systemInterfaces{}, ip)
+}
+
+// interfaceLister enumerates interfaces, their addresses and the default
+// routes; tests substitute a stub for the host's network configuration
+type interfaceLister interface {
+	Interfaces() ([]net.Interface, error)
+	Addrs(iface *net.Interface) ([]net.Addr, error)
+	DefaultRouteInterfaces(ipv6 bool) ([]string, error)
+}
+
+// systemInterfaces lists the host's real interfaces and routing table
+type systemInterfaces struct{}
+
+func (systemInterfaces) Interfaces() ([]net.Interface, error) { return net.Interfaces() }
+
+func (systemInterfaces) Addrs(iface *net.Interface) ([]net.Addr, error) { return iface.Addrs() }
+
+func (systemInterfaces) DefaultRouteInterfaces(ipv6 bool) ([]string, error) {
+	return defaultRouteInterfaces(ipv6)
+}
+
+// findDefaultNetworkInterface returns the up interface with a global unicast IP
+// that carries the default route, falling back to the first such interface
+func findDefaultNetworkInterface(lister interfaceLister, ipv6 bool) (*net.Interface, error) {
+	candidates, err := findCaptureInterfaces(lister, ipv6)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prefer the interface the kernel routes default traffic through
+	routes, err := lister.DefaultRouteInterfaces(ipv6)
+	if err != nil {
+		debugf("Could not read default routes: %v", err)
+	}
+	for _, name := range routes {
+		for i := range candidates {
+			if candidates[i].Name == name {
+				debugf("Interface %v carries the default route.", name)
+				return &candidates[i], nil
+			}
+		}
+	}
+
+	debugf("No default route through a candidate interface; using %v.", candidates[0].Name)
+	return &candidates[0], nil
+}
+
+// findCaptureInterfaces returns every up interface with a global unicast IP
+func findCaptureInterfaces(lister interfaceLister, ipv6 bool) ([]net.Interface, error) {
+	debugf("Listing all network interfaces.")
+	interfaces, err := lister.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("could not list interfaces: %w", err)
+	}
+
+	var candidates []net.Interface
+	for _, iface := range interfaces {
+		debugf("Checking interface: %v", iface.Name)
+		if iface.Flags&net.FlagUp == 0 {
+			debugf("Skipping interface %v: it is down", iface.Name)
+			continue
+		}
+
+		addrs, err := lister.Addrs(&iface)
+		if err != nil {
+			debugf("Could not get addresses for interface %v: %v", iface.Name, err)
+			return nil, fmt.Errorf("could not get addresses for interface %v: %w", iface.Name, err)
+		}
+
+		for _, addr := range addrs {
+			ip := addrIP(addr)
+			debugf("Found IP address: %v on interface: %v", ip, iface.Name)
+
+			if usableIP(ip, ipv6) {
+				debugf("Global unicast IP found: %v on interface: %v", ip, iface.Name)
+				candidates = append(candidates, iface)
+				break
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		debugf("No suitable default interface found.")
+		return nil, fmt.Errorf("%w: no interface is up with a global unicast address", ErrNoInterface)
+	}
+	return candidates, nil
+}
+
+// findNamedNetworkInterface looks up an interface by name and checks it is up with a usable address
+func findNamedNetworkInterface(lister interfaceLister, name string, ipv6 bool) (*net.Interface, error) {
+	interfaces, err := lister.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("could not list interfaces: %w", err)
+	}
+
+	var iface *net.Interface
+	for i := range interfaces {
+		if interfaces[i].Name == name {
+			iface = &interfaces[i]
+			break
+		}
+	}
+	if iface == nil {
+		return nil, fmt.Errorf("interface %q does not exist", name)
+	}
+
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %q is down", name)
+	}
+
+	addrs, err := lister.Addrs(iface)
+	if err != nil {
+		return nil, fmt.Errorf("could not get addresses for interface %v: %w", name, err)
+	}
+
+	loopback := iface.Flags&net.FlagLoopback != 0
+	for _, addr := range addrs {
+		if ip := addrIP(addr); usableIP(ip, ipv6) || (loopback && loopbackIP(ip, ipv6)) {
+			debugf("Usable IP %v found on interface %v", ip, name)
+			return iface, nil
+		}
+	}
+
+	return nil, fmt.Errorf("interface %q has no usable address", name)
+}
+
+// findLoopbackInterface returns the first up loopback interface with a
+// loopback address, restricted to IPv6 when ipv6 is set
+func findLoopbackInterface(lister interfaceLister, ipv6 bool) (*net.Interface, error) {
+	interfaces, err := lister.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("could not list interfaces: %w", err)
+	}
+
+	for i := range interfaces {
+		iface := &interfaces[i]
+		if iface.Flags&net.FlagLoopback == 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := lister.Addrs(iface)
+		if err != nil {
+			debugf("Could not get addresses for interface %v: %v", iface.Name, err)
+			continue
+		}
+		for _, addr := range addrs {
+			if ip := addrIP(addr); loopbackIP(ip, ipv6) {
+				debugf("Loopback IP %v found on interface %v", ip, iface.Name)
+				return iface, nil
+			}
+		}
+	}
+	return nil, errors.New("no loopback interface is up with a loopback address")
+}
+
+// findInterfaceWithIP returns the interface that has ip among its addresses
+func findInterfaceWithIP(lister interfaceLister, ip net.IP) (*net.Interface, error) {
+	interfaces, err := lister.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("could not list interfaces: %w", err)
+	}
+
+	for i := range interfaces {
+		addrs, err := lister.Addrs(&interfaces[i])
+		if err != nil {
+			debugf("Could not get addresses for interface %v: %v", interfaces[i].Name, err)
+			continue
+		}
+		for _, addr := range addrs {
+			if addrIP(addr).Equal(ip) {
+				debugf("Address %v is assigned to interface %v", ip, interfaces[i].Name)
+				return &interfaces[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("source address %v is not assigned to any local interface", ip)
+}
+
+// usableIP reports whether ip can carry DNS traffic, restricted to IPv6 when ipv6 is set
+func usableIP(ip net.IP, ipv6 bool) bool {
+	if !ip.IsGlobalUnicast() {
+		return false
+	}
+	return !ipv6 || ip.To4() == nil
+}
+
+// loopbackIP reports whether ip is a loopback address, restricted to IPv6 when ipv6 is set
+func loopbackIP(ip net.IP, ipv6 bool) bool {
+	if !ip.IsLoopback() {
+		return false
+	}
+	return !ipv6 || ip.To4() == nil
+}
+
+// addrIP extracts the IP from an interface address
+func addrIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.IPNet:
+		return v.IP
+	case *net.IPAddr:
+		return v.IP
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package whichdns
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestFindDefaultNetworkInterface(t *testing.T) {
+	up := net.FlagUp | net.FlagBroadcast
+	loopback := net.Interface{Index: 1, Name: "lo", Flags: net.FlagUp | net.FlagLoopback}
+
+	tests := []struct {
+		name   string
+		ifaces []net.Interface
+		addrs  map[string][]string
+		ipv6   bool
+		want   string
+	}{
+		{
+			name:   "loopback only",
+			ifaces: []net.Interface{loopback},
+			addrs:  map[string][]string{"lo": {"127.0.0.1/8", "::1/128"}},
+		},
+		{
+			name:   "link-local only",
+			ifaces: []net.Interface{loopback, {Index: 2, Name: "eth0", Flags: up}},
+			addrs:  map[string][]string{"lo": {"127.0.0.1/8"}, "eth0": {"169.254.10.1/16", "fe80::1/64"}},
+		},
+		{
+			name:   "v6-only interface",
+			ifaces: []net.Interface{loopback, {Index: 2, Name: "eth0", Flags: up}},
+			addrs:  map[string][]string{"eth0": {"fe80::1/64", "2001:db8::10/64"}},
+			want:   "eth0",
+		},
+		{
+			name: "v6 required",
+			ifaces: []net.Interface{
+				loopback,
+				{Index: 2, Name: "eth0", Flags: up},
+				{Index: 3, Name: "eth1", Flags: up},
+			},
+			addrs: map[string][]string{"eth0": {"192.168.1.10/24"}, "eth1": {"10.0.0.5/24", "2001:db8::10/64"}},
+			ipv6:  true,
+			want:  "eth1",
+		},
+		{
+			name: "multiple candidates",
+			ifaces: []net.Interface{
+				loopback,
+				{Index: 2, Name: "eth0", Flags: up},
+				{Index: 3, Name: "eth1", Flags: up},
+			},
+			addrs: map[string][]string{"eth0": {"192.168.1.10/24"}, "eth1": {"10.0.0.5/24"}},
+			want:  "eth0",
+		},
+		{
+			name:   "all down",
+			ifaces: []net.Interface{loopback, {Index: 2, Name: "eth0"}},
+			addrs:  map[string][]string{"eth0": {"192.168.1.10/24"}},
+		},
+	}
+
+	for _, tt := range tests {
+		iface, err := findDefaultNetworkInterface(stubLister{ifaces: tt.ifaces, addrs: tt.addrs}, tt.ipv6)
+		if tt.want == "" {
+			if !errors.Is(err, ErrNoInterface) {
+				t.Errorf("%s: expected ErrNoInterface, got %v, %v", tt.name, iface, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if iface.Name != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, iface.Name, tt.want)
+		}
+	}
+}
+
+func TestFindNamedNetworkInterface(t *testing.T) {
+	lister := stubLister{
+		ifaces: []net.Interface{
+			{Index: 1, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			{Index: 2, Name: "eth0", Flags: net.FlagUp},
+			{Index: 3, Name: "eth1"},
+		},
+		addrs: map[string][]string{
+			"lo":   {"127.0.0.1/8"},
+			"eth0": {"192.168.1.10/24"},
+			"eth1": {"10.0.0.5/24"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		ipv6 bool
+		ok   bool
+	}{
+		{"eth0", false, true},
+		{"eth0", true, false},
+		{"eth1", false, false},
+		{"lo", false, true}, // For a resolver bound to 127.0.0.1
+		{"lo", true, false},
+		{"whichdns-missing0", false, false},
+	}
+
+	for _, tt := range tests {
+		iface, err := findNamedNetworkInterface(lister, tt.name, tt.ipv6)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s (ipv6=%v): got error %v, want ok=%v", tt.name, tt.ipv6, err, tt.ok)
+			continue
+		}
+		if tt.ok && iface.Name != tt.name {
+			t.Errorf("Expected interface %v, got %v", tt.name, iface.Name)
+		}
+	}
+}
+
+func TestFindLoopbackInterface(t *testing.T) {
+	lister := stubLister{
+		ifaces: []net.Interface{
+			{Index: 1, Name: "eth0", Flags: net.FlagUp},
+			{Index: 2, Name: "lo1", Flags: net.FlagLoopback},
+			{Index: 3, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+		},
+		addrs: map[string][]string{
+			"eth0": {"192.168.1.10/24"},
+			"lo1":  {"127.0.0.2/8"},
+			"lo":   {"127.0.0.1/8", "::1/128"},
+		},
+	}
+	for _, ipv6 := range []bool{false, true} {
+		iface, err := findLoopbackInterface(lister, ipv6)
+		if err != nil || iface.Name != "lo" {
+			t.Errorf("ipv6=%v: got %v, %v, want lo", ipv6, iface, err)
+		}
+	}
+
+	lister.addrs["lo"] = []string{"127.0.0.1/8"}
+	if _, err := findLoopbackInterface(lister, true); err == nil {
+		t.Error("Expected an error without an IPv6 loopback address")
+	}
+}
+
+// stubLister is an interfaceLister backed by fixed interfaces, addresses and routes
+type stubLister struct {
+	ifaces []net.Interface
+	addrs  map[string][]string
+	routes []string
+}
+
+func (s stubLister) Interfaces() ([]net.Interface, error) { return s.ifaces, nil }
+
+func (s stubLister) Addrs(iface *net.Interface) ([]net.Addr, error) {
+	var addrs []net.Addr
+	for _, cidr := range s.addrs[iface.Name] {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ipNet.IP = ip
+		addrs = append(addrs, ipNet)
+	}
+	return addrs, nil
+}
+
+func (s stubLister) DefaultRouteInterfaces(ipv6 bool) ([]string, error) { return s.routes, nil }
+
+func TestFindDefaultNetworkInterfaceRoutes(t *testing.T) {
+	up := net.FlagUp | net.FlagBroadcast
+	lister := stubLister{
+		ifaces: []net.Interface{
+			{Index: 1, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			{Index: 2, Name: "eth0", Flags: 0},
+			{Index: 3, Name: "docker0", Flags: up},
+			{Index: 4, Name: "wlan0", Flags: up},
+		},
+		addrs: map[string][]string{
+			"lo":      {"127.0.0.1/8"},
+			"eth0":    {"192.168.1.10/24"},
+			"docker0": {"172.17.0.1/16"},
+			"wlan0":   {"10.0.0.5/24"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		routes []string
+		want   string
+	}{
+		{"default route preferred", []string{"wlan0"}, "wlan0"},
+		{"lowest metric first", []string{"docker0", "wlan0"}, "docker0"},
+		{"down route interface skipped", []string{"eth0", "wlan0"}, "wlan0"},
+		{"no default route", nil, "docker0"},
+	}
+
+	for _, tt := range tests {
+		lister.routes = tt.routes
+		iface, err := findDefaultNetworkInterface(lister, false)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if iface.Name != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, iface.Name, tt.want)
+		}
+	}
+}
+
+func TestFindCaptureInterfaces(t *testing.T) {
+	up := net.FlagUp | net.FlagBroadcast
+	lister := stubLister{
+		ifaces: []net.Interface{
+			{Index: 1, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			{Index: 2, Name: "eth0", Flags: up},
+			{Index: 3, Name: "eth1", Flags: up},
+			{Index: 4, Name: "eth2"},
+			{Index: 5, Name: "bond0", Flags: up},
+		},
+		addrs: map[string][]string{
+			"lo":    {"127.0.0.1/8"},
+			"eth0":  {"192.168.1.10/24"},
+			"eth1":  {"fe80::1/64"},
+			"eth2":  {"10.0.0.5/24"},
+			"bond0": {"10.1.0.5/24"},
+		},
+	}
+
+	ifaces, err := findCaptureInterfaces(lister, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var names []string
+	for _, iface := range ifaces {
+		names = append(names, iface.Name)
+	}
+	if len(names) != 2 || names[0] != "eth0" || names[1] != "bond0" {
+		t.Errorf("Expected [eth0 bond0], got %v", names)
+	}
+}
+
+func TestFindInterfaceWithIP(t *testing.T) {
+	up := net.FlagUp | net.FlagBroadcast
+	lister := stubLister{
+		ifaces: []net.Interface{
+			{Index: 1, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			{Index: 2, Name: "eth0", Flags: up},
+			{Index: 3, Name: "eth1", Flags: up},
+		},
+		addrs: map[string][]string{
+			"lo":   {"127.0.0.1/8"},
+			"eth0": {"192.168.1.10/24"},
+			"eth1": {"10.0.0.5/24", "2001:db8::10/64"},
+		},
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.168.1.10", "eth0"},
+		{"2001:db8::10", "eth1"},
+		{"127.0.0.1", "lo"},
+		{"10.0.0.6", ""},
+	}
+
+	for _, tt := range tests {
+		iface, err := findInterfaceWithIP(lister, net.ParseIP(tt.ip))
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got interface %v", tt.ip, iface.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.ip, err)
+			continue
+		}
+		if iface.Name != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.ip, tt.want, iface.Name)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package whichdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// queryTypes maps the record types Options.Type accepts to their DNS type codes
+var queryTypes = map[string]uint16{
+	"A":     dnsTypeA,
+	"NS":    2,
+	"CNAME": 5,
+	"MX":    15,
+	"TXT":   16,
+	"AAAA":  28,
+	"SRV":   33,
+}
+
+// QueryTypes returns the record types Options.Type accepts, sorted
+func QueryTypes() []string {
+	types := make([]string, 0, len(queryTypes))
+	for name := range queryTypes {
+		types = append(types, name)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// ValidateQueryType reports whether t is a record type Options.Type accepts;
+// the empty string stands for the default host lookup
+func ValidateQueryType(t string) error {
+	if _, ok := queryTypes[t]; t != "" && !ok {
+		return fmt.Errorf("unsupported record type %q, expected one of %s", t, strings.Join(QueryTypes(), ", "))
+	}
+	return nil
+}
+
+// queryType returns the DNS type code sent for t, A for the default host lookup
+func queryType(t string) uint16 {
+	if code, ok := queryTypes[t]; ok {
+		return code
+	}
+	return dnsTypeA
+}
+
+// lookup queries resolver for name with the record type t, or for its
+// addresses (A and AAAA) when t is empty. Only the traffic matters, so the
+// records returned are discarded.
+func lookup(ctx context.Context, resolver *net.Resolver, t, name string) error {
+	var err error
+	switch t {
+	case "":
+		_, err = resolver.LookupHost(ctx, name)
+	case "A":
+		_, err = resolver.LookupIP(ctx, "ip4", name)
+	case "AAAA":
+		_, err = resolver.LookupIP(ctx, "ip6", name)
+	case "CNAME":
+		_, err = resolver.LookupCNAME(ctx, name)
+	case "MX":
+		_, err = resolver.LookupMX(ctx, name)
+	case "NS":
+		_, err = resolver.LookupNS(ctx, name)
+	case "SRV":
+		// With no service and protocol, name is queried as given
+		_, _, err = resolver.LookupSRV(ctx, "", "", name)
+	case "TXT":
+		_, err = resolver.LookupTXT(ctx, name)
+	default:
+		err = ValidateQueryType(t)
+	}
+	return err
+}
@@ -0,0 +1,22 @@
+package whichdns
+
+import "testing"
+
+func TestValidateQueryType(t *testing.T) {
+	for _, qtype := range append(QueryTypes(), "") {
+		if err := ValidateQueryType(qtype); err != nil {
+			t.Errorf("ValidateQueryType(%q) = %v, want nil", qtype, err)
+		}
+	}
+	for _, qtype := range []string{"mx", "ANY", "PTR", "A "} {
+		if err := ValidateQueryType(qtype); err == nil {
+			t.Errorf("ValidateQueryType(%q) = nil, want an error", qtype)
+		}
+	}
+	if got := queryType("MX"); got != 15 {
+		t.Errorf("queryType(MX) = %d, want 15", got)
+	}
+	if got := queryType(""); got != dnsTypeA {
+		t.Errorf("queryType(\"\") = %d, want A", got)
+	}
+}
@@ -0,0 +1,211 @@
+package whichdns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// pcap file format constants
+const (
+	pcapMagicMicros   = 0xa1b2c3d4 // Magic number for microsecond timestamps
+	pcapMagicNanos    = 0xa1b23c4d // Magic number for nanosecond timestamps
+	pcapGlobalHdrLen  = 24         // Global header length
+	pcapRecordHdrLen  = 16         // Per-packet record header length
+	pcapMaxRecordLen  = 262144     // Largest record accepted, matching libpcap's limit
+	linkTypeNull      = 0          // LINKTYPE_NULL: BSD loopback, host-order family
+	linkTypeEthernet  = 1          // LINKTYPE_ETHERNET
+	linkTypeLoop      = 108        // LINKTYPE_LOOP: OpenBSD loopback, network-order family
+	nullHeaderLen     = 4          // Address family header of LINKTYPE_NULL and LINKTYPE_LOOP
+	pcapngSectionType = 0x0a0d0d0a // pcapng Section Header Block type
+)
+
+// pcapFileSource reads packets from a classic libpcap capture file
+type pcapFileSource struct {
+	file     *os.File
+	reader   *bufio.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType uint32
+}
+
+// openPcapFile opens a pcap capture file and validates its global header
+func openPcapFile(path string) (*pcapFileSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+
+	src := &pcapFileSource{file: file, reader: bufio.NewReader(file)}
+	if err := src.readGlobalHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	infof("Opened capture file %s (link type %d)", path, src.linkType)
+	return src, nil
+}
+
+// readGlobalHeader detects byte order and timestamp precision from the magic number
+func (s *pcapFileSource) readGlobalHeader() error {
+	hdr := make([]byte, pcapGlobalHdrLen)
+	if _, err := io.ReadFull(s.reader, hdr); err != nil {
+		return fmt.Errorf("failed to read capture file header: %w", err)
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(hdr) == pcapMagicMicros:
+		s.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr) == pcapMagicMicros:
+		s.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr) == pcapMagicNanos:
+		s.order, s.nanos = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr) == pcapMagicNanos:
+		s.order, s.nanos = binary.BigEndian, true
+	case binary.BigEndian.Uint32(hdr) == pcapngSectionType:
+		return errors.New("pcapng capture files are not supported; convert with 'editcap -F pcap'")
+	default:
+		return errors.New("not a pcap capture file")
+	}
+
+	s.linkType = s.order.Uint32(hdr[20:24])
+	switch s.linkType {
+	case linkTypeEthernet, linkTypeNull, linkTypeLoop:
+		return nil
+	}
+	return fmt.Errorf("unsupported capture link type %d (only Ethernet and loopback are supported)", s.linkType)
+}
+
+// readPacket returns the next packet in the file, or io.EOF once it is exhausted
+func (s *pcapFileSource) readPacket() (*capturedPacket, error) {
+	hdr := make([]byte, pcapRecordHdrLen)
+	if _, err := io.ReadFull(s.reader, hdr); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated record header in capture file")
+		}
+		return nil, err
+	}
+
+	sec := int64(s.order.Uint32(hdr[0:4]))
+	frac := int64(s.order.Uint32(hdr[4:8]))
+	inclLen := s.order.Uint32(hdr[8:12])
+	origLen := s.order.Uint32(hdr[12:16])
+	if inclLen > pcapMaxRecordLen {
+		return nil, fmt.Errorf("capture file record too large (%d bytes)", inclLen)
+	}
+
+	data := make([]byte, inclLen)
+	if _, err := io.ReadFull(s.reader, data); err != nil {
+		return nil, errors.New("truncated packet data in capture file")
+	}
+
+	if !s.nanos {
+		frac *= int64(time.Microsecond)
+	}
+	length := int(origLen)
+	if s.linkType != linkTypeEthernet {
+		data = loopbackToEthernet(data)
+		length += ethHeaderLen - nullHeaderLen
+	}
+	return &capturedPacket{data: data, timestamp: time.Unix(sec, frac), length: length}, nil
+}
+
+// loopbackToEthernet rewrites a BSD loopback frame, a 4-byte address family
+// followed by the IP packet, as an Ethernet frame with zero addresses like
+// Linux loopback captures, so it decodes and writes out like any other. The
+// family values differ between systems, so the EtherType is taken from the IP
+// version instead; anything else is left undecodable.
+func loopbackToEthernet(data []byte) []byte {
+	if len(data) <= nullHeaderLen {
+		return nil
+	}
+	frame := make([]byte, ethHeaderLen, ethHeaderLen+len(data)-nullHeaderLen)
+	switch data[nullHeaderLen] >> 4 {
+	case 4:
+		binary.BigEndian.PutUint16(frame[12:], ethPIPv4)
+	case 6:
+		binary.BigEndian.PutUint16(frame[12:], ethPIPv6)
+	}
+	return append(frame, data[nullHeaderLen:]...)
+}
+
+// Close closes the underlying capture file
+func (s *pcapFileSource) Close() error {
+	return s.file.Close()
+}
+
+// pcapFileWriter writes captured packets to a classic libpcap file with
+// nanosecond timestamps. It is safe for concurrent use and ignores writes
+// after Close.
+type pcapFileWriter struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	closed bool
+}
+
+// createPcapFile creates or truncates path and writes the pcap global header
+func createPcapFile(path string, snaplen int) (*pcapFileWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %w", err)
+	}
+
+	hdr := make([]byte, pcapGlobalHdrLen)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagicNanos)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2) // Version 2.4
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], uint32(snaplen))
+	binary.LittleEndian.PutUint32(hdr[20:24], linkTypeEthernet)
+
+	w := &pcapFileWriter{file: file, writer: bufio.NewWriter(file)}
+	if _, err := w.writer.Write(hdr); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write capture file header: %w", err)
+	}
+
+	infof("Writing captured packets to %s", path)
+	return w, nil
+}
+
+// writePacket appends a packet record to the file
+func (w *pcapFileWriter) writePacket(packet *capturedPacket) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+
+	rec := make([]byte, pcapRecordHdrLen)
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(packet.timestamp.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(packet.timestamp.Nanosecond()))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(packet.data)))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(packet.wireLen()))
+	if _, err := w.writer.Write(rec); err != nil {
+		return err
+	}
+	_, err := w.writer.Write(packet.data)
+	return err
+}
+
+// Close flushes buffered packets and closes the file
+func (w *pcapFileWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	flushErr := w.writer.Flush()
+	closeErr := w.file.Close()
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
@@ -0,0 +1,53 @@
+package whichdns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// DefaultResolvConf is the resolver configuration read by ConfiguredNameservers
+const DefaultResolvConf = "/etc/resolv.conf"
+
+// ConfiguredNameservers returns the nameserver addresses listed in a
+// resolv.conf style file. These are the servers the system is configured to
+// use, not necessarily the ones that actually answer.
+func ConfiguredNameservers(path string) ([]net.IP, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resolver configuration: %w", err)
+	}
+	defer file.Close()
+
+	var servers []net.IP
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Strip comments
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+
+		// Drop any IPv6 zone such as fe80::1%eth0
+		addr, _, _ := strings.Cut(fields[1], "%")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			debugf("Ignoring invalid nameserver %q in %s", fields[1], path)
+			continue
+		}
+		servers = append(servers, ip)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read resolver configuration: %w", err)
+	}
+
+	debugf("Configured nameservers in %s: %v", path, servers)
+	return servers, nil
+}
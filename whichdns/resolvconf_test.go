@@ -0,0 +1,42 @@
+package whichdns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfiguredNameservers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	conf := `# Generated by NetworkManager
+search corp.local
+nameserver 192.168.1.1
+nameserver 2001:db8::53 # secondary
+; nameserver 10.0.0.1
+nameserver fe80::1%eth0
+nameserver not-an-ip
+options edns0
+`
+	if err := os.WriteFile(path, []byte(conf), 0o644); err != nil {
+		t.Fatalf("Failed to write resolv.conf: %v", err)
+	}
+
+	servers, err := ConfiguredNameservers(path)
+	if err != nil {
+		t.Fatalf("ConfiguredNameservers failed: %v", err)
+	}
+
+	want := []string{"192.168.1.1", "2001:db8::53", "fe80::1"}
+	if len(servers) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, servers)
+	}
+	for i, server := range servers {
+		if server.String() != want[i] {
+			t.Errorf("Expected server %d to be %v, got %v", i, want[i], server)
+		}
+	}
+
+	if _, err := ConfiguredNameservers(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
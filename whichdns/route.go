@@ -0,0 +1,128 @@
+package whichdns
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Routing and neighbour table files exposed by Linux
+const (
+	procRouteIPv4 = "/proc/net/route"
+	procRouteIPv6 = "/proc/net/ipv6_route"
+	procARP       = "/proc/net/arp"
+)
+
+// Route flags from linux/route.h
+const (
+	rtfUp     = 0x0001 // Route is usable
+	rtfReject = 0x0200 // Route rejects traffic (e.g. the IPv6 "unreachable" default on lo)
+)
+
+// defaultRoute is a default route and the interface it leaves through
+type defaultRoute struct {
+	iface  string
+	metric uint32
+}
+
+// defaultRouteInterfaces reads the kernel routing table and returns the names
+// of the interfaces carrying a default route, lowest metric first
+func defaultRouteInterfaces(ipv6 bool) ([]string, error) {
+	path, parse := procRouteIPv4, parseRouteTable
+	if ipv6 {
+		path, parse = procRouteIPv6, parseIPv6RouteTable
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parse(file), nil
+}
+
+// parseRouteTable returns the default-route interfaces listed in /proc/net/route format
+func parseRouteTable(r io.Reader) []string {
+	var routes []defaultRoute
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&rtfUp == 0 || flags&rtfReject != 0 {
+			continue
+		}
+		metric, _ := strconv.ParseUint(fields[6], 10, 32)
+		routes = append(routes, defaultRoute{iface: fields[0], metric: uint32(metric)})
+	}
+	return sortRoutes(routes)
+}
+
+// parseIPv6RouteTable returns the default-route interfaces listed in /proc/net/ipv6_route format
+func parseIPv6RouteTable(r io.Reader) []string {
+	var routes []defaultRoute
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Destination PrefixLen Source SourcePrefixLen NextHop Metric RefCnt Use Flags Iface
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || strings.Trim(fields[0], "0") != "" || fields[1] != "00" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[8], 16, 32)
+		if err != nil || flags&rtfUp == 0 || flags&rtfReject != 0 {
+			continue
+		}
+		metric, _ := strconv.ParseUint(fields[5], 16, 32)
+		routes = append(routes, defaultRoute{iface: fields[9], metric: uint32(metric)})
+	}
+	return sortRoutes(routes)
+}
+
+// sortRoutes orders routes by metric and returns their interface names
+func sortRoutes(routes []defaultRoute) []string {
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].metric < routes[j].metric })
+	names := make([]string, 0, len(routes))
+	for _, route := range routes {
+		names = append(names, route.iface)
+	}
+	return names
+}
+
+// neighborIP returns the IPv4 neighbour owning mac according to the ARP
+// table, or nil if it is not listed or the table cannot be read
+func neighborIP(mac net.HardwareAddr) net.IP {
+	file, err := os.Open(procARP)
+	if err != nil {
+		debugf("Failed to read the ARP table: %v", err)
+		return nil
+	}
+	defer file.Close()
+	return parseARPTable(file, mac)
+}
+
+// parseARPTable returns the first address listed for mac in /proc/net/arp format
+func parseARPTable(r io.Reader, mac net.HardwareAddr) net.IP {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// IP address HW type Flags HW address Mask Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		hw, err := net.ParseMAC(fields[3])
+		if err != nil || hw.String() != mac.String() {
+			continue
+		}
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package whichdns
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRouteTable(t *testing.T) {
+	table := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+wlan0	00000000	0100000A	0003	0	0	600	00000000	0	0	0
+eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0001A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+tun0	00000000	00000000	0200	0	0	50	00000000	0	0	0
+`
+	got := parseRouteTable(strings.NewReader(table))
+	if want := []string{"eth0", "wlan0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got default routes %v, want %v", got, want)
+	}
+}
+
+func TestParseIPv6RouteTable(t *testing.T) {
+	table := `fd000000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fd000000000000000000000000000001 00000400 00000001 00000000 00000003     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo
+`
+	got := parseIPv6RouteTable(strings.NewReader(table))
+	if want := []string{"eth0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got default routes %v, want %v", got, want)
+	}
+}
+
+func TestParseARPTable(t *testing.T) {
+	table := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.99     0x1         0x0         00:00:00:00:00:00     *        eth0
+192.168.1.1      0x1         0x2         52:54:00:12:34:56     *        eth0
+`
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	if got := parseARPTable(strings.NewReader(table), mac); got.String() != "192.168.1.1" {
+		t.Errorf("Expected neighbour 192.168.1.1, got %v", got)
+	}
+	other, _ := net.ParseMAC("52:54:00:ab:cd:ef")
+	if got := parseARPTable(strings.NewReader(table), other); got != nil {
+		t.Errorf("Expected no neighbour for an unknown MAC, got %v", got)
+	}
+}
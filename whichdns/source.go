@@ -0,0 +1,182 @@
+package whichdns
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// packetSource yields captured packets from a live socket or a capture file
+type packetSource interface {
+	// readPacket returns the next packet, nil if none is ready yet, or io.EOF
+	// once a finite source is exhausted
+	readPacket() (*capturedPacket, error)
+	Close() error
+}
+
+// capturedPacket is a raw frame together with the time it was captured
+type capturedPacket struct {
+	data      []byte
+	timestamp time.Time
+	iface     string // Capture interface, empty for capture files
+	length    int    // Length on the wire, more than len(data) when cut off by the snaplen
+}
+
+// wireLen returns the length of the frame on the wire, which is the captured
+// length if the source did not report it
+func (p *capturedPacket) wireLen() int {
+	if p.length < len(p.data) {
+		return len(p.data)
+	}
+	return p.length
+}
+
+// ifaceSuffix returns " on <iface>" for log messages, or nothing for capture files
+func ifaceSuffix(iface string) string {
+	if iface == "" {
+		return ""
+	}
+	return " on " + iface
+}
+
+// multiSource reads from several sources in turn, e.g. one socket per
+// interface. It only reports no packet once every source has none ready, so
+// an empty read still means all of them are drained.
+type multiSource struct {
+	sources []packetSource
+	next    int
+}
+
+// readPacket returns the next packet from the first source that has one,
+// starting after the source read last so none is starved
+func (m *multiSource) readPacket() (*capturedPacket, error) {
+	for range m.sources {
+		src := m.sources[m.next]
+		m.next = (m.next + 1) % len(m.sources)
+		packet, err := src.readPacket()
+		if err != nil || packet != nil {
+			return packet, err
+		}
+	}
+	return nil, nil
+}
+
+// Close closes every source
+func (m *multiSource) Close() error {
+	var errs []error
+	for _, src := range m.sources {
+		errs = append(errs, src.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// reopeningSource wraps a live source and reopens it once when a read fails,
+// e.g. because the interface was reset, instead of failing the whole run.
+// Packets arriving while it is reopened are lost.
+type reopeningSource struct {
+	mu       sync.Mutex
+	src      packetSource
+	reopen   func() (packetSource, error)
+	reopened bool
+}
+
+// readPacket reads from the current source; after the first failure it
+// reopens the source and reports no packet, after a second it gives up
+func (r *reopeningSource) readPacket() (*capturedPacket, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	packet, err := r.src.readPacket()
+	if err == nil || r.reopened {
+		return packet, err
+	}
+
+	r.reopened = true
+	infof("Capture failed (%v); reopening it once.", err)
+	r.src.Close()
+	src, reopenErr := r.reopen()
+	if reopenErr != nil {
+		r.src = closedSource{}
+		return nil, fmt.Errorf("%w (reopening failed: %w)", err, reopenErr)
+	}
+	r.src = src
+	return nil, nil
+}
+
+// Close closes the current source
+func (r *reopeningSource) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.src.Close()
+}
+
+// closedSource stands in for a source that failed to reopen
+type closedSource struct{}
+
+func (closedSource) readPacket() (*capturedPacket, error) { return nil, errors.New("capture closed") }
+
+func (closedSource) Close() error { return nil }
+
+// sharedSource lets several detections read one capture, each seeing every
+// packet. There is no reader goroutine: whichever reader runs out of queued
+// packets reads the next one from the capture and queues it for every reader.
+type sharedSource struct {
+	mu      sync.Mutex
+	src     packetSource
+	readers map[*sharedReader]bool
+	err     error // First read error, reported to every reader
+}
+
+// newSharedSource shares src; it is not closed with the readers
+func newSharedSource(src packetSource) *sharedSource {
+	return &sharedSource{src: src, readers: make(map[*sharedReader]bool)}
+}
+
+// reader returns a new reader that sees every packet captured from now on
+func (s *sharedSource) reader() *sharedReader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &sharedReader{shared: s}
+	s.readers[r] = true
+	return r
+}
+
+// sharedReader is one detection's view of a sharedSource
+type sharedReader struct {
+	shared *sharedSource
+	queue  []*capturedPacket
+}
+
+// readPacket returns the oldest packet queued for this reader, reading from
+// the capture when there is none
+func (r *sharedReader) readPacket() (*capturedPacket, error) {
+	s := r.shared
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(r.queue) == 0 && s.err == nil {
+		packet, err := s.src.readPacket()
+		switch {
+		case err != nil:
+			s.err = err
+		case packet != nil:
+			for reader := range s.readers {
+				reader.queue = append(reader.queue, packet)
+			}
+		}
+	}
+	if len(r.queue) == 0 {
+		return nil, s.err
+	}
+	packet := r.queue[0]
+	r.queue = r.queue[1:]
+	return packet, nil
+}
+
+// Close stops queueing packets for the reader
+func (r *sharedReader) Close() error {
+	r.shared.mu.Lock()
+	defer r.shared.mu.Unlock()
+	delete(r.shared.readers, r)
+	r.queue = nil
+	return nil
+}
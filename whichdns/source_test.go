@@ -0,0 +1,128 @@
+package whichdns
+
+import (
+	"errors"
+	"testing"
+)
+
+// queueSource returns its packets one at a time, then no packet or err
+type queueSource struct {
+	packets []*capturedPacket
+	err     error
+	closed  bool
+}
+
+func (s *queueSource) readPacket() (*capturedPacket, error) {
+	if len(s.packets) == 0 {
+		return nil, s.err
+	}
+	packet := s.packets[0]
+	s.packets = s.packets[1:]
+	return packet, nil
+}
+
+func (s *queueSource) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestMultiSource(t *testing.T) {
+	eth0 := &queueSource{packets: []*capturedPacket{{iface: "eth0"}, {iface: "eth0"}}}
+	eth1 := &queueSource{}
+	bond0 := &queueSource{packets: []*capturedPacket{{iface: "bond0"}}}
+	src := &multiSource{sources: []packetSource{eth0, eth1, bond0}}
+
+	var got []string
+	for {
+		packet, err := src.readPacket()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if packet == nil {
+			break
+		}
+		got = append(got, packet.iface)
+	}
+	if len(got) != 3 || got[0] != "eth0" || got[1] != "bond0" || got[2] != "eth0" {
+		t.Errorf("Expected packets from eth0, bond0, eth0 in turn, got %v", got)
+	}
+
+	src.Close()
+	if !eth0.closed || !eth1.closed || !bond0.closed {
+		t.Error("Expected every source to be closed")
+	}
+}
+
+func TestReopeningSource(t *testing.T) {
+	errDown := errors.New("network is down")
+
+	// The first failure reopens the source, which then keeps delivering
+	first := &queueSource{packets: []*capturedPacket{{iface: "eth0"}}, err: errDown}
+	second := &queueSource{packets: []*capturedPacket{{iface: "eth0"}}, err: errDown}
+	reopens := 0
+	src := &reopeningSource{src: first, reopen: func() (packetSource, error) {
+		reopens++
+		return second, nil
+	}}
+
+	var got int
+	var err error
+	for i := 0; i < 5 && err == nil; i++ {
+		var packet *capturedPacket
+		packet, err = src.readPacket()
+		if packet != nil {
+			got++
+		}
+	}
+	if got != 2 || reopens != 1 || !first.closed {
+		t.Errorf("Expected 2 packets across one reopen, got %d packets and %d reopens", got, reopens)
+	}
+	if !errors.Is(err, errDown) {
+		t.Errorf("Expected the second failure to be returned, got %v", err)
+	}
+
+	// A failed reopen reports both errors
+	src = &reopeningSource{src: &queueSource{err: errDown}, reopen: func() (packetSource, error) {
+		return nil, errors.New("no such device")
+	}}
+	if _, err := src.readPacket(); err == nil || !errors.Is(err, errDown) {
+		t.Errorf("Expected the read error after a failed reopen, got %v", err)
+	}
+	if err := src.Close(); err != nil {
+		t.Errorf("Unexpected error closing: %v", err)
+	}
+}
+
+func TestSharedSource(t *testing.T) {
+	errDown := errors.New("network is down")
+	src := &queueSource{packets: []*capturedPacket{{iface: "eth0"}, {iface: "eth1"}}, err: errDown}
+	shared := newSharedSource(src)
+	a, b := shared.reader(), shared.reader()
+
+	// Both readers see every packet, whichever of them read it from the capture
+	for _, want := range []string{"eth0", "eth1"} {
+		packet, err := a.readPacket()
+		if err != nil || packet == nil || packet.iface != want {
+			t.Fatalf("Expected a packet from %s for the first reader, got %v, %v", want, packet, err)
+		}
+	}
+	for _, want := range []string{"eth0", "eth1"} {
+		packet, err := b.readPacket()
+		if err != nil || packet == nil || packet.iface != want {
+			t.Fatalf("Expected a packet from %s for the second reader, got %v, %v", want, packet, err)
+		}
+	}
+
+	// A closed reader no longer queues packets, and the capture's error
+	// reaches every reader still open
+	b.Close()
+	if _, err := a.readPacket(); !errors.Is(err, errDown) {
+		t.Errorf("Expected the capture error, got %v", err)
+	}
+	if len(b.queue) != 0 {
+		t.Errorf("Expected nothing queued for a closed reader, got %d packets", len(b.queue))
+	}
+	if src.closed {
+		t.Error("Expected the shared capture to stay open")
+	}
+}
@@ -0,0 +1,114 @@
+package whichdns
+
+import (
+	"fmt"
+	"net"
+)
+
+// TCP header flags used when following DNS streams
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+)
+
+// tcpMaxBuffered bounds the bytes buffered per stream: one maximum-size DNS
+// message plus its two-byte length prefix
+const tcpMaxBuffered = 2 + 65535
+
+// tcpSegment is a parsed TCP segment
+type tcpSegment struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	flags   byte
+	payload []byte
+}
+
+// parseTCPSegment extracts ports, sequence number, flags and payload from a TCP segment
+func parseTCPSegment(tcpPacket []byte) (*tcpSegment, bool) {
+	if len(tcpPacket) < tcpHeaderMin {
+		return nil, false
+	}
+
+	// Data offset (upper 4 bits * 4) gives the header length including options
+	headerLen := int(tcpPacket[12]>>4) * 4
+	if headerLen < tcpHeaderMin || len(tcpPacket) < headerLen {
+		return nil, false
+	}
+
+	return &tcpSegment{
+		srcPort: uint16(tcpPacket[0])<<8 | uint16(tcpPacket[1]),
+		dstPort: uint16(tcpPacket[2])<<8 | uint16(tcpPacket[3]),
+		seq:     uint32(tcpPacket[4])<<24 | uint32(tcpPacket[5])<<16 | uint32(tcpPacket[6])<<8 | uint32(tcpPacket[7]),
+		flags:   tcpPacket[13],
+		payload: tcpPacket[headerLen:],
+	}, true
+}
+
+// tcpStream buffers the in-order bytes of one direction of a TCP connection
+type tcpStream struct {
+	next uint32
+	buf  []byte
+}
+
+// tcpStreams reassembles DNS messages, each prefixed with a two-byte length,
+// from the TCP streams seen in a capture
+type tcpStreams struct {
+	streams map[string]*tcpStream
+}
+
+// newTCPStreams creates an empty stream table
+func newTCPStreams() *tcpStreams {
+	return &tcpStreams{streams: make(map[string]*tcpStream)}
+}
+
+// add feeds a segment travelling from src to dst into its stream and returns
+// the DNS messages it completed. Segments that arrive out of order are dropped.
+func (t *tcpStreams) add(src, dst net.IP, seg *tcpSegment) [][]byte {
+	key := fmt.Sprintf("%v:%d>%v:%d", src, seg.srcPort, dst, seg.dstPort)
+
+	if seg.flags&(tcpFlagFIN|tcpFlagRST) != 0 && len(seg.payload) == 0 {
+		delete(t.streams, key)
+		return nil
+	}
+	if seg.flags&tcpFlagSYN != 0 {
+		t.streams[key] = &tcpStream{next: seg.seq + 1}
+		return nil
+	}
+	if len(seg.payload) == 0 {
+		return nil
+	}
+
+	stream, ok := t.streams[key]
+	if !ok {
+		// Capture started mid-connection; assume this segment starts a message
+		stream = &tcpStream{next: seg.seq}
+		t.streams[key] = stream
+	}
+	if seg.seq != stream.next {
+		debugf("Skipping out-of-order TCP segment from %v:%d (seq %d, expected %d)", src, seg.srcPort, seg.seq, stream.next)
+		return nil
+	}
+	stream.next += uint32(len(seg.payload))
+	stream.buf = append(stream.buf, seg.payload...)
+
+	var messages [][]byte
+	for len(stream.buf) >= 2 {
+		msgLen := int(stream.buf[0])<<8 | int(stream.buf[1])
+		if len(stream.buf) < 2+msgLen {
+			break
+		}
+		messages = append(messages, stream.buf[2:2+msgLen])
+		stream.buf = stream.buf[2+msgLen:]
+	}
+	if len(stream.buf) > tcpMaxBuffered {
+		debugf("Dropping oversized TCP stream from %v:%d", src, seg.srcPort)
+		delete(t.streams, key)
+	}
+
+	if seg.flags&(tcpFlagFIN|tcpFlagRST) != 0 {
+		delete(t.streams, key)
+	}
+	return messages
+}
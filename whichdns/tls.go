@@ -0,0 +1,157 @@
+package whichdns
+
+import (
+	"net"
+	"strings"
+)
+
+// Ports watched for encrypted DNS
+const (
+	dotPort   = 853 // DNS over TLS
+	httpsPort = 443 // DNS over HTTPS
+)
+
+// TLS constants needed to find the SNI in a ClientHello
+const (
+	tlsRecordHandshake = 0x16   // TLS record type: handshake
+	tlsRecordHeaderLen = 5      // TLS record header length
+	tlsHandshakeHello  = 0x01   // Handshake type: ClientHello
+	tlsHandshakeHdrLen = 4      // Handshake message header length
+	tlsRandomLen       = 32     // ClientHello random length
+	tlsExtServerName   = 0x0000 // Extension type: server_name
+	tlsServerNameHost  = 0x00   // SNI name type: host_name
+)
+
+// knownDoHHosts lists public DNS-over-HTTPS endpoints recognised by SNI
+var knownDoHHosts = []string{
+	"cloudflare-dns.com",
+	"mozilla.cloudflare-dns.com",
+	"one.one.one.one",
+	"dns.google",
+	"dns.google.com",
+	"dns.quad9.net",
+	"dns9.quad9.net",
+	"doh.opendns.com",
+	"dns.nextdns.io",
+	"dns.adguard.com",
+	"dns.adguard-dns.com",
+	"doh.cleanbrowsing.org",
+	"doh.mullvad.net",
+}
+
+// tlsHello is a TLS ClientHello sent towards a possible encrypted DNS server
+type tlsHello struct {
+	srcIP   net.IP
+	dstIP   net.IP
+	dstPort uint16
+	sni     string
+}
+
+// protocol classifies the connection as DoT or DoH, reporting false for
+// HTTPS connections to hosts that are not known DoH endpoints
+func (h *tlsHello) protocol() (string, bool) {
+	if h.dstPort == dotPort {
+		return ProtocolDoT, true
+	}
+	sni := strings.ToLower(strings.TrimSuffix(h.sni, "."))
+	for _, host := range knownDoHHosts {
+		if sni == host {
+			return ProtocolDoH, true
+		}
+	}
+	return "", false
+}
+
+// decodeClientHello decodes an Ethernet frame carrying a TLS ClientHello to
+// the DoT or HTTPS port
+func decodeClientHello(frame []byte) (*tlsHello, bool) {
+	ipPacket, ok := parseEthernetFrame(frame)
+	if !ok {
+		return nil, false
+	}
+
+	transport, proto, srcIP, dstIP, ok := parseIPPacket(ipPacket)
+	if !ok || proto != ipProtoTCP {
+		return nil, false
+	}
+
+	seg, ok := parseTCPSegment(transport)
+	if !ok || (seg.dstPort != dotPort && seg.dstPort != httpsPort) {
+		return nil, false
+	}
+
+	sni, ok := parseClientHelloSNI(seg.payload)
+	if !ok {
+		return nil, false
+	}
+
+	return &tlsHello{srcIP: srcIP, dstIP: dstIP, dstPort: seg.dstPort, sni: sni}, true
+}
+
+// parseClientHelloSNI reports whether data starts a TLS ClientHello and
+// returns its server name, if any. A ClientHello spanning several segments is
+// only searched as far as the first segment reaches.
+func parseClientHelloSNI(data []byte) (string, bool) {
+	if len(data) < tlsRecordHeaderLen+tlsHandshakeHdrLen || data[0] != tlsRecordHandshake || data[1] != 3 {
+		return "", false
+	}
+	if data[tlsRecordHeaderLen] != tlsHandshakeHello {
+		return "", false
+	}
+
+	// Skip the client version and random, then the session ID, cipher suites
+	// and compression methods
+	offset := tlsRecordHeaderLen + tlsHandshakeHdrLen + 2 + tlsRandomLen
+	if offset >= len(data) {
+		return "", true
+	}
+	offset += 1 + int(data[offset])
+	if offset+2 > len(data) {
+		return "", true
+	}
+	offset += 2 + (int(data[offset])<<8 | int(data[offset+1]))
+	if offset >= len(data) {
+		return "", true
+	}
+	offset += 1 + int(data[offset])
+	if offset+2 > len(data) {
+		return "", true
+	}
+	offset += 2
+
+	// Walk the extensions looking for server_name
+	for offset+4 <= len(data) {
+		extType := int(data[offset])<<8 | int(data[offset+1])
+		extLen := int(data[offset+2])<<8 | int(data[offset+3])
+		offset += 4
+		if offset+extLen > len(data) {
+			break
+		}
+		if extType == tlsExtServerName {
+			return parseServerNameExtension(data[offset : offset+extLen]), true
+		}
+		offset += extLen
+	}
+	return "", true
+}
+
+// parseServerNameExtension returns the first host name in a server_name extension
+func parseServerNameExtension(ext []byte) string {
+	if len(ext) < 2 {
+		return ""
+	}
+	offset := 2
+	for offset+3 <= len(ext) {
+		nameType := ext[offset]
+		nameLen := int(ext[offset+1])<<8 | int(ext[offset+2])
+		offset += 3
+		if offset+nameLen > len(ext) {
+			return ""
+		}
+		if nameType == tlsServerNameHost {
+			return string(ext[offset : offset+nameLen])
+		}
+		offset += nameLen
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package whichdns
+
+import "testing"
+
+// buildClientHello builds a TLS record holding a ClientHello with an optional SNI
+func buildClientHello(sni string) []byte {
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, tlsRandomLen)...)
+	body = append(body, 0)                    // Session ID
+	body = append(body, 0, 2, 0x13, 0x01)     // Cipher suites
+	body = append(body, 1, 0)                 // Compression methods
+	exts := []byte{0x00, 0x2b, 0, 3, 2, 3, 4} // supported_versions
+	if sni != "" {
+		n := len(sni)
+		exts = append(exts, 0, 0, byte((n+5)>>8), byte(n+5), byte((n+3)>>8), byte(n+3), 0, byte(n>>8), byte(n))
+		exts = append(exts, sni...)
+	}
+	body = append(body, byte(len(exts)>>8), byte(len(exts)))
+	body = append(body, exts...)
+
+	hs := append([]byte{tlsHandshakeHello, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	return append([]byte{tlsRecordHandshake, 3, 1, byte(len(hs) >> 8), byte(len(hs))}, hs...)
+}
+
+func TestDecodeClientHello(t *testing.T) {
+	tests := []struct {
+		name     string
+		frame    []byte
+		protocol string
+		sni      string
+		ok       bool
+	}{
+		{"dot", buildTCPFrame("192.168.1.10", "1.1.1.1", 40000, 853, 1, 0x18, buildClientHello("one.one.one.one")), ProtocolDoT, "one.one.one.one", true},
+		{"dot without sni", buildTCPFrame("192.168.1.10", "9.9.9.9", 40000, 853, 1, 0x18, buildClientHello("")), ProtocolDoT, "", true},
+		{"doh", buildTCPFrame("192.168.1.10", "8.8.8.8", 40000, 443, 1, 0x18, buildClientHello("dns.google")), ProtocolDoH, "dns.google", true},
+		{"plain https", buildTCPFrame("192.168.1.10", "93.184.216.34", 40000, 443, 1, 0x18, buildClientHello("example.com")), "", "example.com", false},
+		{"not tls", buildTCPFrame("192.168.1.10", "1.1.1.1", 40000, 853, 1, 0x18, []byte("GET / HTTP/1.1")), "", "", false},
+		{"other port", buildTCPFrame("192.168.1.10", "1.1.1.1", 40000, 8443, 1, 0x18, buildClientHello("dns.google")), "", "", false},
+	}
+
+	for _, tt := range tests {
+		var protocol, sni string
+		var ok bool
+		if hello, decoded := decodeClientHello(tt.frame); decoded {
+			sni = hello.sni
+			protocol, ok = hello.protocol()
+		}
+		if ok != tt.ok || protocol != tt.protocol || sni != tt.sni {
+			t.Errorf("%s: got (%q, %q, %v), want (%q, %q, %v)", tt.name, protocol, sni, ok, tt.protocol, tt.sni, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,1128 @@
+// Package whichdns detects which DNS server answers the host's DNS queries by
+// capturing network packets while performing lookups.
+package whichdns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDomain is the domain looked up when Options.Domain is empty
+	DefaultDomain = "example.com"
+	// DefaultPort is the server port DNS traffic is matched on when Options.Port is zero
+	DefaultPort = dnsPort
+	// DefaultTimeout is how long Detect waits for a response when Options.Timeout is zero
+	DefaultTimeout = 10 * time.Second
+	// DefaultCount is the number of lookups performed when Options.Count is zero
+	DefaultCount = 4
+	// DefaultSnaplen is the snapshot length when Options.Snaplen is zero: whole frames
+	DefaultSnaplen = 65536
+	// retryBackoff is the delay before the first capture open retry; it doubles each retry
+	retryBackoff = 200 * time.Millisecond
+	// responseBuffer is how many matched responses the capture goroutine can
+	// hand over before it waits for them to be received
+	responseBuffer = 64
+)
+
+// Transport protocols accepted in Options.Proto
+const (
+	ProtoAny = "any"
+	ProtoUDP = "udp"
+	ProtoTCP = "tcp"
+)
+
+// Address families accepted in Options.Family
+const (
+	FamilyAny  = "any"
+	FamilyIPv4 = "4"
+	FamilyIPv6 = "6"
+)
+
+// Protocols reported in Result.Protocol
+const (
+	ProtocolDNS = "dns" // Plaintext DNS on port 53
+	ProtocolDoT = "dot" // DNS over TLS on port 853
+	ProtocolDoH = "doh" // DNS over HTTPS to a known endpoint
+)
+
+// Steps reported through Options.OnStep as Detect enters each stage
+const (
+	StepOpenCapture  = "open capture"
+	StepFilter       = "filter"
+	StepStartCapture = "start capture"
+	StepLookup       = "lookup"
+	StepWait         = "wait"
+)
+
+// Errors returned by Detect, wrapped with the underlying cause
+var (
+	ErrCaptureOpen = errors.New("failed to open capture")
+	ErrLookup      = errors.New("DNS lookup failed")
+	ErrCapture     = errors.New("packet capture failed")
+	ErrTimeout     = errors.New("timeout")
+	ErrNoResponse  = errors.New("no DNS response found in capture file")
+	// ErrNoInterface is returned when no interface is up with a usable
+	// address, e.g. in a minimal container with only loopback
+	ErrNoInterface = errors.New("no usable network interface")
+	// ErrUnreachable means an ICMP destination unreachable message came back
+	// for a query, e.g. port unreachable when nothing listens on the DNS
+	// port, so no response will follow
+	ErrUnreachable = errors.New("resolver refused/unreachable")
+	// ErrResolvedLocally means every lookup succeeded without a single query
+	// reaching the capture interface
+	ErrResolvedLocally = errors.New("domain resolved locally (hosts file or cache); no DNS server contacted")
+)
+
+// Logger receives diagnostic messages from the package; it discards them by
+// default. Per-packet detail is logged at debug level, milestones at info.
+var Logger = slog.New(slog.DiscardHandler)
+
+// debugEnabled reports whether debug messages are logged, to skip work done
+// only for them
+func debugEnabled() bool {
+	return Logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// debugf logs a formatted message at debug level
+func debugf(format string, a ...interface{}) {
+	if debugEnabled() {
+		Logger.Debug(fmt.Sprintf(format, a...))
+	}
+}
+
+// infof logs a formatted message at info level
+func infof(format string, a ...interface{}) {
+	if Logger.Enabled(context.Background(), slog.LevelInfo) {
+		Logger.Info(fmt.Sprintf(format, a...))
+	}
+}
+
+// Options controls a detection run
+type Options struct {
+	// Domain is the name looked up to generate DNS traffic
+	Domain string
+	// Interface is the capture interface name; empty selects the default interface
+	Interface string
+	// Timeout bounds how long to wait for a DNS response
+	Timeout time.Duration
+	// IPv6 restricts detection to DNS servers reached over IPv6, like
+	// Family FamilyIPv6
+	IPv6 bool
+	// Family restricts detection to DNS servers reached over one address
+	// family, FamilyIPv4 or FamilyIPv6, so on a dual-stack host the result does
+	// not depend on which family answers first; FamilyAny (the default) takes both
+	Family string
+	// PcapFile, if set, reads packets from a saved pcap file instead of capturing
+	// live; no lookups are performed and Interface is ignored
+	PcapFile string
+	// Retries is how many more times to try opening the capture socket after
+	// a failure, with exponential backoff; zero fails on the first error
+	Retries int
+	// WriteFile, if set, receives every captured packet in pcap format
+	WriteFile string
+	// Filter, if set, keeps only packets matching the expression, e.g.
+	// "net 10.0.0.0/8 and not host 10.0.0.2"; see ValidateFilter. It must still
+	// let the DNS traffic through or detection times out.
+	Filter string
+	// Port is the port the DNS server listens on (DefaultPort when zero)
+	Port int
+	// Proto selects the transport DNS responses are matched on: ProtoUDP,
+	// ProtoTCP or ProtoAny (the default)
+	Proto string
+	// Encrypted watches for TLS connections to DoT servers and known DoH
+	// endpoints instead of plaintext DNS responses
+	Encrypted bool
+	// Unique prepends a random label to the domain for every lookup so no
+	// cache can answer it and each lookup produces a query on the wire; the
+	// domain must tolerate queries for arbitrary subdomains
+	Unique bool
+	// SystemResolver performs the lookups with the platform resolver, which may
+	// answer through nscd or systemd-resolved without sending any packets.
+	// By default Go's own DNS client queries the configured nameservers directly.
+	SystemResolver bool
+	// Source, if set, is the local address the lookups are sent from, e.g. to
+	// test one path of a policy-routing setup. It must be assigned to a local
+	// interface, which becomes the capture interface unless Interface or
+	// AllInterfaces is set; only traffic to or from it is considered, and the
+	// lookups always use Go's DNS client since the system one cannot be bound.
+	Source net.IP
+	// AnyHost considers the DNS traffic of every host the capture sees. By
+	// default only packets to or from an address of the capture interfaces
+	// are, so on a shared segment, a mirror port or an interface another
+	// tool made promiscuous, a response to another machine is never reported.
+	// Capture files are never restricted this way.
+	AnyHost bool
+	// Resolver, if set, is the DNS server the lookups are sent to, on Port,
+	// instead of the configured nameservers; the lookups then always use Go's
+	// DNS client. A response from any other server means the queries were
+	// redirected on the way.
+	Resolver net.IP
+	// EDNS sends the lookups with Go's own EDNS0 client, advertising a
+	// 4096-byte UDP payload, to the nameservers in /etc/resolv.conf instead of
+	// using a resolver, so Result.EDNS can report what the server echoes back
+	EDNS bool
+	// DNSSEC is like EDNS but also sets the DO bit in the queries, asking
+	// the server for DNSSEC records; see Result.DNSSEC
+	DNSSEC bool
+	// Type is the record type looked up, one of QueryTypes such as "MX" or
+	// "TXT", for resolvers that behave differently per type; empty looks up
+	// the domain's addresses (A and AAAA). Only the generated traffic changes:
+	// the server is detected the same way whatever the type.
+	Type string
+	// Snaplen is the number of bytes kept of each captured frame and the
+	// snapshot length recorded in WriteFile (DefaultSnaplen when zero). Packets
+	// cut short by a small snaplen cannot be decoded and are skipped.
+	Snaplen int
+	// BufferSize, if positive, sets the capture socket's receive buffer in
+	// bytes so bursts on a busy host are not dropped; zero keeps the kernel default
+	BufferSize int
+	// Immediate polls the capture without pausing when no packet is ready, so
+	// a response is handled as soon as it arrives at the cost of a busy CPU.
+	// Response times are unaffected either way: they use kernel timestamps.
+	Immediate bool
+	// Count is the number of lookups performed to generate DNS traffic
+	// (DefaultCount when zero)
+	Count int
+	// ProbeInterval is the delay between the starts of consecutive lookups,
+	// generating traffic steadily through the capture rather than in one burst
+	// and giving a pool of backends more chances to answer. Zero starts them
+	// together, or with All or WaitFull spreads them over the first half of
+	// the timeout. The last lookup must start before the timeout.
+	ProbeInterval time.Duration
+	// AllInterfaces captures on every up interface with a usable address
+	// instead of a single one; Interface is ignored
+	AllInterfaces bool
+	// Loopback captures on the loopback interface, to test a resolver bound
+	// to a local address such as a local unbound or dnsmasq. It is implied
+	// when Resolver is a loopback address and neither Interface, Source nor
+	// AllInterfaces picks the capture interface.
+	Loopback bool
+	// All keeps capturing until the timeout, or until every captured query has
+	// been answered, and collects every responding server instead of returning
+	// on the first response
+	All bool
+	// WaitFull keeps capturing for the whole timeout like All, then reports
+	// the server that answered the most lookups as Result.Server rather than
+	// the first to answer: slower, but less easily fooled by a stray response
+	WaitFull bool
+	// MinServers, with All, stops the capture as soon as this many distinct
+	// servers have answered instead of waiting for the timeout; fewer is not
+	// an error, so compare len(Result.Servers) to it. Zero waits as All does.
+	MinServers int
+	// OnCaptureOpen, if set, is called once the capture is open and before any
+	// lookup, e.g. to drop privileges; an error aborts the detection
+	OnCaptureOpen func() error
+	// OnStep, if set, is called with one of the Step constants as each stage starts
+	OnStep func(step string)
+	// OnPacket, if set, is called with every captured packet that passes
+	// Filter, before it is matched, e.g. for custom logging or counting. It
+	// runs on the capture goroutine, so it must not block, and it must not
+	// modify the packet's Data.
+	OnPacket func(Packet)
+}
+
+// Packet is a captured frame passed to Options.OnPacket
+type Packet struct {
+	// Data is the raw Ethernet frame, cut off at Options.Snaplen
+	Data []byte
+	// Length is the length of the frame on the wire, at least len(Data)
+	Length int
+	// Timestamp is the kernel capture time, or the time recorded in PcapFile
+	Timestamp time.Time
+	// Interface is the capture interface, empty for capture files
+	Interface string
+}
+
+// Result describes the DNS server that answered
+type Result struct {
+	// Server is the IP address of the responding DNS server
+	Server net.IP
+	// Servers lists every unique responding server in the order seen when
+	// Options.All or Options.WaitFull is set
+	Servers []net.IP
+	// Counts tallies the responses from each server, keyed by IP string, when
+	// Options.All or Options.WaitFull is set
+	Counts map[string]int
+	// Protocol is one of the Protocol constants
+	Protocol string
+	// SNI is the TLS server name sent to an encrypted DNS server, if any
+	SNI string
+	// Query is the question name of the first matched response, e.g. to
+	// confirm it answered a lookup for Options.Domain; empty for encrypted DNS
+	Query string
+	// Interface is the name of the interface the response was captured on
+	Interface string
+	// EDNS is the OPT record of the first matched response, nil when the
+	// server sent none (e.g. it does not support EDNS0 or was not asked)
+	EDNS *EDNS
+	// DNSSEC holds the DNSSEC flags of the first matched response and its query
+	DNSSEC DNSSEC
+	// MAC is the next-hop MAC address of the first matched response: the
+	// Ethernet source of a DNS response, or the destination of the TLS
+	// handshake with Encrypted. It is the server's own address when the
+	// server is on the local segment and the gateway's otherwise; nil on links
+	// without Ethernet addressing such as loopback.
+	MAC net.HardwareAddr
+	// NextHop is the IPv4 neighbour owning MAC according to the ARP table,
+	// e.g. the default gateway, or nil if it is not listed there. It is not
+	// looked up for capture files, which come from another host.
+	NextHop net.IP
+	// ServerPort and ClientPort are the source and destination ports of the
+	// first matched response; zero with Encrypted. A ServerPort other than
+	// Options.Port means NAT or a proxy rewrote the response on its way.
+	ServerPort int
+	ClientPort int
+	// Answers holds the answer records of the first matched response, e.g.
+	// to spot a server returning forged addresses; nil with Encrypted
+	Answers []Answer
+	// TTL is the IP TTL (hop limit for IPv6) of the first matched response,
+	// from which the hops to the server can be estimated; zero with Encrypted
+	TTL int
+	// TTLCounts tallies the responses from each server by TTL, keyed by IP
+	// string, when Options.All or Options.WaitFull is set. Several TTLs for
+	// one address suggest several anycast nodes at different distances.
+	TTLCounts map[string]map[int]int
+	// AnswerSets lists the distinct answer records each server returned
+	// across its responses, keyed by IP string and then by query type, when
+	// Options.All or Options.WaitFull is set. Records are given as type and
+	// value, e.g. "A 93.184.215.14", sorted; an empty list means the server
+	// answered that type with none, e.g. NXDOMAIN. Encrypted responses are
+	// not listed.
+	AnswerSets map[string]map[string][]string
+	// Interfaces maps each server, keyed by IP string, to the interface its
+	// first response was captured on when Options.AllInterfaces is set
+	Interfaces map[string]string
+	// Elapsed is the time from the first lookup until the kernel captured the
+	// response; for capture files it is the time between query and response
+	Elapsed time.Duration
+}
+
+// response is a matched DNS response handed from the capture goroutine
+type response struct {
+	server     net.IP
+	timestamp  time.Time
+	queried    time.Time
+	protocol   string
+	sni        string
+	query      string
+	edns       *EDNS
+	dnssec     DNSSEC
+	iface      string
+	mac        net.HardwareAddr
+	serverPort int
+	clientPort int
+	answers    []Answer
+	qtype      string
+	ttl        int
+}
+
+// withDefaults fills in zero-valued options
+func (o Options) withDefaults() Options {
+	if o.Domain == "" {
+		o.Domain = DefaultDomain
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.Proto == "" {
+		o.Proto = ProtoAny
+	}
+	if o.Family == "" || o.Family == FamilyAny {
+		o.Family = FamilyAny
+		if o.IPv6 {
+			o.Family = FamilyIPv6
+		}
+	}
+	if o.Family == FamilyIPv6 {
+		o.IPv6 = true
+	}
+	if o.Port == 0 {
+		o.Port = DefaultPort
+	}
+	if o.Count <= 0 {
+		o.Count = DefaultCount
+	}
+	if o.Snaplen <= 0 {
+		o.Snaplen = DefaultSnaplen
+	}
+	return o
+}
+
+// matchesFamily reports whether ip belongs to the address family o.Family
+func (o Options) matchesFamily(ip net.IP) bool {
+	switch o.Family {
+	case FamilyIPv4:
+		return ip.To4() != nil
+	case FamilyIPv6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// validate checks the options other than Domain once defaults are filled in
+func (o Options) validate() error {
+	switch o.Proto {
+	case ProtoAny, ProtoUDP, ProtoTCP:
+	default:
+		return fmt.Errorf("unsupported protocol %q", o.Proto)
+	}
+	switch {
+	case o.Family == FamilyIPv4 && o.IPv6:
+		return errors.New("IPv6 conflicts with address family 4")
+	case o.Family != FamilyAny && o.Family != FamilyIPv4 && o.Family != FamilyIPv6:
+		return fmt.Errorf("unsupported address family %q", o.Family)
+	}
+	if o.Port < 1 || o.Port > 65535 {
+		return fmt.Errorf("DNS port %d out of range 1-65535", o.Port)
+	}
+	if o.Resolver != nil && !o.matchesFamily(o.Resolver) {
+		return fmt.Errorf("resolver %v is not in address family %s", o.Resolver, o.Family)
+	}
+	if err := ValidateQueryType(o.Type); err != nil {
+		return err
+	}
+	if err := ValidateFilter(o.Filter); err != nil {
+		return err
+	}
+	if o.BufferSize < 0 {
+		return fmt.Errorf("buffer size %d must not be negative", o.BufferSize)
+	}
+	if o.ProbeInterval < 0 {
+		return fmt.Errorf("probe interval %v must not be negative", o.ProbeInterval)
+	}
+	if last := time.Duration(o.Count-1) * o.ProbeInterval; last >= o.Timeout {
+		return fmt.Errorf("probe interval %v starts lookup %d after the %v timeout", o.ProbeInterval, o.Count, o.Timeout)
+	}
+	if o.MinServers < 0 || (o.MinServers > 0 && (!o.All || o.WaitFull)) {
+		return fmt.Errorf("minimum of %d servers needs All without WaitFull", o.MinServers)
+	}
+	if o.Loopback && (o.Interface != "" || o.AllInterfaces) {
+		return errors.New("Loopback conflicts with Interface and AllInterfaces")
+	}
+	if o.Snaplen > pcapMaxRecordLen {
+		return fmt.Errorf("snaplen %d exceeds the maximum of %d", o.Snaplen, pcapMaxRecordLen)
+	}
+	return nil
+}
+
+// step reports a stage to the OnStep callback if one is set
+func (o Options) step(name string) {
+	if o.OnStep != nil {
+		o.OnStep(name)
+	}
+}
+
+// Detect performs DNS lookups for opts.Domain while capturing packets and
+// returns the DNS server that answered them. Cancelling ctx stops the capture
+// and returns ctx.Err().
+func Detect(ctx context.Context, opts Options) (Result, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return Result{}, err
+	}
+	if err := ValidateDomain(opts.Domain); err != nil {
+		return Result{}, err
+	}
+
+	var writer *pcapFileWriter
+	if opts.WriteFile != "" {
+		w, err := createPcapFile(opts.WriteFile, opts.Snaplen)
+		if err != nil {
+			return Result{}, err
+		}
+		writer = w
+	}
+
+	result, err := detect(ctx, opts, writer)
+
+	// Flush and close the capture file on every exit path
+	if writer != nil {
+		if closeErr := writer.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to write capture file: %w", closeErr)
+		}
+	}
+	return result, err
+}
+
+// CaptureInterfaces returns the names of the interfaces Detect would capture
+// on for opts
+func CaptureInterfaces(opts Options) ([]string, error) {
+	ifaces, err := captureInterfaces(opts.withDefaults())
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(ifaces))
+	for i := range ifaces {
+		names[i] = ifaces[i].Name
+	}
+	return names, nil
+}
+
+// CheckCapture opens the live capture Detect would use for opts and closes it
+// again without performing any lookup, e.g. to validate a host's setup
+func CheckCapture(ctx context.Context, opts Options) error {
+	opts = opts.withDefaults()
+	if err := ValidateFilter(opts.Filter); err != nil {
+		return err
+	}
+	ifaces, err := captureInterfaces(opts)
+	if err != nil {
+		return err
+	}
+	src, err := openLiveSource(ctx, opts, ifaces)
+	if err != nil {
+		return err
+	}
+	return src.Close()
+}
+
+// detect runs a detection, copying every captured packet to writer if it is not nil
+func detect(ctx context.Context, opts Options, writer *pcapFileWriter) (Result, error) {
+	src, ifaces, err := openSource(ctx, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	defer src.Close()
+
+	if opts.OnCaptureOpen != nil {
+		if err := opts.OnCaptureOpen(); err != nil {
+			return Result{}, err
+		}
+	}
+	return detectOn(ctx, opts, src, ifaces, writer)
+}
+
+// openSource opens the capture file or the live capture for opts. It also
+// returns the capture interfaces, none for a capture file.
+func openSource(ctx context.Context, opts Options) (packetSource, []net.Interface, error) {
+	if opts.PcapFile != "" {
+		opts.step(StepOpenCapture)
+		file, err := openPcapFile(opts.PcapFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrCaptureOpen, err)
+		}
+		return file, nil, nil
+	}
+
+	ifaces, err := captureInterfaces(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts.step(StepOpenCapture)
+	live, err := openLiveSource(ctx, opts, ifaces)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &reopeningSource{src: live, reopen: func() (packetSource, error) {
+		return openLiveSource(ctx, opts, ifaces)
+	}}, ifaces, nil
+}
+
+// detectOn runs a detection on the open capture src on ifaces, copying every
+// captured packet to writer if it is not nil
+func detectOn(ctx context.Context, opts Options, src packetSource, ifaces []net.Interface, writer *pcapFileWriter) (Result, error) {
+	var result Result
+	if len(ifaces) == 1 {
+		result.Interface = ifaces[0].Name
+	}
+
+	// No kernel BPF filter is attached, so there is no driver support to
+	// depend on: ports are matched in userspace, where a response whose
+	// source port was rewritten can still be matched to its query
+	opts.step(StepFilter)
+	infof("Capture opened, filtering DNS packets in userspace.")
+	if opts.Filter != "" {
+		infof("Applying capture filter: %v", opts.Filter)
+	}
+	if opts.Source != nil {
+		infof("Only considering traffic to or from source address %v.", opts.Source)
+	}
+
+	// Choose the names to look up before capture starts so the tracker knows them
+	lookups := opts.Count
+	if opts.PcapFile != "" {
+		// The capture file already contains the traffic
+		lookups = 0
+	}
+	names := make([]string, lookups)
+	for i := range names {
+		names[i] = opts.Domain
+		if opts.Unique {
+			names[i] = uniqueName(opts.Domain)
+		}
+	}
+	tracked := []string{opts.Domain}
+	if opts.Unique {
+		tracked = names
+	}
+
+	// Stop the capture goroutine when detect returns, and wait for it before
+	// the deferred Close so the source is never read once closed
+	ctx, cancel := context.WithCancel(ctx)
+	captureDone := make(chan struct{})
+	defer func() {
+		cancel()
+		<-captureDone
+	}()
+
+	// Start packet processing
+	opts.step(StepStartCapture)
+	// Buffered so a burst of responses, e.g. with All, never holds up reading
+	// the capture while the previous one is being recorded
+	dnsResponseCh := make(chan response, responseBuffer)
+	errorCh := make(chan error)
+	lookupsDone := make(chan struct{})
+	allAnswered := make(chan struct{})
+
+	// Keep collecting responses rather than stopping at the first one
+	collect := opts.All || opts.WaitFull
+
+	filter, _ := parseFilter(opts.Filter)
+	if opts.Source != nil {
+		// Queries leave from the source address and responses come back to it
+		if filter == nil {
+			filter = &packetFilter{}
+		}
+		filter.terms = append(filter.terms, filterTerm{network: hostNetwork(opts.Source)})
+	} else if !opts.AnyHost {
+		// Only this host's own queries and responses
+		if local := localAddresses(ifaces); len(local) > 0 {
+			infof("Only considering traffic to or from the %d addresses of the capture interfaces.", len(local))
+			if filter == nil {
+				filter = &packetFilter{}
+			}
+			filter.local = local
+		}
+	}
+	go func() {
+		defer close(captureDone)
+		debugf("Starting packet processing goroutine.")
+		tracker := newQueryTracker(tracked, uint16(opts.Port))
+		decoder := newPacketDecoder(opts.Proto, uint16(opts.Port))
+		decoder.expecting = tracker.expecting
+		startTime := time.Now()
+		for {
+			// Stop as soon as the caller gives up
+			if ctx.Err() != nil {
+				debugf("Packet processing cancelled: %v", ctx.Err())
+				return
+			}
+
+			// Check if we've exceeded the timeout
+			if time.Since(startTime) > opts.Timeout {
+				sendCtx(ctx, errorCh, fmt.Errorf("%w after %v", ErrTimeout, opts.Timeout))
+				return
+			}
+
+			packet, err := src.readPacket()
+			if err == io.EOF {
+				sendCtx(ctx, errorCh, ErrNoResponse)
+				return
+			}
+			if err != nil {
+				sendCtx(ctx, errorCh, fmt.Errorf("%w: failed to read packet: %w", ErrCapture, err))
+				return
+			}
+
+			if packet != nil {
+				if !filter.match(packet.data) {
+					continue
+				}
+				if debugEnabled() {
+					debugf("Packet captured at %s%s: %d of %d bytes, %s", packet.timestamp.Format("15:04:05.000000000"),
+						ifaceSuffix(packet.iface), len(packet.data), packet.wireLen(), describeFrame(packet.data))
+				}
+				if opts.OnPacket != nil {
+					opts.OnPacket(Packet{Data: packet.data, Length: packet.wireLen(), Timestamp: packet.timestamp, Interface: packet.iface})
+				}
+
+				if writer != nil {
+					if err := writer.writePacket(packet); err != nil {
+						sendCtx(ctx, errorCh, fmt.Errorf("%w: failed to write packet: %w", ErrCapture, err))
+						return
+					}
+				}
+
+				if opts.Encrypted {
+					hello, ok := decodeClientHello(packet.data)
+					if !ok || !opts.matchesFamily(hello.dstIP) {
+						continue
+					}
+					protocol, ok := hello.protocol()
+					if !ok {
+						debugf("Skipping TLS connection to %v (SNI %q)", hello.dstIP, hello.sni)
+						continue
+					}
+					infof("Encrypted DNS connection detected to IP: %v (%s, SNI %q)", hello.dstIP, protocol, hello.sni)
+					resp := response{server: hello.dstIP, timestamp: packet.timestamp, queried: packet.timestamp, protocol: protocol, sni: hello.sni, iface: packet.iface, mac: frameMAC(packet.data, ethDstOffset)}
+					if !sendCtx(ctx, dnsResponseCh, resp) || !collect {
+						return
+					}
+					continue
+				}
+
+				// A query bounced with ICMP fails at once instead of timing
+				// out; with collect, other servers may still answer
+				if u, ok := decodeICMPUnreachable(packet.data, uint16(opts.Port)); ok {
+					if !opts.matchesFamily(u.server) || !tracker.expecting(u.srcPort) {
+						debugf("Skipping ICMP %s for %v port %d: not about a captured query", u.reason, u.server, u.dstPort)
+						continue
+					}
+					err := fmt.Errorf("%w: %w", ErrUnreachable, u)
+					if !collect {
+						sendCtx(ctx, errorCh, err)
+						return
+					}
+					infof("%v", err)
+					continue
+				}
+
+				for _, pkt := range decoder.decode(packet.data) {
+					if !opts.matchesFamily(pkt.srcIP) {
+						continue
+					}
+					pkt.timestamp = packet.timestamp
+					if dnsIP, ok := tracker.observe(pkt); ok {
+						query, _ := tracker.question(pkt.msg)
+						infof("DNS response detected from IP: %v (query for %v)", dnsIP, query)
+						resp := response{server: dnsIP, timestamp: packet.timestamp, queried: tracker.sentAt(pkt), protocol: ProtocolDNS, query: query, edns: pkt.msg.edns, dnssec: tracker.dnssec(pkt), iface: packet.iface, mac: frameMAC(packet.data, ethSrcOffset), serverPort: int(pkt.srcPort), clientPort: int(pkt.dstPort), answers: pkt.msg.answers, qtype: typeName(pkt.msg.qtype), ttl: pkt.ttl}
+						if !sendCtx(ctx, dnsResponseCh, resp) || !collect {
+							return
+						}
+					}
+				}
+			} else {
+				// Once the lookups are over and the socket is drained, every query
+				// has been seen; stop collecting when all have been answered, or
+				// give up at once when the lookups never touched the network (unless
+				// a filter, an address family or a short snaplen may have hidden
+				// the queries)
+				select {
+				case <-lookupsDone:
+					if !opts.Encrypted && opts.Filter == "" && opts.Family == FamilyAny && opts.Snaplen >= dnsUDPMaxLen && !tracker.sawQueries() {
+						debugf("Lookups succeeded without any query on the wire.")
+						sendCtx(ctx, errorCh, ErrResolvedLocally)
+						return
+					}
+					if opts.All && !opts.WaitFull && tracker.allAnswered() {
+						debugf("Every captured query has been answered.")
+						close(allAnswered)
+						return
+					}
+				default:
+				}
+
+				// Small delay to prevent busy waiting when no packets, unless
+				// the caller trades a CPU for the lowest latency
+				if opts.Immediate {
+					runtime.Gosched()
+				} else {
+					time.Sleep(1 * time.Millisecond)
+				}
+			}
+		}
+	}()
+
+	// Perform the DNS lookups concurrently, each bounded by the timeout so a
+	// dead resolver cannot stretch the run
+	spread := probeSpacing(opts, collect)
+	resolver := &net.Resolver{PreferGo: true}
+	if opts.Source != nil || opts.Resolver != nil {
+		resolver.Dial = lookupDialer(opts)
+	} else if opts.SystemResolver {
+		resolver = net.DefaultResolver
+	}
+	seen := make(map[string]bool)
+	lookupStart := time.Now()
+	lookupFailed := make(chan error, 1)
+	if lookups > 0 {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var lookupErr error
+		complete := true
+		deadline := lookupStart.Add(opts.Timeout)
+		for i := 1; i <= lookups; i++ {
+			wg.Add(1)
+			go func(i int, name string) {
+				defer wg.Done()
+				err := performLookup(ctx, opts, resolver, name, i, time.Duration(i-1)*spread, deadline, &mu)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case ctx.Err() != nil:
+					// Cancelled; the wait below returns ctx.Err()
+					complete = false
+				case errors.Is(err, context.DeadlineExceeded):
+					// Cut off by the timeout; the wait below times out too
+					complete = false
+				case err != nil && lookupErr == nil:
+					lookupErr = err
+				}
+			}(i, names[i-1])
+		}
+		go func() {
+			wg.Wait()
+			switch {
+			case lookupErr != nil:
+				lookupFailed <- lookupErr
+			case complete:
+				close(lookupsDone)
+			}
+		}()
+	}
+
+	// describe fills in the details of the result from a server's first response
+	describe := func(resp response) {
+		result.Server = resp.server
+		if resp.iface != "" {
+			result.Interface = resp.iface
+		}
+		result.Protocol = resp.protocol
+		result.SNI = resp.sni
+		result.Query = resp.query
+		result.EDNS = resp.edns
+		result.DNSSEC = resp.dnssec
+		result.MAC = resp.mac
+		result.ServerPort = resp.serverPort
+		result.ClientPort = resp.clientPort
+		result.Answers = resp.answers
+		result.TTL = resp.ttl
+		result.NextHop = nil
+		if resp.mac != nil && opts.PcapFile == "" {
+			result.NextHop = neighborIP(resp.mac)
+		}
+		if opts.PcapFile != "" {
+			result.Elapsed = resp.timestamp.Sub(resp.queried)
+		} else {
+			result.Elapsed = resp.timestamp.Sub(lookupStart)
+		}
+	}
+
+	// finish picks the server that answered the most lookups with WaitFull;
+	// on a tie the first to answer wins
+	firsts := make(map[string]response)
+	finish := func() (Result, error) {
+		if opts.WaitFull {
+			best := result.Servers[0]
+			for _, server := range result.Servers[1:] {
+				if result.Counts[server.String()] > result.Counts[best.String()] {
+					best = server
+				}
+			}
+			debugf("Best match: %v with %d of the responses", best, result.Counts[best.String()])
+			describe(firsts[best.String()])
+		}
+		return result, nil
+	}
+
+	// Wait for DNS responses or timeout. Without collect the first response
+	// is held until the lookups are over, so a failed lookup is still
+	// reported as such whichever finished first.
+	opts.step(StepWait)
+	timeout := time.After(opts.Timeout)
+	lookupsOver := lookupsDone
+	if lookups == 0 {
+		lookupsOver = nil
+	}
+	// enough reports whether MinServers distinct servers have answered
+	enough := func() bool {
+		return opts.MinServers > 0 && len(result.Servers) >= opts.MinServers
+	}
+	// record takes in one matched response and reports whether the result
+	// is complete without waiting any longer
+	record := func(resp response) bool {
+		dnsIP := resp.server
+		if opts.AllInterfaces {
+			if result.Interfaces == nil {
+				result.Interfaces = make(map[string]string)
+			}
+			if _, ok := result.Interfaces[dnsIP.String()]; !ok {
+				result.Interfaces[dnsIP.String()] = resp.iface
+			}
+		}
+		if result.Server == nil {
+			describe(resp)
+		}
+		if !collect {
+			return lookupsOver == nil
+		}
+		if !seen[dnsIP.String()] {
+			seen[dnsIP.String()] = true
+			firsts[dnsIP.String()] = resp
+			result.Servers = append(result.Servers, dnsIP)
+		}
+		if result.Counts == nil {
+			result.Counts = make(map[string]int)
+		}
+		result.Counts[dnsIP.String()]++
+		if resp.ttl > 0 {
+			if result.TTLCounts == nil {
+				result.TTLCounts = make(map[string]map[int]int)
+			}
+			if result.TTLCounts[dnsIP.String()] == nil {
+				result.TTLCounts[dnsIP.String()] = make(map[int]int)
+			}
+			result.TTLCounts[dnsIP.String()][resp.ttl]++
+		}
+		if resp.protocol == ProtocolDNS {
+			if result.AnswerSets == nil {
+				result.AnswerSets = make(map[string]map[string][]string)
+			}
+			if result.AnswerSets[dnsIP.String()] == nil {
+				result.AnswerSets[dnsIP.String()] = make(map[string][]string)
+			}
+			sets := result.AnswerSets[dnsIP.String()]
+			sets[resp.qtype] = addAnswers(sets[resp.qtype], resp.answers)
+		}
+		return enough() && lookupsOver == nil
+	}
+	// drain records the responses still buffered. The capture goroutine
+	// sends every response before it reports an error or closes
+	// allAnswered, so once either is seen the buffer holds all the rest.
+	drain := func() bool {
+		for {
+			select {
+			case resp := <-dnsResponseCh:
+				if record(resp) {
+					return true
+				}
+			default:
+				return false
+			}
+		}
+	}
+	for {
+		select {
+		case resp := <-dnsResponseCh:
+			if record(resp) {
+				return result, nil
+			}
+		case <-lookupsOver:
+			lookupsOver = nil
+			if (!collect && result.Server != nil) || enough() {
+				return result, nil
+			}
+		case err := <-lookupFailed:
+			return Result{}, fmt.Errorf("%w: %w", ErrLookup, err)
+		case <-allAnswered:
+			drain()
+			return finish()
+		case err := <-errorCh:
+			if drain() {
+				return result, nil
+			}
+			if collect && (errors.Is(err, ErrTimeout) || errors.Is(err, ErrNoResponse)) && len(result.Servers) > 0 {
+				return finish()
+			}
+			return Result{}, err
+		case <-timeout:
+			if collect && len(result.Servers) > 0 {
+				return finish()
+			}
+			if !collect && result.Server != nil {
+				return result, nil
+			}
+			return Result{}, fmt.Errorf("%w after %v", ErrTimeout, opts.Timeout)
+		case <-ctx.Done():
+			return Result{}, ctx.Err()
+		}
+	}
+}
+
+// sendCtx sends v on ch unless ctx is done first, reporting whether it was
+// sent, so a goroutine cannot block forever once nobody is receiving
+func sendCtx[T any](ctx context.Context, ch chan<- T, v T) bool {
+	select {
+	case ch <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// probeSpacing returns the delay between the starts of consecutive lookups:
+// Options.ProbeInterval if set, otherwise none, or when collecting every
+// server enough to spread them over the first half of the timeout so they
+// have a chance to hit different backends
+func probeSpacing(opts Options, collect bool) time.Duration {
+	switch {
+	case opts.ProbeInterval > 0:
+		return opts.ProbeInterval
+	case collect:
+		return opts.Timeout / time.Duration(2*opts.Count)
+	}
+	return 0
+}
+
+// performLookup sends the i-th lookup for name after waiting delay, giving up
+// at deadline. A name or record that does not exist counts as success when
+// it is expected, since the query still went out; OnStep calls are
+// serialised through mu.
+func performLookup(ctx context.Context, opts Options, resolver *net.Resolver, name string, i int, delay time.Duration, deadline time.Time, mu *sync.Mutex) error {
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	infof("Performing DNS lookup for domain: %v (Attempt %d)", name, i)
+	mu.Lock()
+	opts.step(StepLookup)
+	mu.Unlock()
+	if opts.EDNS || opts.DNSSEC {
+		err := ednsLookup(ctx, name, opts)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			debugf("EDNS0 lookup failed: %v", err)
+		}
+		return err
+	}
+	if err := lookup(ctx, resolver, opts.Type, name); err != nil {
+		if ctx.Err() != nil {
+			debugf("DNS lookup for %v cut off: %v", name, err)
+			return ctx.Err()
+		}
+		// A random subdomain may well not exist, nor a record of the
+		// requested type; the query still went out
+		var dnsErr *net.DNSError
+		if (opts.Unique || opts.Type != "") && errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			debugf("Lookup for %v found no records: %v", name, err)
+			return nil
+		}
+		debugf("DNS lookup failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// lookupDialer returns a resolver dial function that sends queries from
+// opts.Source, if set, to opts.Resolver on opts.Port, if set, in place of the
+// nameserver the resolver picked
+func lookupDialer(opts Options) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		var d net.Dialer
+		if opts.Source != nil && strings.HasPrefix(network, "tcp") {
+			d.LocalAddr = &net.TCPAddr{IP: opts.Source}
+		} else if opts.Source != nil {
+			d.LocalAddr = &net.UDPAddr{IP: opts.Source}
+		}
+		if opts.Resolver != nil {
+			address = net.JoinHostPort(opts.Resolver.String(), strconv.Itoa(opts.Port))
+		}
+		if opts.Source != nil {
+			debugf("Dialing DNS server %v over %v from %v", address, network, opts.Source)
+		} else {
+			debugf("Dialing DNS server %v over %v", address, network)
+		}
+		return d.DialContext(ctx, network, address)
+	}
+}
+
+// captureInterfaces returns the interfaces to capture on: the requested one,
+// every usable one with AllInterfaces, the one holding the source address, or
+// the default one. A source address must be local even if it does not pick
+// the interface, since the lookups are bound to it.
+func captureInterfaces(opts Options) ([]net.Interface, error) {
+	var sourceIface *net.Interface
+	if opts.Source != nil {
+		var err error
+		if sourceIface, err = findInterfaceWithIP(systemInterfaces{}, opts.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.AllInterfaces {
+		return findCaptureInterfaces(systemInterfaces{}, opts.IPv6)
+	}
+
+	var iface *net.Interface
+	var err error
+	if opts.Interface != "" {
+		iface, err = findNamedNetworkInterface(systemInterfaces{}, opts.Interface, opts.IPv6)
+	} else if opts.Loopback || (sourceIface == nil && opts.Resolver.IsLoopback()) {
+		iface, err = findLoopbackInterface(systemInterfaces{}, opts.IPv6)
+	} else if sourceIface != nil {
+		iface = sourceIface
+	} else {
+		iface, err = findDefaultNetworkInterface(systemInterfaces{}, opts.IPv6)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []net.Interface{*iface}, nil
+}
+
+// openLiveSource opens an AF_PACKET socket on each interface, retrying while
+// the interface settles, and merges them when there are several. If any
+// socket cannot be opened, the ones already open are closed again.
+func openLiveSource(ctx context.Context, opts Options, ifaces []net.Interface) (packetSource, error) {
+	var sources []packetSource
+	for i := range ifaces {
+		var sock *afPacketSource
+		err := retry(ctx, opts.Retries, retryBackoff, func() error {
+			var err error
+			sock, err = openAFPacketSource(&ifaces[i], opts.Snaplen, opts.BufferSize)
+			return err
+		})
+		if err != nil {
+			for _, src := range sources {
+				src.Close()
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("%w: %w", ErrCaptureOpen, err)
+		}
+		infof("Capturing on interface %v.", ifaces[i].Name)
+		sources = append(sources, sock)
+	}
+
+	if len(sources) == 1 {
+		return sources[0], nil
+	}
+	return &multiSource{sources: sources}, nil
+}
+
+// uniqueName returns domain prefixed with a random label
+func uniqueName(domain string) string {
+	label := make([]byte, 6)
+	rand.Read(label)
+	return hex.EncodeToString(label) + "." + strings.TrimPrefix(domain, ".")
+}
+
+// retry calls fn until it succeeds or retries further attempts have failed,
+// waiting backoff before the first retry and doubling the wait each time.
+// It returns the last error, or ctx.Err() if ctx is cancelled while waiting.
+func retry(ctx context.Context, retries int, backoff time.Duration, fn func() error) error {
+	err := fn()
+	for attempt := 1; err != nil && attempt <= retries; attempt++ {
+		debugf("Attempt %d failed: %v; retrying in %v", attempt, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
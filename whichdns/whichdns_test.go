@@ -0,0 +1,458 @@
+package whichdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writePcap writes frames to a little-endian microsecond pcap file, one millisecond apart
+func writePcap(t *testing.T, frames ...[]byte) string {
+	t.Helper()
+	return writePcapLink(t, linkTypeEthernet, frames...)
+}
+
+// writePcapLink is writePcap for frames of the given link type
+func writePcapLink(t *testing.T, linkType uint32, frames ...[]byte) string {
+	t.Helper()
+
+	hdr := make([]byte, pcapGlobalHdrLen)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagicMicros)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkType)
+
+	data := hdr
+	for i, frame := range frames {
+		rec := make([]byte, pcapRecordHdrLen)
+		binary.LittleEndian.PutUint32(rec[0:4], 1700000000)
+		binary.LittleEndian.PutUint32(rec[4:8], uint32(i*1000))
+		binary.LittleEndian.PutUint32(rec[8:12], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(rec[12:16], uint32(len(frame)))
+		data = append(data, rec...)
+		data = append(data, frame...)
+	}
+
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("Failed to write capture file: %v", err)
+	}
+	return path
+}
+
+func TestDetectPcapFile(t *testing.T) {
+	path := writePcap(t,
+		buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(7, false, "example.com")),
+		buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, buildDNSPayload(7, true, "example.com")),
+	)
+
+	result, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: path})
+	if err != nil {
+		t.Fatalf("Detect failed: %v", err)
+	}
+	if result.Server.String() != "192.168.1.1" {
+		t.Errorf("Expected server 192.168.1.1, got %v", result.Server)
+	}
+	if result.Elapsed != time.Millisecond {
+		t.Errorf("Expected elapsed 1ms between query and response, got %v", result.Elapsed)
+	}
+}
+
+func TestDetectPcapFileOnPacket(t *testing.T) {
+	path := writePcap(t,
+		buildUDPFrame("192.168.1.10", "192.168.1.20", 40000, 123, nil),
+		buildUDPFrame("192.168.1.10", "10.9.9.9", 40001, 53, buildDNSPayload(6, false, "example.com")),
+		buildUDPFrame("192.168.1.10", "192.168.1.1", 40002, 53, buildDNSPayload(7, false, "example.com")),
+		buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40002, buildDNSPayload(7, true, "example.com")),
+	)
+
+	var seen atomic.Int32
+	var first atomic.Value
+	opts := Options{Domain: "example.com", PcapFile: path, Filter: "not host 10.9.9.9", OnPacket: func(p Packet) {
+		if seen.Add(1) == 1 {
+			first.Store(p)
+		}
+	}}
+	if _, err := Detect(context.Background(), opts); err != nil {
+		t.Fatalf("Detect failed: %v", err)
+	}
+	if n := seen.Load(); n != 3 {
+		t.Errorf("Expected OnPacket for the 3 packets passing the filter, got %d", n)
+	}
+	p, _ := first.Load().(Packet)
+	if p.Length != len(p.Data) || p.Length == 0 || p.Timestamp.IsZero() {
+		t.Errorf("Expected the unrelated first packet with its length and timestamp, got %+v", p)
+	}
+}
+
+func TestDetectPcapFileFamily(t *testing.T) {
+	path := writePcap(t,
+		buildUDP6Frame("2001:db8::10", "2001:db8::53", 40000, 53, buildDNSPayload(7, false, "example.com")),
+		buildUDPFrame("192.168.1.10", "192.168.1.1", 40001, 53, buildDNSPayload(8, false, "example.com")),
+		buildUDP6Frame("2001:db8::53", "2001:db8::10", 53, 40000, buildDNSPayload(7, true, "example.com")),
+		buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40001, buildDNSPayload(8, true, "example.com")),
+	)
+
+	for family, want := range map[string]string{FamilyAny: "2001:db8::53", FamilyIPv6: "2001:db8::53", FamilyIPv4: "192.168.1.1"} {
+		result, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: path, Family: family})
+		if err != nil {
+			t.Fatalf("Detect with family %s failed: %v", family, err)
+		}
+		if result.Server.String() != want {
+			t.Errorf("Expected server %s with family %s, got %v", want, family, result.Server)
+		}
+	}
+
+	if _, err := Detect(context.Background(), Options{PcapFile: path, Family: FamilyIPv4, IPv6: true}); err == nil {
+		t.Error("Expected family 4 with IPv6 to be rejected")
+	}
+}
+
+func TestDetectNoGoroutineLeak(t *testing.T) {
+	path := writePcap(t,
+		buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(7, false, "example.com")),
+		buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, buildDNSPayload(7, true, "example.com")),
+	)
+	// A slow OnPacket makes Detect time out before the response is matched,
+	// leaving the capture goroutine with a response nobody will receive
+	opts := Options{Domain: "example.com", PcapFile: path, Timeout: 5 * time.Millisecond, OnPacket: func(Packet) {
+		time.Sleep(10 * time.Millisecond)
+	}}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		if _, err := Detect(context.Background(), opts); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("Expected a timeout, got %v", err)
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected no goroutines left behind by Detect, had %d before and %d after", before, after)
+	}
+}
+
+func TestDetectPcapFilePort(t *testing.T) {
+	path := writePcap(t,
+		buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(7, false, "example.com")),
+		buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, buildDNSPayload(7, true, "example.com")),
+		buildUDPFrame("192.168.1.10", "10.0.0.53", 40001, 5353, buildDNSPayload(8, false, "example.com")),
+		buildUDPFrame("10.0.0.53", "192.168.1.10", 5353, 40001, buildDNSPayload(8, true, "example.com")),
+	)
+
+	result, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: path, Port: 5353})
+	if err != nil {
+		t.Fatalf("Detect failed: %v", err)
+	}
+	if result.Server.String() != "10.0.0.53" {
+		t.Errorf("Expected server 10.0.0.53 on port 5353, got %v", result.Server)
+	}
+
+	if _, err := Detect(context.Background(), Options{PcapFile: path, Port: 70000}); err == nil {
+		t.Error("Expected port 70000 to be rejected")
+	}
+}
+
+func TestDetectPcapFileFragmentedFiltered(t *testing.T) {
+	payload := buildDNSPayload(7, true, "example.com")
+	payload = append(payload, make([]byte, 64)...)
+	tests := []struct {
+		filter   string
+		query    []byte
+		response []byte
+	}{
+		{
+			"host 192.168.1.1",
+			buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(7, false, "example.com")),
+			buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, payload),
+		},
+		{
+			"host 2001:db8::53",
+			buildUDP6Frame("2001:db8::10", "2001:db8::53", 40000, 53, buildDNSPayload(7, false, "example.com")),
+			buildUDP6Frame("2001:db8::53", "2001:db8::10", 53, 40000, payload),
+		},
+	}
+	for _, tt := range tests {
+		// The last fragment is shorter than a UDP header
+		frags := fragmentFrame(tt.response, 0x1234, 96)
+		path := writePcap(t, tt.query, frags[0], frags[1])
+		result, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: path, Filter: tt.filter})
+		if err != nil {
+			t.Errorf("%s: Detect failed: %v", tt.filter, err)
+			continue
+		}
+		if result.Query != "example.com" {
+			t.Errorf("%s: expected the reassembled response, got %+v", tt.filter, result)
+		}
+	}
+}
+
+func TestDetectPcapFileUnreachable(t *testing.T) {
+	query := buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(7, false, "example.com"))
+	path := writePcap(t,
+		// Not about a captured query
+		buildICMPFrame("192.168.1.2", "192.168.1.10", 3, buildUDPFrame("192.168.1.10", "192.168.1.2", 41000, 53, nil)),
+		query,
+		buildICMPFrame("192.168.1.1", "192.168.1.10", 3, query),
+	)
+
+	_, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: path})
+	if !errors.Is(err, ErrUnreachable) || !strings.Contains(err.Error(), "192.168.1.1 port 53 refused the query") {
+		t.Errorf("Expected ErrUnreachable for 192.168.1.1, got %v", err)
+	}
+
+	// Collecting, other servers may still answer
+	if _, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: path, All: true}); !errors.Is(err, ErrNoResponse) {
+		t.Errorf("Expected ErrNoResponse with All, got %v", err)
+	}
+
+	// A capture filter must not hide the ICMP message, which has no UDP header
+	_, err = Detect(context.Background(), Options{Domain: "example.com", PcapFile: path, Filter: "host 192.168.1.1"})
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected ErrUnreachable with a capture filter, got %v", err)
+	}
+}
+
+func TestDetectOnUnreachableLocalFilter(t *testing.T) {
+	lo, err := LoopbackInterface(false)
+	if err != nil {
+		t.Skipf("No loopback interface: %v", err)
+	}
+
+	// The capture interface's addresses make up the default host filter
+	query := buildUDPFrame("127.0.0.1", "127.0.0.53", 40000, 53, buildDNSPayload(7, false, "example.com"))
+	src := &queueSource{err: io.EOF, packets: []*capturedPacket{
+		{data: query},
+		{data: buildICMPFrame("127.0.0.53", "127.0.0.1", 3, query)},
+	}}
+	opts := Options{Domain: "example.com", PcapFile: "loopback.pcap"}.withDefaults()
+	_, err = detectOn(context.Background(), opts, src, []net.Interface{*lo}, nil)
+	if !errors.Is(err, ErrUnreachable) || !strings.Contains(err.Error(), "127.0.0.53 port 53 refused the query") {
+		t.Errorf("Expected ErrUnreachable for 127.0.0.53, got %v", err)
+	}
+}
+
+func TestDetectPcapFileLoopback(t *testing.T) {
+	// BSD loopback captures carry the address family instead of an Ethernet
+	// header: 2 for IPv4 everywhere, 30 for IPv6 on macOS
+	null := func(family byte, frame []byte) []byte {
+		return append([]byte{family, 0, 0, 0}, frame[ethHeaderLen:]...)
+	}
+	path := writePcapLink(t, linkTypeNull,
+		null(2, buildUDPFrame("127.0.0.1", "127.0.0.1", 40000, 53, buildDNSPayload(7, false, "example.com"))),
+		null(30, buildUDP6Frame("::1", "::1", 40001, 53, buildDNSPayload(8, false, "example.com"))),
+		null(30, buildUDP6Frame("::1", "::1", 53, 40001, buildDNSPayload(8, true, "example.com"))),
+		null(2, buildUDPFrame("127.0.0.1", "127.0.0.1", 53, 40000, buildDNSPayload(7, true, "example.com"))),
+	)
+
+	result, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: path, All: true})
+	if err != nil {
+		t.Fatalf("Detect failed: %v", err)
+	}
+	if len(result.Servers) != 2 || result.Servers[0].String() != "::1" || result.Servers[1].String() != "127.0.0.1" {
+		t.Errorf("Expected servers [::1 127.0.0.1], got %v", result.Servers)
+	}
+	if result.MAC != nil {
+		t.Errorf("Expected no MAC address on loopback, got %v", result.MAC)
+	}
+}
+
+func TestDetectPcapFileAll(t *testing.T) {
+	path := writePcap(t,
+		buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(7, false, "example.com")),
+		buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, buildDNSPayload(7, true, "example.com")),
+		buildUDPFrame("192.168.1.10", "192.168.1.2", 40001, 53, buildDNSPayload(8, false, "example.com")),
+		buildUDPFrame("192.168.1.2", "192.168.1.10", 53, 40001, buildDNSPayload(8, true, "example.com")),
+		buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, buildDNSPayload(7, true, "example.com")),
+	)
+
+	result, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: path, All: true})
+	if err != nil {
+		t.Fatalf("Detect failed: %v", err)
+	}
+	if len(result.Servers) != 2 || result.Servers[0].String() != "192.168.1.1" || result.Servers[1].String() != "192.168.1.2" {
+		t.Errorf("Expected servers [192.168.1.1 192.168.1.2], got %v", result.Servers)
+	}
+	if result.Counts["192.168.1.1"] != 2 || result.Counts["192.168.1.2"] != 1 {
+		t.Errorf("Expected counts 2 and 1, got %v", result.Counts)
+	}
+	if result.TTL != 64 || result.TTLCounts["192.168.1.1"][64] != 2 {
+		t.Errorf("Expected TTL 64 for both responses of 192.168.1.1, got %d and %v", result.TTL, result.TTLCounts)
+	}
+	if set, ok := result.AnswerSets["192.168.1.2"]["A"]; !ok || len(set) != 0 || len(result.AnswerConflicts()) != 0 {
+		t.Errorf("Expected empty answer sets and no conflicts, got %v", result.AnswerSets)
+	}
+
+	// MinServers stops at the first server when one is enough
+	result, err = Detect(context.Background(), Options{Domain: "example.com", PcapFile: path, All: true, MinServers: 1})
+	if err != nil {
+		t.Fatalf("Detect failed: %v", err)
+	}
+	if len(result.Servers) != 1 || result.Counts["192.168.1.1"] != 1 {
+		t.Errorf("Expected to stop after the first response, got %v %v", result.Servers, result.Counts)
+	}
+	if _, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: path, WaitFull: true, MinServers: 1}); err == nil {
+		t.Error("Expected MinServers without All to be rejected")
+	}
+}
+
+func TestDetectPcapFileWaitFull(t *testing.T) {
+	// A stray server answers first, but the real one answers more of the queries
+	path := writePcap(t,
+		buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(7, false, "example.com")),
+		buildUDPFrame("192.168.1.10", "192.168.1.1", 40001, 53, buildDNSPayload(8, false, "example.com")),
+		buildUDPFrame("10.9.9.9", "192.168.1.10", 53, 40000, buildDNSPayload(7, true, "example.com")),
+		buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, buildDNSPayload(7, true, "example.com")),
+		buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40001, buildDNSPayload(8, true, "example.com")),
+	)
+
+	result, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: path})
+	if err != nil {
+		t.Fatalf("Detect failed: %v", err)
+	}
+	if result.Server.String() != "10.9.9.9" {
+		t.Errorf("Expected the first answer from 10.9.9.9 by default, got %v", result.Server)
+	}
+
+	result, err = Detect(context.Background(), Options{Domain: "example.com", PcapFile: path, WaitFull: true})
+	if err != nil {
+		t.Fatalf("Detect failed: %v", err)
+	}
+	if result.Server.String() != "192.168.1.1" {
+		t.Errorf("Expected 192.168.1.1 to win with most answers, got %v", result.Server)
+	}
+	if result.Counts["192.168.1.1"] != 2 || result.Counts["10.9.9.9"] != 1 {
+		t.Errorf("Expected counts 2 and 1, got %v", result.Counts)
+	}
+	if result.Elapsed != 3*time.Millisecond {
+		t.Errorf("Expected the winner's response time of 3ms, got %v", result.Elapsed)
+	}
+}
+
+func TestDetectPcapFileNoResponse(t *testing.T) {
+	path := writePcap(t,
+		buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(7, false, "example.com")),
+	)
+
+	_, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: path})
+	if !errors.Is(err, ErrNoResponse) {
+		t.Errorf("Expected ErrNoResponse, got %v", err)
+	}
+}
+
+func TestOpenPcapFileRejectsPcapng(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	if err := os.WriteFile(path, []byte{0x0a, 0x0d, 0x0d, 0x0a, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 0o644); err != nil {
+		t.Fatalf("Failed to write capture file: %v", err)
+	}
+
+	if _, err := openPcapFile(path); err == nil {
+		t.Error("Expected pcapng file to be rejected")
+	}
+}
+
+func TestDetectWriteFile(t *testing.T) {
+	path := writePcap(t,
+		buildUDPFrame("192.168.1.10", "192.168.1.1", 40000, 53, buildDNSPayload(7, false, "example.com")),
+		buildUDPFrame("192.168.1.1", "192.168.1.10", 53, 40000, buildDNSPayload(7, true, "example.com")),
+	)
+	out := filepath.Join(t.TempDir(), "copy.pcap")
+
+	if _, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: path, WriteFile: out}); err != nil {
+		t.Fatalf("Detect failed: %v", err)
+	}
+
+	// The written file must be readable and contain the same traffic
+	result, err := Detect(context.Background(), Options{Domain: "example.com", PcapFile: out})
+	if err != nil {
+		t.Fatalf("Detect on written file failed: %v", err)
+	}
+	if result.Server.String() != "192.168.1.1" {
+		t.Errorf("Expected server 192.168.1.1, got %v", result.Server)
+	}
+}
+
+func TestProbeSpacing(t *testing.T) {
+	opts := Options{Count: 4, Timeout: 8 * time.Second}
+	if got := probeSpacing(opts, false); got != 0 {
+		t.Errorf("Expected lookups to start together by default, got %v apart", got)
+	}
+	if got := probeSpacing(opts, true); got != time.Second {
+		t.Errorf("Expected lookups spread over half the timeout when collecting, got %v apart", got)
+	}
+	opts.ProbeInterval = 300 * time.Millisecond
+	if got := probeSpacing(opts, true); got != opts.ProbeInterval {
+		t.Errorf("Expected the probe interval to win, got %v apart", got)
+	}
+
+	// The fourth lookup would start at 3s, after the timeout
+	if _, err := Detect(context.Background(), Options{PcapFile: "capture.pcap", Timeout: 2 * time.Second, ProbeInterval: time.Second}); err == nil || !strings.Contains(err.Error(), "probe interval") {
+		t.Error("Expected a probe interval reaching past the timeout to be rejected")
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	first, second := uniqueName("example.com"), uniqueName("example.com")
+	if first == second {
+		t.Errorf("Expected distinct names, got %v twice", first)
+	}
+	if !strings.HasSuffix(first, ".example.com") {
+		t.Errorf("Expected a subdomain of example.com, got %v", first)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	failing := errors.New("interface flapping")
+	tests := []struct {
+		name     string
+		failures int
+		retries  int
+		calls    int
+		ok       bool
+	}{
+		{"first attempt succeeds", 0, 3, 1, true},
+		{"succeeds after retries", 2, 3, 3, true},
+		{"retries exhausted", 5, 3, 4, false},
+		{"no retries", 1, 0, 1, false},
+	}
+
+	for _, tt := range tests {
+		calls := 0
+		err := retry(context.Background(), tt.retries, time.Millisecond, func() error {
+			calls++
+			if calls <= tt.failures {
+				return failing
+			}
+			return nil
+		})
+		if (err == nil) != tt.ok || calls != tt.calls {
+			t.Errorf("%s: got (%v, %d calls), want ok=%v with %d calls", tt.name, err, calls, tt.ok, tt.calls)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := retry(ctx, 3, time.Hour, func() error { return failing }); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancellation to stop retries, got %v", err)
+	}
+}
+
+func TestDetectDomainsRejectsFiles(t *testing.T) {
+	called := false
+	err := DetectDomains(context.Background(), Options{PcapFile: "capture.pcap"}, []string{"example.com", "example.org"}, 0,
+		func(int, Result, error) { called = true })
+	if err == nil {
+		t.Error("Expected DetectDomains to reject a capture file")
+	}
+	if called {
+		t.Error("Expected no domain to be reported")
+	}
+}